@@ -8,15 +8,21 @@ import (
 	"os/signal"
 	"syscall"
 	"time"
+	// APP_TIMEZONE をタイムゾーンデータのないコンテナでも解決できるよう埋め込む
+	_ "time/tzdata"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 
+	"github.com/ymmtyamaterous/diary-oc-api/internal/auth"
 	"github.com/ymmtyamaterous/diary-oc-api/internal/config"
 	"github.com/ymmtyamaterous/diary-oc-api/internal/server"
 )
 
 func main() {
 	cfg := config.Load()
+	if err := cfg.Validate(); err != nil {
+		log.Fatal(err)
+	}
 	if cfg.DatabaseURL == "" {
 		log.Fatal("DATABASE_URL が設定されていません")
 	}
@@ -36,10 +42,22 @@ func main() {
 		log.Fatalf("UPLOAD_DIR 作成に失敗しました: %v", err)
 	}
 
-	handler := server.New(cfg, db).Router()
+	keys, err := auth.LoadKeySet(cfg.JWTSecret, cfg.JWTPrivateKeyFile, cfg.JWTPreviousKeyFiles)
+	if err != nil {
+		log.Fatalf("JWT 署名鍵の読み込みに失敗しました: %v", err)
+	}
+
+	srv := server.New(cfg, db, keys)
+	if err := srv.LoadBreachedPasswords(cfg.PasswordBreachedListFile); err != nil {
+		log.Fatalf("パスワード禁止リストの読み込みに失敗しました: %v", err)
+	}
+	maintenanceCtx, stopMaintenance := context.WithCancel(ctx)
+	defer stopMaintenance()
+	go srv.RunMaintenance(maintenanceCtx)
+
 	httpServer := &http.Server{
 		Addr:         cfg.Host + ":" + cfg.APIPort,
-		Handler:      handler,
+		Handler:      srv.Router(),
 		ReadTimeout:  15 * time.Second,
 		WriteTimeout: 30 * time.Second,
 		IdleTimeout:  60 * time.Second,
@@ -8,33 +8,29 @@ import (
 )
 
 type Claims struct {
-	UserID string `json:"uid"`
-	Email  string `json:"email"`
+	UserID    string `json:"uid"`
+	Email     string `json:"email"`
+	SessionID string `json:"sid"`
 	jwt.RegisteredClaims
 }
 
-func GenerateToken(userID, email, secret string, hours int) (string, error) {
+func GenerateToken(userID, email, sessionID string, keys *KeySet, ttl time.Duration) (string, error) {
 	now := time.Now()
 	claims := Claims{
-		UserID: userID,
-		Email:  email,
+		UserID:    userID,
+		Email:     email,
+		SessionID: sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
 			Subject:   userID,
 			IssuedAt:  jwt.NewNumericDate(now),
-			ExpiresAt: jwt.NewNumericDate(now.Add(time.Duration(hours) * time.Hour)),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
 		},
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(secret))
+	return keys.sign(claims)
 }
 
-func ParseToken(raw, secret string) (*Claims, error) {
-	token, err := jwt.ParseWithClaims(raw, &Claims{}, func(token *jwt.Token) (any, error) {
-		if token.Method != jwt.SigningMethodHS256 {
-			return nil, fmt.Errorf("unexpected signing method")
-		}
-		return []byte(secret), nil
-	})
+func ParseToken(raw string, keys *KeySet) (*Claims, error) {
+	token, err := keys.parse(raw, &Claims{})
 	if err != nil {
 		return nil, err
 	}
@@ -43,7 +39,48 @@ func ParseToken(raw, secret string) (*Claims, error) {
 	if !ok || !token.Valid {
 		return nil, fmt.Errorf("invalid token")
 	}
-	if claims.UserID == "" {
+	if claims.UserID == "" || claims.SessionID == "" {
+		return nil, fmt.Errorf("invalid token claims")
+	}
+
+	return claims, nil
+}
+
+const mfaPendingPurpose = "mfa_pending"
+
+// MFAClaims は2段階認証の途中であることを表す短命トークンのクレーム。
+// sid を持たないため通常のアクセストークンとしては受け付けられない。
+type MFAClaims struct {
+	UserID  string `json:"uid"`
+	Purpose string `json:"purpose"`
+	jwt.RegisteredClaims
+}
+
+func GenerateMFAToken(userID string, keys *KeySet, ttl time.Duration) (string, error) {
+	now := time.Now()
+	claims := MFAClaims{
+		UserID:  userID,
+		Purpose: mfaPendingPurpose,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   userID,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		},
+	}
+	return keys.sign(claims)
+}
+
+func ParseMFAToken(raw string, keys *KeySet) (*MFAClaims, error) {
+	token, err := keys.parse(raw, &MFAClaims{})
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(*MFAClaims)
+	if !ok || !token.Valid {
+		return nil, fmt.Errorf("invalid token")
+	}
+	if claims.UserID == "" || claims.Purpose != mfaPendingPurpose {
 		return nil, fmt.Errorf("invalid token claims")
 	}
 
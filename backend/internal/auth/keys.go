@@ -0,0 +1,224 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const minRSAKeyBits = 2048
+
+// KeySet はトークンの署名鍵の集合。現在の鍵で署名し、kid が一致する鍵(ローテーション前の鍵を含む)で検証する。
+type KeySet struct {
+	current *signingKey
+	keys    map[string]*signingKey
+}
+
+type signingKey struct {
+	id      string
+	method  jwt.SigningMethod
+	private any
+	public  any
+}
+
+// JWK は公開鍵を JSON Web Key (RFC 7517) で表したもの。
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// NewHMACKeySet は JWT_SECRET による HS256 の鍵を返す。非対称鍵が設定されていない開発環境向け。
+func NewHMACKeySet(secret string) *KeySet {
+	key := &signingKey{method: jwt.SigningMethodHS256, private: []byte(secret), public: []byte(secret)}
+	return &KeySet{current: key, keys: map[string]*signingKey{"": key}}
+}
+
+// NewKeySet は current で署名し、current と previous で検証する鍵の集合を返す。
+// RSA 鍵は RS256、Ed25519 鍵は EdDSA で署名し、kid には RFC 7638 の thumbprint を使う。
+func NewKeySet(current crypto.Signer, previous ...crypto.Signer) (*KeySet, error) {
+	set := &KeySet{keys: map[string]*signingKey{}}
+	for i, signer := range append([]crypto.Signer{current}, previous...) {
+		key, err := newSigningKey(signer)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			set.current = key
+		}
+		set.keys[key.id] = key
+	}
+	return set, nil
+}
+
+// LoadKeySet は PEM 形式の秘密鍵ファイルを読み込む。currentFile が空の場合は secret による HS256 を使う。
+func LoadKeySet(secret, currentFile string, previousFiles []string) (*KeySet, error) {
+	if currentFile == "" {
+		return NewHMACKeySet(secret), nil
+	}
+
+	signers := make([]crypto.Signer, 0, len(previousFiles)+1)
+	for _, path := range append([]string{currentFile}, previousFiles...) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ParsePrivateKeyPEM(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		signers = append(signers, signer)
+	}
+	return NewKeySet(signers[0], signers[1:]...)
+}
+
+// ParsePrivateKeyPEM は PKCS#8 または PKCS#1 形式の RSA / Ed25519 秘密鍵を読み込む。
+func ParsePrivateKeyPEM(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, errors.New("unsupported private key")
+		}
+		return signer, nil
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+}
+
+func newSigningKey(signer crypto.Signer) (*signingKey, error) {
+	switch private := signer.(type) {
+	case *rsa.PrivateKey:
+		if private.N.BitLen() < minRSAKeyBits {
+			return nil, fmt.Errorf("RSA key must be at least %d bits", minRSAKeyBits)
+		}
+		key := &signingKey{method: jwt.SigningMethodRS256, private: private, public: &private.PublicKey}
+		key.id = thumbprint(key.jwk())
+		return key, nil
+	case ed25519.PrivateKey:
+		key := &signingKey{method: jwt.SigningMethodEdDSA, private: private, public: private.Public()}
+		key.id = thumbprint(key.jwk())
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", signer)
+	}
+}
+
+// sign は現在の鍵でクレームに署名する。
+func (k *KeySet) sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(k.current.method, claims)
+	if k.current.id != "" {
+		token.Header["kid"] = k.current.id
+	}
+	return token.SignedString(k.current.private)
+}
+
+// parse は kid で選んだ鍵で検証する。鍵と異なるアルゴリズムのトークン(alg の差し替え)は拒否する。
+func (k *KeySet) parse(raw string, claims jwt.Claims) (*jwt.Token, error) {
+	return jwt.ParseWithClaims(raw, claims, func(token *jwt.Token) (any, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, ok := k.keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown key id %q", kid)
+		}
+		if token.Method.Alg() != key.method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return key.public, nil
+	}, jwt.WithValidMethods(k.methods()))
+}
+
+func (k *KeySet) methods() []string {
+	seen := map[string]bool{}
+	methods := make([]string, 0, len(k.keys))
+	for _, key := range k.keys {
+		if alg := key.method.Alg(); !seen[alg] {
+			seen[alg] = true
+			methods = append(methods, alg)
+		}
+	}
+	return methods
+}
+
+// JWKS は検証用の公開鍵を返す。HS256 の共有鍵は公開しない。先頭が現在の署名鍵。
+func (k *KeySet) JWKS() JWKSet {
+	set := JWKSet{Keys: []JWK{}}
+	if k.current.id == "" {
+		return set
+	}
+	set.Keys = append(set.Keys, k.current.jwk())
+	for id, key := range k.keys {
+		if id != k.current.id {
+			set.Keys = append(set.Keys, key.jwk())
+		}
+	}
+	return set
+}
+
+func (key *signingKey) jwk() JWK {
+	jwk := JWK{Kid: key.id, Use: "sig", Alg: key.method.Alg()}
+	switch public := key.public.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(public)
+	}
+	return jwk
+}
+
+// thumbprint は RFC 7638 の JWK Thumbprint (SHA-256) を返す。必須メンバーのみを辞書順で並べる。
+func thumbprint(jwk JWK) string {
+	var members any
+	switch jwk.Kty {
+	case "RSA":
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{jwk.E, jwk.Kty, jwk.N}
+	default:
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{jwk.Crv, jwk.Kty, jwk.X}
+	}
+	data, _ := json.Marshal(members)
+	sum := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,177 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func mustEd25519(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate ed25519 key: %v", err)
+	}
+	return key
+}
+
+func mustRSA(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate rsa key: %v", err)
+	}
+	return key
+}
+
+func TestAsymmetricKeySetRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		key  crypto.Signer
+		alg  string
+	}{
+		{name: "ed25519", key: mustEd25519(t), alg: "EdDSA"},
+		{name: "rsa", key: mustRSA(t), alg: "RS256"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, err := NewKeySet(tt.key)
+			if err != nil {
+				t.Fatalf("NewKeySet() error = %v", err)
+			}
+			token, err := GenerateToken("user-1", "a@example.com", "session-1", keys, time.Minute)
+			if err != nil {
+				t.Fatalf("GenerateToken() error = %v", err)
+			}
+			if _, err := ParseToken(token, keys); err != nil {
+				t.Fatalf("ParseToken() error = %v", err)
+			}
+
+			jwks := keys.JWKS()
+			if len(jwks.Keys) != 1 || jwks.Keys[0].Alg != tt.alg || jwks.Keys[0].Kid == "" {
+				t.Fatalf("unexpected jwks: %+v", jwks)
+			}
+		})
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	oldKey, newKey := mustEd25519(t), mustEd25519(t)
+
+	before, err := NewKeySet(oldKey)
+	if err != nil {
+		t.Fatalf("NewKeySet() error = %v", err)
+	}
+	oldToken, err := GenerateToken("user-1", "a@example.com", "session-1", before, time.Minute)
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+
+	rotated, err := NewKeySet(newKey, oldKey)
+	if err != nil {
+		t.Fatalf("NewKeySet() error = %v", err)
+	}
+	if _, err := ParseToken(oldToken, rotated); err != nil {
+		t.Fatalf("token signed with the previous key should still verify: %v", err)
+	}
+	newToken, err := GenerateToken("user-1", "a@example.com", "session-1", rotated, time.Minute)
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+	if _, err := ParseToken(newToken, before); err == nil {
+		t.Fatal("old key set should not know the new key")
+	}
+	if jwks := rotated.JWKS(); len(jwks.Keys) != 2 || jwks.Keys[0].Kid != rotated.current.id {
+		t.Fatalf("current key should be listed first: %+v", jwks)
+	}
+
+	retired, err := NewKeySet(newKey)
+	if err != nil {
+		t.Fatalf("NewKeySet() error = %v", err)
+	}
+	if _, err := ParseToken(oldToken, retired); err == nil {
+		t.Fatal("token signed with a retired key should be rejected")
+	}
+}
+
+func TestKeySetRejectsOtherAlgorithms(t *testing.T) {
+	keys, err := NewKeySet(mustEd25519(t))
+	if err != nil {
+		t.Fatalf("NewKeySet() error = %v", err)
+	}
+
+	hmacToken, err := GenerateToken("user-1", "a@example.com", "session-1", NewHMACKeySet("secret"), time.Minute)
+	if err != nil {
+		t.Fatalf("GenerateToken() error = %v", err)
+	}
+	if _, err := ParseToken(hmacToken, keys); err == nil {
+		t.Fatal("HS256 token must not be accepted by an asymmetric key set")
+	}
+	if jwks := NewHMACKeySet("secret").JWKS(); len(jwks.Keys) != 0 {
+		t.Fatal("shared secrets must not be published")
+	}
+}
+
+func TestNewKeySetRejectsWeakRSA(t *testing.T) {
+	weak, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("generate rsa key: %v", err)
+	}
+	if _, err := NewKeySet(weak); err == nil {
+		t.Fatal("1024-bit RSA key should be rejected")
+	}
+}
+
+func TestLoadKeySet(t *testing.T) {
+	dir := t.TempDir()
+	writeKey := func(name string, key crypto.Signer) string {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatalf("marshal key: %v", err)
+		}
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+			t.Fatalf("write key: %v", err)
+		}
+		return path
+	}
+	current := writeKey("current.pem", mustEd25519(t))
+	previous := writeKey("previous.pem", mustRSA(t))
+
+	keys, err := LoadKeySet("secret", current, []string{previous})
+	if err != nil {
+		t.Fatalf("LoadKeySet() error = %v", err)
+	}
+	if len(keys.JWKS().Keys) != 2 || keys.current.method.Alg() != "EdDSA" {
+		t.Fatalf("unexpected key set: %+v", keys.JWKS())
+	}
+
+	hmac, err := LoadKeySet("secret", "", nil)
+	if err != nil || hmac.current.method.Alg() != "HS256" {
+		t.Fatalf("empty key file should fall back to HS256: %v", err)
+	}
+
+	if _, err := LoadKeySet("secret", filepath.Join(dir, "missing.pem"), nil); err == nil {
+		t.Fatal("missing key file should fail")
+	}
+}
+
+// RFC 7638 Section 3.1 の例。
+func TestThumbprint(t *testing.T) {
+	jwk := JWK{
+		Kty: "RSA",
+		E:   "AQAB",
+		N:   "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+	}
+	if got, want := thumbprint(jwk), "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs"; got != want {
+		t.Fatalf("thumbprint() = %q, want %q", got, want)
+	}
+}
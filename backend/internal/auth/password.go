@@ -1,15 +1,155 @@
 package auth
 
-import "golang.org/x/crypto/bcrypt"
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
 
-func HashPassword(password string) (string, error) {
-	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	if err != nil {
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	PasswordAlgorithmArgon2id = "argon2id"
+	PasswordAlgorithmBcrypt   = "bcrypt"
+
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+var (
+	ErrPasswordMismatch    = errors.New("password does not match")
+	ErrUnknownPasswordHash = errors.New("unknown password hash format")
+)
+
+// Argon2Params は Argon2id のコストパラメータ。既定値は OWASP の推奨最小値に合わせている。
+type Argon2Params struct {
+	MemoryKiB   uint32
+	Iterations  uint32
+	Parallelism uint8
+}
+
+var defaultArgon2Params = Argon2Params{MemoryKiB: 19 * 1024, Iterations: 2, Parallelism: 1}
+
+// PasswordHasher は設定されたアルゴリズムでパスワードをハッシュ化する。
+// ハッシュ文字列にはアルゴリズムとパラメータが含まれるため、設定を変えても既存のハッシュは検証でき、
+// Verify が返す needsRehash を見てログイン時に新しい設定へ置き換えられる。
+type PasswordHasher struct {
+	Algorithm  string
+	BcryptCost int
+	Argon2     Argon2Params
+}
+
+// Hash は現在の設定でパスワードをハッシュ化する。
+// bcrypt は "$2a$<cost>$..."、Argon2id は PHC 形式 "$argon2id$v=19$m=...,t=...,p=...$<salt>$<key>" を返す。
+func (h PasswordHasher) Hash(password string) (string, error) {
+	h = h.withDefaults()
+	if h.Algorithm == PasswordAlgorithmBcrypt {
+		hashed, err := bcrypt.GenerateFromPassword([]byte(password), h.BcryptCost)
+		if err != nil {
+			return "", err
+		}
+		return string(hashed), nil
+	}
+
+	salt := make([]byte, argon2SaltLength)
+	if _, err := rand.Read(salt); err != nil {
 		return "", err
 	}
-	return string(hashed), nil
+	key := argon2.IDKey([]byte(password), salt, h.Argon2.Iterations, h.Argon2.MemoryKiB, h.Argon2.Parallelism, argon2KeyLength)
+	return encodeArgon2(h.Argon2, salt, key), nil
+}
+
+// Verify はパスワードを検証し、ハッシュが現在の設定より古い(アルゴリズムやコストが異なる)かどうかを返す。
+func (h PasswordHasher) Verify(hash, plain string) (bool, error) {
+	h = h.withDefaults()
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$"):
+		params, salt, key, err := decodeArgon2(hash)
+		if err != nil {
+			return false, err
+		}
+		candidate := argon2.IDKey([]byte(plain), salt, params.Iterations, params.MemoryKiB, params.Parallelism, uint32(len(key)))
+		if subtle.ConstantTimeCompare(candidate, key) != 1 {
+			return false, ErrPasswordMismatch
+		}
+		return h.Algorithm != PasswordAlgorithmArgon2id || params != h.Argon2 || len(key) != argon2KeyLength, nil
+	case strings.HasPrefix(hash, "$2"):
+		if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(plain)); err != nil {
+			if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+				return false, ErrPasswordMismatch
+			}
+			return false, err
+		}
+		cost, err := bcrypt.Cost([]byte(hash))
+		if err != nil {
+			return false, err
+		}
+		return h.Algorithm != PasswordAlgorithmBcrypt || cost != h.BcryptCost, nil
+	default:
+		return false, ErrUnknownPasswordHash
+	}
 }
 
-func VerifyPassword(hash, plain string) error {
-	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(plain))
+func (h PasswordHasher) withDefaults() PasswordHasher {
+	if h.Algorithm != PasswordAlgorithmBcrypt {
+		h.Algorithm = PasswordAlgorithmArgon2id
+	}
+	if h.BcryptCost < bcrypt.MinCost || h.BcryptCost > bcrypt.MaxCost {
+		h.BcryptCost = bcrypt.DefaultCost
+	}
+	if h.Argon2.MemoryKiB == 0 {
+		h.Argon2.MemoryKiB = defaultArgon2Params.MemoryKiB
+	}
+	if h.Argon2.Iterations == 0 {
+		h.Argon2.Iterations = defaultArgon2Params.Iterations
+	}
+	if h.Argon2.Parallelism == 0 {
+		h.Argon2.Parallelism = defaultArgon2Params.Parallelism
+	}
+	return h
+}
+
+func encodeArgon2(params Argon2Params, salt, key []byte) string {
+	return fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		params.MemoryKiB,
+		params.Iterations,
+		params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	)
+}
+
+func decodeArgon2(hash string) (Argon2Params, []byte, []byte, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != PasswordAlgorithmArgon2id {
+		return Argon2Params{}, nil, nil, ErrUnknownPasswordHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return Argon2Params{}, nil, nil, ErrUnknownPasswordHash
+	}
+	var params Argon2Params
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.MemoryKiB, &params.Iterations, &params.Parallelism); err != nil {
+		return Argon2Params{}, nil, nil, ErrUnknownPasswordHash
+	}
+	if params.MemoryKiB == 0 || params.Iterations == 0 || params.Parallelism == 0 {
+		return Argon2Params{}, nil, nil, ErrUnknownPasswordHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return Argon2Params{}, nil, nil, ErrUnknownPasswordHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return Argon2Params{}, nil, nil, ErrUnknownPasswordHash
+	}
+	return params, salt, key, nil
 }
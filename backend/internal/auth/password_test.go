@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// テストを速くするため Argon2id のメモリは小さくする。
+var testArgon2 = Argon2Params{MemoryKiB: 64, Iterations: 1, Parallelism: 1}
+
+func TestPasswordHasherRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		hasher PasswordHasher
+		prefix string
+	}{
+		{name: "argon2id", hasher: PasswordHasher{Algorithm: PasswordAlgorithmArgon2id, Argon2: testArgon2}, prefix: "$argon2id$v=19$m=64,t=1,p=1$"},
+		{name: "bcrypt", hasher: PasswordHasher{Algorithm: PasswordAlgorithmBcrypt, BcryptCost: bcrypt.MinCost}, prefix: "$2a$04$"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hash, err := tt.hasher.Hash("correct horse")
+			if err != nil {
+				t.Fatalf("Hash() error = %v", err)
+			}
+			if !strings.HasPrefix(hash, tt.prefix) {
+				t.Fatalf("Hash() = %q, want prefix %q", hash, tt.prefix)
+			}
+
+			needsRehash, err := tt.hasher.Verify(hash, "correct horse")
+			if err != nil || needsRehash {
+				t.Fatalf("Verify() = %v, %v; want false, nil", needsRehash, err)
+			}
+			if _, err := tt.hasher.Verify(hash, "wrong horse"); !errors.Is(err, ErrPasswordMismatch) {
+				t.Fatalf("Verify() with wrong password error = %v, want ErrPasswordMismatch", err)
+			}
+		})
+	}
+}
+
+func TestPasswordHasherNeedsRehash(t *testing.T) {
+	legacy, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("generate bcrypt hash: %v", err)
+	}
+	argon, err := PasswordHasher{Argon2: testArgon2}.Hash("correct horse")
+	if err != nil {
+		t.Fatalf("Hash() error = %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		hasher PasswordHasher
+		hash   string
+		want   bool
+	}{
+		{name: "bcrypt to argon2id", hasher: PasswordHasher{Argon2: testArgon2}, hash: string(legacy), want: true},
+		{name: "bcrypt cost raised", hasher: PasswordHasher{Algorithm: PasswordAlgorithmBcrypt, BcryptCost: bcrypt.MinCost + 1}, hash: string(legacy), want: true},
+		{name: "bcrypt same cost", hasher: PasswordHasher{Algorithm: PasswordAlgorithmBcrypt, BcryptCost: bcrypt.MinCost}, hash: string(legacy), want: false},
+		{name: "argon2id params raised", hasher: PasswordHasher{Argon2: Argon2Params{MemoryKiB: 128, Iterations: 1, Parallelism: 1}}, hash: argon, want: true},
+		{name: "argon2id to bcrypt", hasher: PasswordHasher{Algorithm: PasswordAlgorithmBcrypt, BcryptCost: bcrypt.MinCost}, hash: argon, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.hasher.Verify(tt.hash, "correct horse")
+			if err != nil {
+				t.Fatalf("Verify() error = %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("Verify() needsRehash = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPasswordHasherRejectsMalformedHash(t *testing.T) {
+	hasher := PasswordHasher{Argon2: testArgon2}
+	for _, hash := range []string{
+		"",
+		"plain-text",
+		"$argon2id$v=19$m=64,t=1,p=1$c2FsdA",
+		"$argon2id$v=18$m=64,t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=0,t=1,p=1$c2FsdA$a2V5",
+	} {
+		if _, err := hasher.Verify(hash, "correct horse"); !errors.Is(err, ErrUnknownPasswordHash) {
+			t.Fatalf("Verify(%q) error = %v, want ErrUnknownPasswordHash", hash, err)
+		}
+	}
+}
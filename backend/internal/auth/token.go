@@ -0,0 +1,36 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+)
+
+// GenerateOpaqueToken はクライアントに渡すランダムなトークンと、DBに保存する SHA-256 ハッシュを返す。
+func GenerateOpaqueToken() (string, string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	raw := base64.RawURLEncoding.EncodeToString(buf)
+	return raw, HashOpaqueToken(raw), nil
+}
+
+func HashOpaqueToken(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+// PersonalAccessTokenPrefix は JWT と区別し、漏えいしたトークンをシークレットスキャナで検出しやすくするための接頭辞。
+const PersonalAccessTokenPrefix = "dpat_"
+
+// GeneratePersonalAccessToken は新しいパーソナルアクセストークンと、DBに保存する SHA-256 ハッシュを返す。
+func GeneratePersonalAccessToken() (string, string, error) {
+	raw, _, err := GenerateOpaqueToken()
+	if err != nil {
+		return "", "", err
+	}
+	raw = PersonalAccessTokenPrefix + raw
+	return raw, HashOpaqueToken(raw), nil
+}
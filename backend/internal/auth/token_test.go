@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+var testKeys = NewHMACKeySet("secret")
+
+func TestGenerateOpaqueToken(t *testing.T) {
+	raw, hash, err := GenerateOpaqueToken()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if raw == "" || len(hash) != 64 {
+		t.Fatalf("unexpected token shape: raw=%q hash=%q", raw, hash)
+	}
+	if HashOpaqueToken(raw) != hash {
+		t.Fatal("hash should be reproducible from raw token")
+	}
+
+	other, _, err := GenerateOpaqueToken()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if other == raw {
+		t.Fatal("tokens should be random")
+	}
+}
+
+func TestGeneratePersonalAccessToken(t *testing.T) {
+	raw, hash, err := GeneratePersonalAccessToken()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(raw, PersonalAccessTokenPrefix) {
+		t.Fatalf("token %q should start with %q", raw, PersonalAccessTokenPrefix)
+	}
+	if HashOpaqueToken(raw) != hash {
+		t.Fatal("hash should cover the prefixed token")
+	}
+	if _, err := ParseToken(raw, testKeys); err == nil {
+		t.Fatal("personal access token must not parse as a JWT")
+	}
+}
+
+func TestTokenRoundTrip(t *testing.T) {
+	token, err := GenerateToken("user-1", "a@example.com", "session-1", testKeys, time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	claims, err := ParseToken(token, testKeys)
+	if err != nil {
+		t.Fatalf("unexpected parse error: %v", err)
+	}
+	if claims.UserID != "user-1" || claims.SessionID != "session-1" {
+		t.Fatalf("unexpected claims: %+v", claims)
+	}
+
+	if _, err := ParseToken(token, NewHMACKeySet("other-secret")); err == nil {
+		t.Fatal("expected signature error")
+	}
+
+	expired, err := GenerateToken("user-1", "a@example.com", "session-1", testKeys, -time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := ParseToken(expired, testKeys); err == nil {
+		t.Fatal("expected expired token error")
+	}
+
+	noSession, err := GenerateToken("user-1", "a@example.com", "", testKeys, time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := ParseToken(noSession, testKeys); err == nil {
+		t.Fatal("expected error for token without session")
+	}
+}
+
+func TestMFATokenIsNotAccessToken(t *testing.T) {
+	mfaToken, err := GenerateMFAToken("user-1", testKeys, time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := ParseToken(mfaToken, testKeys); err == nil {
+		t.Fatal("mfa token must not be accepted as access token")
+	}
+	claims, err := ParseMFAToken(mfaToken, testKeys)
+	if err != nil || claims.UserID != "user-1" {
+		t.Fatalf("unexpected mfa parse result: %+v, %v", claims, err)
+	}
+
+	accessToken, err := GenerateToken("user-1", "a@example.com", "session-1", testKeys, time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := ParseMFAToken(accessToken, testKeys); err == nil {
+		t.Fatal("access token must not be accepted as mfa token")
+	}
+}
@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// RFC 6238 Appendix B のテストベクタ(SHA1, シークレット "12345678901234567890")。
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCodeRFCVectors(t *testing.T) {
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{unix: 59, want: "287082"},
+		{unix: 1111111109, want: "081804"},
+		{unix: 1234567890, want: "005924"},
+		{unix: 2000000000, want: "279037"},
+	}
+	for _, tt := range tests {
+		got, err := TOTPCode(rfcSecret, time.Unix(tt.unix, 0))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got != tt.want {
+			t.Fatalf("TOTPCode(%d) = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	now := time.Unix(1_700_000_000, 0)
+
+	code, _ := TOTPCode(secret, now.Add(-30*time.Second))
+	counter, ok := ValidateTOTP(secret, code, now, 0)
+	if !ok {
+		t.Fatal("code from the previous step should be accepted")
+	}
+	if _, ok := ValidateTOTP(secret, code, now, counter); ok {
+		t.Fatal("same code must not be accepted twice")
+	}
+
+	stale, _ := TOTPCode(secret, now.Add(-5*time.Minute))
+	if _, ok := ValidateTOTP(secret, stale, now, 0); ok {
+		t.Fatal("stale code should be rejected")
+	}
+	if _, ok := ValidateTOTP(secret, "12345", now, 0); ok {
+		t.Fatal("short code should be rejected")
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	uri := TOTPURI("Diary Open Close", "user@example.com", "ABC")
+	if !strings.HasPrefix(uri, "otpauth://totp/Diary%20Open%20Close:user@example.com?") {
+		t.Fatalf("unexpected uri: %s", uri)
+	}
+	if !strings.Contains(uri, "secret=ABC") || !strings.Contains(uri, "issuer=Diary+Open+Close") {
+		t.Fatalf("uri should contain secret and issuer: %s", uri)
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := GenerateRecoveryCodes(10)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(codes) != 10 {
+		t.Fatalf("expected 10 codes, got %d", len(codes))
+	}
+	seen := map[string]struct{}{}
+	for _, code := range codes {
+		if len(code) != 11 || code[5] != '-' {
+			t.Fatalf("unexpected code format: %q", code)
+		}
+		seen[code] = struct{}{}
+	}
+	if len(seen) != len(codes) {
+		t.Fatal("codes should be unique")
+	}
+
+	if NormalizeRecoveryCode(" ABCDE-FGHIJ ") != "abcdefghij" {
+		t.Fatal("recovery code should be normalized")
+	}
+}
@@ -1,10 +1,29 @@
 package config
 
 import (
+	"fmt"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
+const (
+	EmailPolicyNone           = "none"
+	EmailPolicyRestrictPublic = "restrict_public"
+	EmailPolicyRequired       = "required"
+)
+
+// OIDCProvider は OpenID Connect のIDプロバイダ設定。
+type OIDCProvider struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+}
+
 type Config struct {
 	Host           string
 	APIPort        string
@@ -12,7 +31,82 @@ type Config struct {
 	DatabaseURL    string
 	JWTSecret      string
 	UploadDir      string
-	TokenHours     int
+	TrustProxy     bool
+
+	// TrustedProxyHops は TrustProxy のとき、X-Forwarded-For の右から何番目をクライアントIPとみなすか(手前の信頼できるプロキシの段数)。
+	TrustedProxyHops int
+
+	// JWTPrivateKeyFile を設定するとアクセストークンを RS256 / EdDSA で署名し、JWKS で公開鍵を配布する。
+	// ローテーション後もしばらくは JWTPreviousKeyFiles の鍵で署名されたトークンを受け付ける。
+	JWTPrivateKeyFile   string
+	JWTPreviousKeyFiles []string
+
+	// AuthCookieEnabled のとき、ログイン時に httpOnly Cookie でもトークンを発行し、authMiddleware で受け付ける。
+	AuthCookieEnabled  bool
+	AuthCookieSecure   bool
+	AuthCookieDomain   string
+	AuthCookieSameSite string
+
+	// PasswordHashAlgorithm は新しく保存するパスワードハッシュのアルゴリズム(argon2id / bcrypt)。
+	// 設定と異なるアルゴリズムやコストのハッシュは、ログイン成功時に現在の設定で再ハッシュされる。
+	PasswordHashAlgorithm string
+	BcryptCost            int
+	Argon2MemoryKiB       int
+	Argon2Iterations      int
+	Argon2Parallelism     int
+
+	// パスワード要件。PasswordMinLength は文字数、PasswordMaxBytes は UTF-8 のバイト数。
+	// PasswordBreachedListFile には使用を禁止するパスワードを1行に1つ記載する。
+	PasswordMinLength        int
+	PasswordMaxBytes         int
+	PasswordBreachedListFile string
+
+	AccessTokenMinutes   int
+	RefreshTokenDays     int
+	PasswordResetMinutes int
+	// TOTPIssuer は認証アプリに表示される発行者名。
+	TOTPIssuer string
+
+	// EmailVerificationPolicy は未確認アカウントの扱い。
+	// none: 制限なし / restrict_public: 日記を公開できない / required: 確認まで日記機能を利用できない
+	EmailVerificationPolicy string
+	EmailVerificationHours  int
+
+	// AccountDeletionGraceDays が 0 の場合、アカウント削除は即時に行われる。
+	AccountDeletionGraceDays int
+
+	// DiaryRevisionLimit は日記ごとに残す過去の版の数。0 の場合は版を記録しない。
+	DiaryRevisionLimit int
+	// DiaryTrashRetentionDays はゴミ箱の日記と添付ファイルを完全に削除するまでの日数。
+	DiaryTrashRetentionDays int
+	// AppTimezone は日付を省略した下書きの日付など、「今日」を決めるタイムゾーン(IANA 名)。
+	AppTimezone string
+
+	// AppBaseURL はメール本文に埋め込むフロントエンドのURL。
+	AppBaseURL   string
+	MailDriver   string
+	MailFrom     string
+	MailDir      string
+	SMTPHost     string
+	SMTPPort     string
+	SMTPUsername string
+	SMTPPassword string
+
+	// ログイン試行制限。失敗回数がしきい値に達すると LoginLockoutSeconds だけロックし、
+	// 以降の失敗ごとにロック時間を倍にする(上限 LoginLockoutMaxMinutes)。
+	LoginMaxAccountFailures   int
+	LoginMaxIPFailures        int
+	LoginFailureWindowMinutes int
+	LoginLockoutSeconds       int
+	LoginLockoutMaxMinutes    int
+
+	// パスワード再設定メールの送信制限。メールアドレス単位・接続元IP単位の回数がしきい値に達すると、
+	// ログイン試行制限と同じ期間だけ受付を止める。
+	PasswordResetMaxEmailRequests int
+	PasswordResetMaxIPRequests    int
+
+	// OIDCProviders は OIDC_PROVIDERS に列挙され、発行者とクライアントIDが設定されたプロバイダ。
+	OIDCProviders []OIDCProvider
 }
 
 func Load() Config {
@@ -21,6 +115,8 @@ func Load() Config {
 		allowedOrigins = []string{"http://localhost:3000"}
 	}
 
+	appBaseURL := strings.TrimRight(getEnv("APP_BASE_URL", "http://localhost:3000"), "/")
+
 	return Config{
 		Host:           getEnv("HOST", "0.0.0.0"),
 		APIPort:        getEnv("API_PORT", "8000"),
@@ -28,8 +124,100 @@ func Load() Config {
 		DatabaseURL:    os.Getenv("DATABASE_URL"),
 		JWTSecret:      getEnv("JWT_SECRET", "dev-secret-change-me"),
 		UploadDir:      getEnv("UPLOAD_DIR", "./uploads"),
-		TokenHours:     24,
+		TrustProxy:     getEnvBool("TRUST_PROXY", false),
+
+		TrustedProxyHops: getEnvInt("TRUSTED_PROXY_HOPS", 1),
+
+		JWTPrivateKeyFile:   getEnv("JWT_PRIVATE_KEY_FILE", ""),
+		JWTPreviousKeyFiles: splitCSV(getEnv("JWT_PREVIOUS_KEY_FILES", "")),
+
+		AuthCookieEnabled:  getEnvBool("AUTH_COOKIE_ENABLED", false),
+		AuthCookieSecure:   getEnvBool("AUTH_COOKIE_SECURE", true),
+		AuthCookieDomain:   getEnv("AUTH_COOKIE_DOMAIN", ""),
+		AuthCookieSameSite: getEnv("AUTH_COOKIE_SAMESITE", "lax"),
+
+		PasswordHashAlgorithm: getEnv("PASSWORD_HASH_ALGORITHM", "argon2id"),
+		BcryptCost:            getEnvInt("BCRYPT_COST", 12),
+		Argon2MemoryKiB:       getEnvInt("ARGON2_MEMORY_KIB", 19456),
+		Argon2Iterations:      getEnvInt("ARGON2_ITERATIONS", 2),
+		Argon2Parallelism:     getEnvInt("ARGON2_PARALLELISM", 1),
+
+		PasswordMinLength:        getEnvInt("PASSWORD_MIN_LENGTH", 8),
+		PasswordMaxBytes:         getEnvInt("PASSWORD_MAX_BYTES", 72),
+		PasswordBreachedListFile: getEnv("PASSWORD_BREACHED_LIST_FILE", ""),
+
+		AccessTokenMinutes:   getEnvInt("ACCESS_TOKEN_MINUTES", 15),
+		RefreshTokenDays:     getEnvInt("REFRESH_TOKEN_DAYS", 30),
+		PasswordResetMinutes: getEnvInt("PASSWORD_RESET_MINUTES", 60),
+		TOTPIssuer:           getEnv("TOTP_ISSUER", "Diary Open Close"),
+
+		EmailVerificationPolicy: strings.ToLower(strings.TrimSpace(getEnv("EMAIL_VERIFICATION_POLICY", EmailPolicyNone))),
+		EmailVerificationHours:  getEnvInt("EMAIL_VERIFICATION_HOURS", 24),
+
+		AccountDeletionGraceDays: getEnvNonNegativeInt("ACCOUNT_DELETION_GRACE_DAYS", 0),
+
+		DiaryRevisionLimit:      getEnvNonNegativeInt("DIARY_REVISION_LIMIT", 20),
+		DiaryTrashRetentionDays: getEnvInt("DIARY_TRASH_RETENTION_DAYS", 30),
+		AppTimezone:             getEnv("APP_TIMEZONE", "Asia/Tokyo"),
+
+		LoginMaxAccountFailures:   getEnvInt("LOGIN_MAX_ACCOUNT_FAILURES", 5),
+		LoginMaxIPFailures:        getEnvInt("LOGIN_MAX_IP_FAILURES", 20),
+		LoginFailureWindowMinutes: getEnvInt("LOGIN_FAILURE_WINDOW_MINUTES", 15),
+		LoginLockoutSeconds:       getEnvInt("LOGIN_LOCKOUT_SECONDS", 60),
+		LoginLockoutMaxMinutes:    getEnvInt("LOGIN_LOCKOUT_MAX_MINUTES", 60),
+
+		PasswordResetMaxEmailRequests: getEnvInt("PASSWORD_RESET_MAX_EMAIL_REQUESTS", 3),
+		PasswordResetMaxIPRequests:    getEnvInt("PASSWORD_RESET_MAX_IP_REQUESTS", 10),
+
+		AppBaseURL:   appBaseURL,
+		MailDriver:   getEnv("MAIL_DRIVER", "file"),
+		MailFrom:     getEnv("MAIL_FROM", "no-reply@localhost"),
+		MailDir:      getEnv("MAIL_DIR", "./tmp/mail"),
+		SMTPHost:     getEnv("SMTP_HOST", "localhost"),
+		SMTPPort:     getEnv("SMTP_PORT", "587"),
+		SMTPUsername: os.Getenv("SMTP_USERNAME"),
+		SMTPPassword: os.Getenv("SMTP_PASSWORD"),
+
+		OIDCProviders: loadOIDCProviders(appBaseURL),
+	}
+}
+
+// loadOIDCProviders は OIDC_PROVIDERS=google,github のような一覧から
+// OIDC_<NAME>_ISSUER / _CLIENT_ID / _CLIENT_SECRET / _REDIRECT_URL / _SCOPES を読み込む。
+// Validate は列挙値の設定を検証する。値の誤記で意図しない挙動にならないよう、起動時に失敗させる。
+func (c Config) Validate() error {
+	switch c.EmailVerificationPolicy {
+	case EmailPolicyNone, EmailPolicyRestrictPublic, EmailPolicyRequired:
+	default:
+		return fmt.Errorf("EMAIL_VERIFICATION_POLICY が不正です: %q (%s / %s / %s のいずれかを指定してください)",
+			c.EmailVerificationPolicy, EmailPolicyNone, EmailPolicyRestrictPublic, EmailPolicyRequired)
+	}
+	if _, err := time.LoadLocation(c.AppTimezone); err != nil {
+		return fmt.Errorf("APP_TIMEZONE が不正です: %q (%v)", c.AppTimezone, err)
 	}
+	return nil
+}
+
+func loadOIDCProviders(appBaseURL string) []OIDCProvider {
+	names := splitCSV(getEnv("OIDC_PROVIDERS", ""))
+	providers := make([]OIDCProvider, 0, len(names))
+	for _, name := range names {
+		name = strings.ToLower(name)
+		prefix := "OIDC_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		provider := OIDCProvider{
+			Name:         name,
+			Issuer:       getEnv(prefix+"ISSUER", ""),
+			ClientID:     getEnv(prefix+"CLIENT_ID", ""),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			RedirectURL:  getEnv(prefix+"REDIRECT_URL", appBaseURL+"/auth/callback/"+name),
+			Scopes:       strings.Fields(getEnv(prefix+"SCOPES", "openid email profile")),
+		}
+		if provider.Issuer == "" || provider.ClientID == "" {
+			continue
+		}
+		providers = append(providers, provider)
+	}
+	return providers
 }
 
 func getEnv(key, fallback string) string {
@@ -40,6 +228,30 @@ func getEnv(key, fallback string) string {
 	return value
 }
 
+func getEnvInt(key string, fallback int) int {
+	value, err := strconv.Atoi(getEnv(key, ""))
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
+
+func getEnvNonNegativeInt(key string, fallback int) int {
+	value, err := strconv.Atoi(getEnv(key, ""))
+	if err != nil || value < 0 {
+		return fallback
+	}
+	return value
+}
+
+func getEnvBool(key string, fallback bool) bool {
+	value, err := strconv.ParseBool(getEnv(key, ""))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
 func splitCSV(value string) []string {
 	parts := strings.Split(value, ",")
 	result := make([]string, 0, len(parts))
@@ -0,0 +1,32 @@
+package config
+
+import "testing"
+
+func TestValidateEmailVerificationPolicy(t *testing.T) {
+	for _, policy := range []string{EmailPolicyNone, EmailPolicyRestrictPublic, EmailPolicyRequired} {
+		if err := (Config{EmailVerificationPolicy: policy, AppTimezone: "Asia/Tokyo"}).Validate(); err != nil {
+			t.Fatalf("Validate(%q) = %v, want nil", policy, err)
+		}
+	}
+	for _, policy := range []string{"requird", ""} {
+		if err := (Config{EmailVerificationPolicy: policy}).Validate(); err == nil {
+			t.Fatalf("Validate(%q) should fail", policy)
+		}
+	}
+}
+
+func TestLoadNormalizesEmailVerificationPolicy(t *testing.T) {
+	t.Setenv("EMAIL_VERIFICATION_POLICY", " Required ")
+	if got := Load().EmailVerificationPolicy; got != EmailPolicyRequired {
+		t.Fatalf("EmailVerificationPolicy = %q, want %q", got, EmailPolicyRequired)
+	}
+}
+
+func TestValidateAppTimezone(t *testing.T) {
+	if err := (Config{EmailVerificationPolicy: EmailPolicyNone, AppTimezone: "Asia/Tokyo"}).Validate(); err != nil {
+		t.Fatalf("Validate() = %v, want nil", err)
+	}
+	if err := (Config{EmailVerificationPolicy: EmailPolicyNone, AppTimezone: "Asia/Tokio"}).Validate(); err == nil {
+		t.Fatal("Validate() should reject an unknown timezone")
+	}
+}
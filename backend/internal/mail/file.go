@@ -0,0 +1,42 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// FileMailer は送信の代わりに .eml ファイルとして書き出す開発・テスト用の Mailer。
+// Dir が空の場合はログ出力のみ行う。
+type FileMailer struct {
+	Dir  string
+	From string
+}
+
+func (m *FileMailer) Send(ctx context.Context, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if m.Dir == "" {
+		log.Printf("mail to=%s subject=%s\n%s", msg.To, msg.Subject, msg.Body)
+		return nil
+	}
+
+	if err := os.MkdirAll(m.Dir, 0o755); err != nil {
+		return err
+	}
+	now := time.Now()
+	name := fmt.Sprintf("%d-%s.eml", now.UnixMilli(), uuid.NewString())
+	path := filepath.Join(m.Dir, name)
+	if err := os.WriteFile(path, buildMessage(m.From, msg, now), 0o644); err != nil {
+		return err
+	}
+	log.Printf("mail to=%s subject=%s saved=%s", msg.To, msg.Subject, path)
+	return nil
+}
@@ -0,0 +1,57 @@
+package mail
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ymmtyamaterous/diary-oc-api/internal/config"
+)
+
+func TestBuildMessage(t *testing.T) {
+	raw := string(buildMessage("no-reply@example.com", Message{
+		To:      "user@example.com",
+		Subject: "パスワード再設定",
+		Body:    "本文です",
+	}, time.Date(2026, 2, 22, 10, 0, 0, 0, time.UTC)))
+
+	for _, want := range []string{
+		"From: no-reply@example.com\r\n",
+		"To: user@example.com\r\n",
+		"Subject: =?UTF-8?b?",
+		"Content-Type: text/plain; charset=UTF-8\r\n",
+		"\r\n\r\n本文です",
+	} {
+		if !strings.Contains(raw, want) {
+			t.Fatalf("message should contain %q, got:\n%s", want, raw)
+		}
+	}
+}
+
+func TestFileMailer(t *testing.T) {
+	dir := t.TempDir()
+	mailer := &FileMailer{Dir: dir, From: "no-reply@example.com"}
+
+	if err := mailer.Send(context.Background(), Message{To: "user@example.com", Subject: "件名", Body: "本文"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(entries) != 1 || !strings.HasSuffix(entries[0].Name(), ".eml") {
+		t.Fatalf("expected one .eml file, got %v", entries)
+	}
+}
+
+func TestNew(t *testing.T) {
+	if _, ok := New(config.Config{MailDriver: "smtp"}).(*SMTPMailer); !ok {
+		t.Fatal("smtp driver should return SMTPMailer")
+	}
+	if _, ok := New(config.Config{}).(*FileMailer); !ok {
+		t.Fatal("default driver should return FileMailer")
+	}
+}
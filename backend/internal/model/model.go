@@ -1,13 +1,44 @@
 package model
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 type User struct {
-	ID              string    `json:"id"`
-	Email           string    `json:"email"`
-	DisplayName     string    `json:"display_name"`
-	ProfileImageURL *string   `json:"profile_image_url"`
-	CreatedAt       time.Time `json:"created_at"`
+	ID               string     `json:"id"`
+	Email            string     `json:"email"`
+	DisplayName      string     `json:"display_name"`
+	ProfileImageURL  *string    `json:"profile_image_url"`
+	EmailVerifiedAt  *time.Time `json:"email_verified_at"`
+	TwoFactorEnabled bool       `json:"two_factor_enabled"`
+	CreatedAt        time.Time  `json:"created_at"`
+}
+
+type Session struct {
+	ID         string    `json:"id"`
+	UserAgent  *string   `json:"user_agent"`
+	IPAddress  *string   `json:"ip_address"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current"`
+}
+
+type UserIdentity struct {
+	Provider  string    `json:"provider"`
+	Email     *string   `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type PersonalAccessToken struct {
+	ID          string     `json:"id"`
+	Name        string     `json:"name"`
+	TokenPrefix string     `json:"token_prefix"`
+	Scopes      []string   `json:"scopes"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+	LastUsedAt  *time.Time `json:"last_used_at"`
+	CreatedAt   time.Time  `json:"created_at"`
 }
 
 type DiaryEntry struct {
@@ -31,8 +62,12 @@ type DiaryEntry struct {
 	Learnings              *string   `json:"learnings"`
 	HealthHabits           *string   `json:"health_habits"`
 	TodayInOneWord         *string   `json:"today_in_one_word"`
+	Tags                   []string  `json:"tags"`
+	IsDraft                bool      `json:"is_draft"`
 	CreatedAt              time.Time `json:"created_at"`
 	UpdatedAt              time.Time `json:"updated_at"`
+	// Version は ETag ヘッダーで返す
+	Version int64 `json:"-"`
 }
 
 type PublicDiaryEntry struct {
@@ -53,6 +88,61 @@ type PublicDiaryEntry struct {
 	HealthHabits           *string   `json:"health_habits"`
 	TodayInOneWord         *string   `json:"today_in_one_word"`
 	CreatedAt              time.Time `json:"created_at"`
+	AuthorID               string    `json:"author_id"`
 	AuthorName             string    `json:"author_name"`
 	AuthorPhoto            *string   `json:"author_photo"`
 }
+
+// Tag は日記に付けるタグ。UsageCount はタグが付いた日記の数。
+type Tag struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	UsageCount int       `json:"usage_count"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// DiarySearchResult は日記検索の結果1件。Score はキーワードの出現回数。
+type DiarySearchResult struct {
+	DiaryEntry
+	Score    int             `json:"score"`
+	Snippets []SearchSnippet `json:"snippets"`
+}
+
+// SearchSnippet は一致した項目の抜粋。Fragments を順に連結すると抜粋の本文になる。
+type SearchSnippet struct {
+	Field     string            `json:"field"`
+	Fragments []SnippetFragment `json:"fragments"`
+}
+
+type SnippetFragment struct {
+	Text  string `json:"text"`
+	Match bool   `json:"match"`
+}
+
+// TrashedDiaryEntry はゴミ箱の日記。PurgeAt を過ぎると添付ファイルごと完全に削除される。
+type TrashedDiaryEntry struct {
+	DiaryEntry
+	DeletedAt time.Time `json:"deleted_at"`
+	PurgeAt   time.Time `json:"purge_at"`
+}
+
+// DiaryRevision は日記の過去の版。Snapshot はその版の本文・日付・公開状態・タグなど。
+type DiaryRevision struct {
+	Revision  int64           `json:"revision"`
+	AuthorID  *string         `json:"author_id"`
+	Snapshot  json.RawMessage `json:"snapshot"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// DiaryRevisionDiff は2つの版の項目ごとの差分。To が nil の場合は現在の日記と比較している。
+type DiaryRevisionDiff struct {
+	From    int64              `json:"from"`
+	To      *int64             `json:"to"`
+	Changes []DiaryFieldChange `json:"changes"`
+}
+
+type DiaryFieldChange struct {
+	Field string `json:"field"`
+	From  any    `json:"from"`
+	To    any    `json:"to"`
+}
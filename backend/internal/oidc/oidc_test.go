@@ -0,0 +1,162 @@
+package oidc_test
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/ymmtyamaterous/diary-oc-api/internal/config"
+	"github.com/ymmtyamaterous/diary-oc-api/internal/oidc"
+	"github.com/ymmtyamaterous/diary-oc-api/internal/oidc/oidctest"
+)
+
+func newTestProvider(t *testing.T) (*oidctest.Issuer, *oidc.Provider) {
+	t.Helper()
+	issuer, err := oidctest.NewIssuer("diary-client", "diary-secret")
+	if err != nil {
+		t.Fatalf("NewIssuer() error = %v", err)
+	}
+	t.Cleanup(issuer.Close)
+
+	provider := oidc.NewProvider(config.OIDCProvider{
+		Name:         "mock",
+		Issuer:       issuer.URL(),
+		ClientID:     issuer.ClientID,
+		ClientSecret: issuer.ClientSecret,
+		RedirectURL:  "http://localhost:3000/auth/callback/mock",
+		Scopes:       []string{"openid", "email", "profile"},
+	}, nil)
+	return issuer, provider
+}
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+	issuer, provider := newTestProvider(t)
+	issuer.SetUser(oidctest.User{Subject: "user-1", Email: "alice@example.com", EmailVerified: true, Name: "Alice"})
+	ctx := context.Background()
+
+	verifier, err := oidc.GenerateVerifier()
+	if err != nil {
+		t.Fatalf("GenerateVerifier() error = %v", err)
+	}
+	authURL, err := provider.AuthCodeURL(ctx, "state-1", "nonce-1", verifier)
+	if err != nil {
+		t.Fatalf("AuthCodeURL() error = %v", err)
+	}
+	parsed, _ := url.Parse(authURL)
+	if got := parsed.Query().Get("code_challenge"); got != oidc.CodeChallenge(verifier) {
+		t.Fatalf("code_challenge = %q, want S256 of verifier", got)
+	}
+
+	code, state, err := issuer.Authorize(authURL)
+	if err != nil {
+		t.Fatalf("Authorize() error = %v", err)
+	}
+	if state != "state-1" {
+		t.Fatalf("state = %q, want state-1", state)
+	}
+
+	idToken, err := provider.Exchange(ctx, code, verifier)
+	if err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+	identity, err := provider.VerifyIDToken(ctx, idToken, "nonce-1")
+	if err != nil {
+		t.Fatalf("VerifyIDToken() error = %v", err)
+	}
+	want := oidc.Identity{Subject: "user-1", Email: "alice@example.com", EmailVerified: true, Name: "Alice"}
+	if identity != want {
+		t.Fatalf("identity = %+v, want %+v", identity, want)
+	}
+
+	if _, err := provider.Exchange(ctx, code, verifier); err == nil {
+		t.Fatal("authorization code should be single use")
+	}
+}
+
+func TestExchangeRejectsWrongVerifier(t *testing.T) {
+	issuer, provider := newTestProvider(t)
+	ctx := context.Background()
+
+	verifier, _ := oidc.GenerateVerifier()
+	authURL, err := provider.AuthCodeURL(ctx, "state", "nonce", verifier)
+	if err != nil {
+		t.Fatalf("AuthCodeURL() error = %v", err)
+	}
+	code, _, err := issuer.Authorize(authURL)
+	if err != nil {
+		t.Fatalf("Authorize() error = %v", err)
+	}
+
+	other, _ := oidc.GenerateVerifier()
+	if _, err := provider.Exchange(ctx, code, other); err == nil {
+		t.Fatal("exchange with a different code_verifier should fail")
+	}
+}
+
+func TestVerifyIDTokenRejectsInvalidClaims(t *testing.T) {
+	issuer, provider := newTestProvider(t)
+	ctx := context.Background()
+	now := time.Now()
+
+	valid := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss":   issuer.URL(),
+			"sub":   "user-1",
+			"aud":   issuer.ClientID,
+			"exp":   now.Add(time.Minute).Unix(),
+			"nonce": "nonce",
+		}
+	}
+
+	tests := []struct {
+		name   string
+		mutate func(jwt.MapClaims)
+	}{
+		{name: "wrong nonce", mutate: func(c jwt.MapClaims) { c["nonce"] = "other" }},
+		{name: "wrong audience", mutate: func(c jwt.MapClaims) { c["aud"] = "other-client" }},
+		{name: "wrong issuer", mutate: func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com" }},
+		{name: "expired", mutate: func(c jwt.MapClaims) { c["exp"] = now.Add(-time.Hour).Unix() }},
+		{name: "missing exp", mutate: func(c jwt.MapClaims) { delete(c, "exp") }},
+		{name: "missing sub", mutate: func(c jwt.MapClaims) { delete(c, "sub") }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := valid()
+			tt.mutate(claims)
+			raw, err := issuer.SignIDToken(claims)
+			if err != nil {
+				t.Fatalf("SignIDToken() error = %v", err)
+			}
+			if _, err := provider.VerifyIDToken(ctx, raw, "nonce"); !errors.Is(err, oidc.ErrInvalidIDToken) {
+				t.Fatalf("VerifyIDToken() error = %v, want ErrInvalidIDToken", err)
+			}
+		})
+	}
+
+	raw, _ := issuer.SignIDToken(valid())
+	if _, err := provider.VerifyIDToken(ctx, raw, "nonce"); err != nil {
+		t.Fatalf("valid token rejected: %v", err)
+	}
+}
+
+func TestDiscoveryRejectsIssuerMismatch(t *testing.T) {
+	issuer, err := oidctest.NewIssuer("client", "")
+	if err != nil {
+		t.Fatalf("NewIssuer() error = %v", err)
+	}
+	defer issuer.Close()
+
+	provider := oidc.NewProvider(config.OIDCProvider{
+		Name:     "mock",
+		Issuer:   issuer.URL() + "/",
+		ClientID: "client",
+	}, nil)
+	if _, err := provider.AuthCodeURL(context.Background(), "s", "n", "v"); err == nil {
+		t.Fatal("discovery should fail when issuer does not match exactly")
+	}
+}
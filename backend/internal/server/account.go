@@ -0,0 +1,302 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+
+	"github.com/ymmtyamaterous/diary-oc-api/internal/model"
+	"github.com/ymmtyamaterous/diary-oc-api/internal/validation"
+)
+
+// reauthWindow はパスワード未設定のアカウントで、ログインし直した直後とみなす時間。
+const reauthWindow = 10 * time.Minute
+
+const errReauthRequired = "パスワードが設定されていません。2段階認証のコードを入力するか、IDプロバイダでログインし直してから操作してください"
+
+type deleteAccountPayload struct {
+	Password string `json:"password"`
+	// Code はパスワード未設定のアカウントで本人確認に使う2段階認証のコード
+	Code string `json:"code"`
+}
+
+// confirmWithoutPassword はパスワード未設定(外部IDのみ)のアカウントの本人確認を行う。
+// 2段階認証のコードか、reauthWindow 以内のログインで作られた現在のセッションがあれば確認済みとする。
+func (s *Server) confirmWithoutPassword(ctx context.Context, q querier, userID, code string) (bool, error) {
+	var secret pgtype.Text
+	var enabled bool
+	var lastCounter int64
+	if err := q.QueryRow(ctx, `
+		SELECT totp_secret, totp_enabled_at IS NOT NULL, totp_last_counter
+		FROM users
+		WHERE id = $1
+	`, userID).Scan(&secret, &enabled, &lastCounter); err != nil {
+		return false, err
+	}
+	if enabled && strings.TrimSpace(code) != "" {
+		return verifySecondFactor(ctx, q, userID, secret.String, lastCounter, code)
+	}
+
+	sessionID, ok := getSessionID(ctx)
+	if !ok {
+		return false, nil
+	}
+	var fresh bool
+	err := q.QueryRow(ctx, `
+		SELECT created_at > $2 FROM sessions WHERE id = $1 AND revoked_at IS NULL
+	`, sessionID, time.Now().Add(-reauthWindow)).Scan(&fresh)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	return fresh, err
+}
+
+// rejectWithoutPassword は confirmWithoutPassword で本人確認できなかった場合の 400 を返す。
+// 認証コードが送られていれば総当たりを防ぐため失敗として記録する。
+func (s *Server) rejectWithoutPassword(w http.ResponseWriter, r *http.Request, t loginThrottle, user model.User, code string) {
+	if strings.TrimSpace(code) == "" {
+		writeError(w, http.StatusBadRequest, errReauthRequired)
+		return
+	}
+	s.rejectReauth(w, r, t, user, errReauthRequired)
+}
+
+// handleDeleteAccount はアカウントを削除する。ACCOUNT_DELETION_GRACE_DAYS が 0 の場合は即時に、
+// それ以外は猶予期間の経過後に RunMaintenance が日記・アップロードファイル・セッションごと削除する。
+func (s *Server) handleDeleteAccount(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserID(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "認証トークンが無効です")
+		return
+	}
+
+	var payload deleteAccountPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeError(w, http.StatusBadRequest, "不正なリクエストです")
+		return
+	}
+
+	var hash string
+	user, err := scanUser(s.db.QueryRow(r.Context(), `
+		SELECT `+userColumns+`, COALESCE(password_hash, '')
+		FROM users
+		WHERE id = $1
+	`, userID), &hash)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeError(w, http.StatusUnauthorized, "認証トークンが無効です")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "アカウント削除に失敗しました")
+		return
+	}
+	throttle, ok := s.checkReauthThrottle(w, r, user)
+	if !ok {
+		return
+	}
+	if hash == "" {
+		confirmed, err := s.confirmWithoutPassword(r.Context(), s.db, userID, payload.Code)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "アカウント削除に失敗しました")
+			return
+		}
+		if !confirmed {
+			s.rejectWithoutPassword(w, r, throttle, user, payload.Code)
+			return
+		}
+	} else if _, err := s.passwords.Verify(hash, payload.Password); err != nil {
+		s.rejectReauth(w, r, throttle, user, "パスワードが正しくありません")
+		return
+	}
+
+	if s.cfg.AccountDeletionGraceDays <= 0 {
+		if err := s.purgeUser(r.Context(), userID); err != nil {
+			writeError(w, http.StatusInternalServerError, "アカウント削除に失敗しました")
+			return
+		}
+		writeData(w, http.StatusOK, map[string]string{"message": "アカウントを削除しました"})
+		return
+	}
+
+	ctx := r.Context()
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "アカウント削除に失敗しました")
+		return
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	var deleteAfter time.Time
+	if err := tx.QueryRow(ctx, `
+		UPDATE users
+		SET delete_after = NOW() + make_interval(days => $1), updated_at = NOW()
+		WHERE id = $2
+		RETURNING delete_after
+	`, s.cfg.AccountDeletionGraceDays, userID).Scan(&deleteAfter); err != nil {
+		writeError(w, http.StatusInternalServerError, "アカウント削除に失敗しました")
+		return
+	}
+	if _, err := s.revokeUserSessions(ctx, tx, userID, ""); err != nil {
+		writeError(w, http.StatusInternalServerError, "アカウント削除に失敗しました")
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, "アカウント削除に失敗しました")
+		return
+	}
+
+	writeData(w, http.StatusAccepted, map[string]any{
+		"message":      "アカウントの削除を受け付けました。期限までにログイン情報を入力すると復元できます",
+		"delete_after": deleteAfter,
+	})
+}
+
+// handleRestoreAccount は削除猶予期間中のアカウントを復元し、通常のログインと同様に応答する。
+func (s *Server) handleRestoreAccount(w http.ResponseWriter, r *http.Request) {
+	var payload authPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeError(w, http.StatusBadRequest, "不正なリクエストです")
+		return
+	}
+	if err := validation.RequireEmail(payload.Email); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	throttle := s.newLoginThrottle(r, payload.Email)
+	retryAfter, err := s.loginRetryAfter(r.Context(), throttle)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "アカウントの復元に失敗しました")
+		return
+	}
+	if retryAfter > 0 {
+		writeTooManyAttempts(w, retryAfter)
+		return
+	}
+
+	var hash string
+	user, err := scanUser(s.db.QueryRow(r.Context(), `
+		SELECT `+userColumns+`, COALESCE(password_hash, '')
+		FROM users
+		WHERE email = $1 AND delete_after > NOW()
+	`, strings.TrimSpace(payload.Email)), &hash)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "復元できるアカウントが見つかりません")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "アカウントの復元に失敗しました")
+		return
+	}
+	if _, err := s.passwords.Verify(hash, payload.Password); err != nil {
+		s.rejectLogin(w, r, throttle, &user)
+		return
+	}
+	if err := s.clearLoginFailures(r.Context(), throttle); err != nil {
+		writeError(w, http.StatusInternalServerError, "アカウントの復元に失敗しました")
+		return
+	}
+
+	if _, err := s.db.Exec(r.Context(), `
+		UPDATE users SET delete_after = NULL, updated_at = NOW()
+		WHERE id = $1
+	`, user.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, "アカウントの復元に失敗しました")
+		return
+	}
+
+	s.completeLogin(w, r, user)
+}
+
+// purgeUser はユーザー行を削除し(日記・セッション等は ON DELETE CASCADE)、
+// コミット後にアップロード済みの画像・音声・アバターのうち、他のユーザーの日記が参照していないものを削除する。
+func (s *Server) purgeUser(ctx context.Context, userID string) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	files, err := collectUserFiles(ctx, tx, userID)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM users WHERE id = $1`, userID); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	files, err = s.unreferencedUploads(ctx, files)
+	if err != nil {
+		return err
+	}
+	s.removeUploads(files)
+	return nil
+}
+
+// collectUserFiles はユーザーが参照しているアップロードファイルを返す。
+func collectUserFiles(ctx context.Context, q querier, userID string) ([]uploadedFile, error) {
+	rows, err := q.Query(ctx, `
+		SELECT 'images', image_name FROM diary_entries
+		WHERE user_id = $1 AND image_name IS NOT NULL
+		UNION
+		SELECT 'audio', audio_name FROM diary_entries
+		WHERE user_id = $1 AND audio_name IS NOT NULL
+		UNION
+		SELECT 'avatars', profile_image_url FROM users
+		WHERE id = $1 AND profile_image_url IS NOT NULL
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := make([]uploadedFile, 0)
+	for rows.Next() {
+		var dir, value string
+		if err := rows.Scan(&dir, &value); err != nil {
+			return nil, err
+		}
+		if file, ok := userUploadedFile(dir, value); ok {
+			files = append(files, file)
+		}
+	}
+	return files, rows.Err()
+}
+
+// userUploadedFile は collectUserFiles の行をアップロードファイルに変換する。
+// アバターはプロフィール画像URLからファイル名を取り出し、外部URLなど自前で保存していない画像は対象外にする。
+func userUploadedFile(dir, value string) (uploadedFile, bool) {
+	if dir == "avatars" {
+		name, ok := avatarFileName(value)
+		return uploadedFile{dir: dir, name: name}, ok
+	}
+	return uploadedFile{dir: dir, name: value}, true
+}
+
+// purgeDeletedAccounts は削除猶予期間が過ぎたアカウントを完全に削除する。
+func (s *Server) purgeDeletedAccounts(ctx context.Context) error {
+	rows, err := s.db.Query(ctx, `SELECT id FROM users WHERE delete_after <= NOW()`)
+	if err != nil {
+		return err
+	}
+	userIDs, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return err
+	}
+
+	for _, userID := range userIDs {
+		if err := s.purgeUser(ctx, userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
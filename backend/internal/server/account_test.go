@@ -0,0 +1,60 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ymmtyamaterous/diary-oc-api/internal/config"
+)
+
+func TestUserUploadedFile(t *testing.T) {
+	tests := []struct {
+		name   string
+		dir    string
+		value  string
+		want   uploadedFile
+		wantOK bool
+	}{
+		{name: "image", dir: "images", value: "diary-image.png", want: uploadedFile{dir: "images", name: "diary-image.png"}, wantOK: true},
+		{name: "own avatar", dir: "avatars", value: avatarURLPrefix + "avatar-123.png", want: uploadedFile{dir: "avatars", name: "avatar-123.png"}, wantOK: true},
+		{name: "external avatar", dir: "avatars", value: "https://example.com/me.png", wantOK: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := userUploadedFile(tt.dir, tt.value)
+			if ok != tt.wantOK || (ok && got != tt.want) {
+				t.Fatalf("userUploadedFile() = %+v, %v, want %+v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+// アバターを持つユーザーの削除で、collectUserFiles の行からアバター画像のファイルまで削除されることを確認する。
+func TestPurgeUserRemovesAvatar(t *testing.T) {
+	uploadDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(uploadDir, "avatars"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	avatar := filepath.Join(uploadDir, "avatars", "avatar-123.png")
+	if err := os.WriteFile(avatar, []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := New(config.Config{UploadDir: uploadDir}, nil, nil)
+	file, ok := userUploadedFile("avatars", avatarURLPrefix+"avatar-123.png")
+	if !ok {
+		t.Fatal("own avatar should be collected")
+	}
+	files, err := s.unreferencedUploads(context.Background(), []uploadedFile{file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.removeUploads(files)
+
+	if _, err := os.Stat(avatar); !os.IsNotExist(err) {
+		t.Fatalf("avatar should be removed, stat err = %v", err)
+	}
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ymmtyamaterous/diary-oc-api/internal/auth"
+)
+
+// AUTH_COOKIE_ENABLED のとき、トークンを JavaScript から読めない httpOnly Cookie でも発行する。
+// Cookie はブラウザが自動送信するため、状態を変更するリクエストでは二重送信方式の CSRF 対策を行う。
+const (
+	accessCookieName  = "diary_access"
+	refreshCookieName = "diary_refresh"
+	csrfCookieName    = "diary_csrf"
+	csrfHeaderName    = "X-CSRF-Token"
+	refreshCookiePath = "/api/auth"
+)
+
+// writeSession はセッション発行時の応答を返す。Cookie 認証が有効なら Cookie も設定する。
+func (s *Server) writeSession(w http.ResponseWriter, status int, response authResponse) {
+	if s.cfg.AuthCookieEnabled {
+		csrfToken, err := s.setAuthCookies(w, response.Token, response.RefreshToken)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "トークン生成に失敗しました")
+			return
+		}
+		response.CSRFToken = csrfToken
+	}
+	writeData(w, status, response)
+}
+
+// setAuthCookies はアクセストークン・リフレッシュトークン・CSRF トークンの Cookie を設定し、CSRF トークンを返す。
+func (s *Server) setAuthCookies(w http.ResponseWriter, accessToken, refreshToken string) (string, error) {
+	csrfToken, _, err := auth.GenerateOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	http.SetCookie(w, s.authCookie(accessCookieName, accessToken, "/api", s.accessTokenTTL(), true))
+	http.SetCookie(w, s.authCookie(refreshCookieName, refreshToken, refreshCookiePath, s.refreshTokenTTL(), true))
+	// CSRF トークンはフロントエンドが読み取ってヘッダに付けるため httpOnly にしない
+	http.SetCookie(w, s.authCookie(csrfCookieName, csrfToken, "/", s.refreshTokenTTL(), false))
+	return csrfToken, nil
+}
+
+func (s *Server) clearAuthCookies(w http.ResponseWriter) {
+	if !s.cfg.AuthCookieEnabled {
+		return
+	}
+	http.SetCookie(w, s.authCookie(accessCookieName, "", "/api", -1, true))
+	http.SetCookie(w, s.authCookie(refreshCookieName, "", refreshCookiePath, -1, true))
+	http.SetCookie(w, s.authCookie(csrfCookieName, "", "/", -1, false))
+}
+
+// authCookie は設定に従った属性の Cookie を返す。ttl が負の場合は削除用の Cookie になる。
+func (s *Server) authCookie(name, value, path string, ttl time.Duration, httpOnly bool) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Domain:   s.cfg.AuthCookieDomain,
+		HttpOnly: httpOnly,
+		Secure:   s.cfg.AuthCookieSecure,
+		SameSite: http.SameSiteLaxMode,
+	}
+	switch strings.ToLower(s.cfg.AuthCookieSameSite) {
+	case "strict":
+		cookie.SameSite = http.SameSiteStrictMode
+	case "none":
+		// SameSite=None はブラウザが Secure 属性なしでは受け付けない
+		cookie.SameSite = http.SameSiteNoneMode
+		cookie.Secure = true
+	}
+	if ttl < 0 {
+		cookie.MaxAge = -1
+	} else {
+		cookie.MaxAge = int(ttl / time.Second)
+	}
+	return cookie
+}
+
+// requestToken は Authorization ヘッダ、Cookie 認証が有効であればアクセストークン Cookie の順にトークンを探す。
+func (s *Server) requestToken(r *http.Request) (string, bool) {
+	if authHeader := strings.TrimSpace(r.Header.Get("Authorization")); authHeader != "" {
+		if !strings.HasPrefix(authHeader, "Bearer ") {
+			return "", false
+		}
+		token := strings.TrimSpace(strings.TrimPrefix(authHeader, "Bearer "))
+		return token, token != ""
+	}
+	if !s.cfg.AuthCookieEnabled {
+		return "", false
+	}
+	cookie, err := r.Cookie(accessCookieName)
+	if err != nil || cookie.Value == "" {
+		return "", false
+	}
+	return cookie.Value, true
+}
+
+// refreshTokenCookie は Cookie 認証が有効な場合にリフレッシュトークン Cookie を返す。
+func (s *Server) refreshTokenCookie(r *http.Request) string {
+	if !s.cfg.AuthCookieEnabled {
+		return ""
+	}
+	cookie, err := r.Cookie(refreshCookieName)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// csrfMiddleware は認証 Cookie を伴う状態変更リクエストに対し、X-CSRF-Token ヘッダと CSRF Cookie の一致を要求する。
+// Authorization ヘッダ付きのリクエストはブラウザが自動で付与しないため対象外。
+// 認証 Cookie のないリクエスト(ログインや登録など Cookie を発行するもの)は、攻撃者のアカウントで
+// ログインさせられないよう、送信元オリジンが ALLOWED_ORIGINS に含まれることを要求する。
+func (s *Server) csrfMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.cfg.AuthCookieEnabled || isSafeMethod(r.Method) || r.Header.Get("Authorization") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !hasAuthCookie(r) {
+			if !s.isTrustedOrigin(r) {
+				writeError(w, http.StatusForbidden, "許可されていない送信元からのリクエストです")
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cookie, err := r.Cookie(csrfCookieName)
+		header := r.Header.Get(csrfHeaderName)
+		if err != nil || cookie.Value == "" || header == "" ||
+			subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(header)) != 1 {
+			writeError(w, http.StatusForbidden, "CSRFトークンが無効です。ページを再読み込みしてください")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isTrustedOrigin は Origin ヘッダが ALLOWED_ORIGINS に含まれるかを返す。Origin を付けない
+// ブラウザ以外のクライアントは許可し、Origin がなくても Sec-Fetch-Site がクロスサイトなら拒否する。
+func (s *Server) isTrustedOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return r.Header.Get("Sec-Fetch-Site") != "cross-site"
+	}
+	for _, allowed := range s.cfg.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAuthCookie(r *http.Request) bool {
+	for _, name := range []string{accessCookieName, refreshCookieName} {
+		if cookie, err := r.Cookie(name); err == nil && cookie.Value != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ymmtyamaterous/diary-oc-api/internal/config"
+)
+
+func TestCSRFMiddleware(t *testing.T) {
+	tests := []struct {
+		name      string
+		enabled   bool
+		method    string
+		bearer    bool
+		cookies   map[string]string
+		header    string
+		origin    string
+		fetchSite string
+		want      int
+	}{
+		{name: "cookie auth disabled", enabled: false, method: http.MethodPost, cookies: map[string]string{accessCookieName: "jwt"}, want: http.StatusOK},
+		{name: "safe method", enabled: true, method: http.MethodGet, cookies: map[string]string{accessCookieName: "jwt"}, want: http.StatusOK},
+		{name: "bearer request", enabled: true, method: http.MethodPost, bearer: true, cookies: map[string]string{accessCookieName: "jwt"}, want: http.StatusOK},
+		{name: "no auth cookie", enabled: true, method: http.MethodPost, want: http.StatusOK},
+		{name: "login from allowed origin", enabled: true, method: http.MethodPost, origin: "http://localhost:3000", want: http.StatusOK},
+		{name: "login from other origin", enabled: true, method: http.MethodPost, origin: "https://evil.example", want: http.StatusForbidden},
+		{name: "cross-site without origin", enabled: true, method: http.MethodPost, fetchSite: "cross-site", want: http.StatusForbidden},
+		{name: "other origin with cookie auth disabled", enabled: false, method: http.MethodPost, origin: "https://evil.example", want: http.StatusOK},
+		{name: "missing header", enabled: true, method: http.MethodPost, cookies: map[string]string{accessCookieName: "jwt", csrfCookieName: "csrf"}, want: http.StatusForbidden},
+		{name: "mismatched header", enabled: true, method: http.MethodDelete, cookies: map[string]string{accessCookieName: "jwt", csrfCookieName: "csrf"}, header: "other", want: http.StatusForbidden},
+		{name: "refresh cookie only", enabled: true, method: http.MethodPost, cookies: map[string]string{refreshCookieName: "rt"}, header: "csrf", want: http.StatusForbidden},
+		{name: "matching header", enabled: true, method: http.MethodPut, cookies: map[string]string{accessCookieName: "jwt", csrfCookieName: "csrf"}, header: "csrf", want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(config.Config{AuthCookieEnabled: tt.enabled, AllowedOrigins: []string{"http://localhost:3000"}}, nil, nil)
+			handler := s.csrfMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			req := httptest.NewRequest(tt.method, "/api/diaries", nil)
+			if tt.bearer {
+				req.Header.Set("Authorization", "Bearer token")
+			}
+			for name, value := range tt.cookies {
+				req.AddCookie(&http.Cookie{Name: name, Value: value})
+			}
+			if tt.header != "" {
+				req.Header.Set(csrfHeaderName, tt.header)
+			}
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			if tt.fetchSite != "" {
+				req.Header.Set("Sec-Fetch-Site", tt.fetchSite)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetAuthCookies(t *testing.T) {
+	s := New(config.Config{AuthCookieEnabled: true, AuthCookieSameSite: "none", AccessTokenMinutes: 15, RefreshTokenDays: 30}, nil, nil)
+	rec := httptest.NewRecorder()
+	csrfToken, err := s.setAuthCookies(rec, "access", "refresh")
+	if err != nil {
+		t.Fatalf("setAuthCookies() error = %v", err)
+	}
+
+	cookies := map[string]*http.Cookie{}
+	for _, cookie := range rec.Result().Cookies() {
+		cookies[cookie.Name] = cookie
+	}
+	access, refresh, csrf := cookies[accessCookieName], cookies[refreshCookieName], cookies[csrfCookieName]
+	if access == nil || refresh == nil || csrf == nil {
+		t.Fatalf("missing cookies: %v", cookies)
+	}
+	if !access.HttpOnly || !refresh.HttpOnly || csrf.HttpOnly {
+		t.Fatal("token cookies must be httpOnly and the csrf cookie readable by scripts")
+	}
+	if !access.Secure || access.SameSite != http.SameSiteNoneMode {
+		t.Fatal("SameSite=None cookies must be Secure")
+	}
+	if refresh.Path != refreshCookiePath || csrf.Value != csrfToken {
+		t.Fatalf("unexpected refresh path %q or csrf value", refresh.Path)
+	}
+	if access.MaxAge != 15*60 {
+		t.Fatalf("access cookie max-age = %d, want %d", access.MaxAge, 15*60)
+	}
+}
+
+func TestRequestToken(t *testing.T) {
+	withCookie := httptest.NewRequest(http.MethodGet, "/api/auth/me", nil)
+	withCookie.AddCookie(&http.Cookie{Name: accessCookieName, Value: "from-cookie"})
+
+	disabled := New(config.Config{}, nil, nil)
+	if _, ok := disabled.requestToken(withCookie); ok {
+		t.Fatal("cookie must be ignored when cookie auth is disabled")
+	}
+
+	enabled := New(config.Config{AuthCookieEnabled: true}, nil, nil)
+	if token, ok := enabled.requestToken(withCookie); !ok || token != "from-cookie" {
+		t.Fatalf("requestToken() = %q, %v", token, ok)
+	}
+
+	withCookie.Header.Set("Authorization", "Bearer from-header")
+	if token, _ := enabled.requestToken(withCookie); token != "from-header" {
+		t.Fatalf("Authorization header should take precedence, got %q", token)
+	}
+}
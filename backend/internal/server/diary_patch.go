@@ -0,0 +1,235 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"github.com/ymmtyamaterous/diary-oc-api/internal/model"
+	"github.com/ymmtyamaterous/diary-oc-api/internal/validation"
+)
+
+const mergePatchContentType = "application/merge-patch+json"
+
+// diaryPatchRequired は merge patch で null (項目の削除)を指定できない項目とそのエラーメッセージ。
+var diaryPatchRequired = map[string]string{
+	"date":      "日付は必須です",
+	"is_public": "is_public に null は指定できません",
+}
+
+// handlePatchDiary は JSON Merge Patch (RFC 7396) で日記の一部の項目だけを変更する。
+// 省略した項目はそのまま残り、null を指定した項目は空になる。何も変わらない場合は updated_at と ETag を変えない。
+func (s *Server) handlePatchDiary(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserID(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "認証トークンが無効です")
+		return
+	}
+
+	id := chi.URLParam(r, "id")
+	if _, err := uuid.Parse(id); err != nil {
+		writeError(w, http.StatusBadRequest, "日記IDが不正です")
+		return
+	}
+
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil || (mediaType != mergePatchContentType && mediaType != "application/json") {
+			writeError(w, http.StatusUnsupportedMediaType, "Content-Type は "+mergePatchContentType+" を指定してください")
+			return
+		}
+	}
+	patch, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "不正なリクエストです")
+		return
+	}
+
+	ctx := r.Context()
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "日記更新に失敗しました")
+		return
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	current, err := lockDiary(ctx, tx, id)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "日記が見つかりません")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "日記更新に失敗しました")
+		return
+	}
+	if current.UserID != userID {
+		writeError(w, http.StatusForbidden, "この日記を変更する権限がありません")
+		return
+	}
+	if !ifMatch(r, diaryETag(current.Version)) {
+		writeDiaryPreconditionFailed(w, current)
+		return
+	}
+
+	original := payloadFromEntry(current)
+	payload, err := mergeDiaryPatch(original, patch)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := validateDiaryPayload(payload); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if payload.IsPublic && !s.canPublish(ctx) {
+		writeError(w, http.StatusForbidden, errPublishUnverified)
+		return
+	}
+
+	fieldsChanged := !diaryFieldsEqual(original, payload)
+	tagsChanged := !sameTags(original.Tags, payload.Tags)
+	if !fieldsChanged && !tagsChanged {
+		writeDiary(w, http.StatusOK, current)
+		return
+	}
+
+	if err := recordDiaryRevision(ctx, tx, current, s.cfg.DiaryRevisionLimit); err != nil {
+		writeError(w, http.StatusInternalServerError, "日記更新に失敗しました")
+		return
+	}
+	entry, err := updateDiaryEntry(ctx, tx, id, payload)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "日記更新に失敗しました")
+		return
+	}
+	if tagsChanged {
+		if entry.Tags, err = setDiaryTags(ctx, tx, userID, entry.ID, payload.Tags); err != nil {
+			writeError(w, http.StatusInternalServerError, "日記更新に失敗しました")
+			return
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, "日記更新に失敗しました")
+		return
+	}
+
+	writeDiary(w, http.StatusOK, entry)
+}
+
+// payloadFromEntry は保存済みの日記を更新リクエストと同じ形に変換する。
+func payloadFromEntry(entry model.DiaryEntry) diaryCreatePayload {
+	tags := entry.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	return diaryCreatePayload{
+		Content:                entry.Content,
+		Date:                   entry.Date,
+		Weather:                entry.Weather,
+		IsPublic:               entry.IsPublic,
+		ImageURL:               entry.ImageURL,
+		ImageName:              entry.ImageName,
+		AudioURL:               entry.AudioURL,
+		AudioName:              entry.AudioName,
+		Events:                 entry.Events,
+		Emotions:               entry.Emotions,
+		GoodThings:             entry.GoodThings,
+		Reflections:            entry.Reflections,
+		Gratitude:              entry.Gratitude,
+		TomorrowGoals:          entry.TomorrowGoals,
+		TomorrowLookingForward: entry.TomorrowLookingForward,
+		Learnings:              entry.Learnings,
+		HealthHabits:           entry.HealthHabits,
+		TodayInOneWord:         entry.TodayInOneWord,
+		Tags:                   tags,
+	}
+}
+
+// mergeDiaryPatch は merge patch を current に適用した結果を返す。
+// 日記の項目は入れ子を持たないため、パッチのメンバーごとに値を置き換えるか、null なら削除するだけでよい。
+func mergeDiaryPatch(current diaryCreatePayload, patch []byte) (diaryCreatePayload, error) {
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(patch, &members); err != nil || members == nil {
+		return current, errors.New("パッチは JSON オブジェクトで指定してください")
+	}
+
+	base, err := json.Marshal(current)
+	if err != nil {
+		return current, err
+	}
+	var document map[string]json.RawMessage
+	if err := json.Unmarshal(base, &document); err != nil {
+		return current, err
+	}
+
+	for name, value := range members {
+		if _, ok := document[name]; !ok {
+			return current, fmt.Errorf("%s は変更できない項目です", name)
+		}
+		if bytes.Equal(bytes.TrimSpace(value), []byte("null")) {
+			if message, required := diaryPatchRequired[name]; required {
+				return current, errors.New(message)
+			}
+			delete(document, name)
+			continue
+		}
+		document[name] = value
+	}
+
+	merged, err := json.Marshal(document)
+	if err != nil {
+		return current, err
+	}
+	var payload diaryCreatePayload
+	if err := json.Unmarshal(merged, &payload); err != nil {
+		return current, errors.New("不正なリクエストです")
+	}
+	// tags の削除はすべてのタグを外すことを意味する
+	if payload.Tags == nil {
+		payload.Tags = []string{}
+	}
+	return payload, nil
+}
+
+// diaryFieldsEqual はタグ以外の項目が保存時に同じ値になるかを返す。空白だけの文字列は null と同じに扱う。
+func diaryFieldsEqual(a, b diaryCreatePayload) bool {
+	normalize := func(p diaryCreatePayload) diaryCreatePayload {
+		p.Tags = nil
+		for _, field := range []**string{
+			&p.Content, &p.Weather, &p.ImageURL, &p.ImageName, &p.AudioURL, &p.AudioName,
+			&p.Events, &p.Emotions, &p.GoodThings, &p.Reflections, &p.Gratitude,
+			&p.TomorrowGoals, &p.TomorrowLookingForward, &p.Learnings, &p.HealthHabits, &p.TodayInOneWord,
+		} {
+			*field = emptyToNil(*field)
+		}
+		return p
+	}
+	return reflect.DeepEqual(normalize(a), normalize(b))
+}
+
+// sameTags はタグ名の集合が大文字小文字を区別せずに等しいかを返す。
+func sameTags(a, b []string) bool {
+	key := func(tags []string) []string {
+		normalized, err := validation.NormalizeTags(tags)
+		if err != nil {
+			return nil
+		}
+		for i, tag := range normalized {
+			normalized[i] = strings.ToLower(tag)
+		}
+		slices.Sort(normalized)
+		return normalized
+	}
+	return slices.Equal(key(a), key(b))
+}
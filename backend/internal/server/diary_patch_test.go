@@ -0,0 +1,73 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeDiaryPatch(t *testing.T) {
+	current := diaryCreatePayload{
+		Date:     "2026-10-01",
+		IsPublic: true,
+		Content:  strPtr("朝から雨だった"),
+		Weather:  strPtr("rainy"),
+		Events:   strPtr("図書館に行った"),
+		Tags:     []string{"読書"},
+	}
+
+	got, err := mergeDiaryPatch(current, []byte(`{"content":"午後は晴れた","weather":null}`))
+	if err != nil {
+		t.Fatalf("mergeDiaryPatch() error = %v", err)
+	}
+	want := current
+	want.Content = strPtr("午後は晴れた")
+	want.Weather = nil
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("mergeDiaryPatch() = %+v, want %+v", got, want)
+	}
+
+	cleared, err := mergeDiaryPatch(current, []byte(`{"tags":null}`))
+	if err != nil || cleared.Tags == nil || len(cleared.Tags) != 0 {
+		t.Fatalf("tags null should clear tags: %v, %v", cleared.Tags, err)
+	}
+
+	for _, patch := range []string{
+		`[]`,
+		`null`,
+		`{"date":null}`,
+		`{"is_public":null}`,
+		`{"id":"8b6d3f0e-4a51-4a8f-9d8e-3c0f5f0b6a11"}`,
+		`{"is_public":"yes"}`,
+	} {
+		if _, err := mergeDiaryPatch(current, []byte(patch)); err == nil {
+			t.Fatalf("mergeDiaryPatch(%s) should fail", patch)
+		}
+	}
+}
+
+func TestDiaryPatchChangeDetection(t *testing.T) {
+	current := diaryCreatePayload{
+		Date:    "2026-10-01",
+		Content: strPtr("朝から雨だった"),
+		Tags:    []string{"Work", "読書"},
+	}
+
+	same, err := mergeDiaryPatch(current, []byte(`{"content":"朝から雨だった","events":"  ","tags":["読書","work"]}`))
+	if err != nil {
+		t.Fatalf("mergeDiaryPatch() error = %v", err)
+	}
+	if !diaryFieldsEqual(current, same) || !sameTags(current.Tags, same.Tags) {
+		t.Fatal("patch with the same values should not count as a change")
+	}
+
+	changed, err := mergeDiaryPatch(current, []byte(`{"is_public":true}`))
+	if err != nil {
+		t.Fatalf("mergeDiaryPatch() error = %v", err)
+	}
+	if diaryFieldsEqual(current, changed) {
+		t.Fatal("is_public change should be detected")
+	}
+	if sameTags(current.Tags, []string{"読書"}) {
+		t.Fatal("removed tag should be detected")
+	}
+}
@@ -0,0 +1,305 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"github.com/ymmtyamaterous/diary-oc-api/internal/model"
+	"github.com/ymmtyamaterous/diary-oc-api/internal/validation"
+)
+
+// validateDraftPayload は下書きを検証する。すべての項目が空でもよく、日付を省略すると defaultDate を使う。
+func validateDraftPayload(payload *diaryCreatePayload, defaultDate string) error {
+	payload.Date = strings.TrimSpace(payload.Date)
+	if payload.Date == "" {
+		payload.Date = defaultDate
+	}
+	if _, err := time.Parse("2006-01-02", payload.Date); err != nil {
+		return errors.New("日付形式が不正です")
+	}
+	if err := validation.ValidateWeather(payload.Weather); err != nil {
+		return err
+	}
+	for _, name := range []*string{payload.ImageName, payload.AudioName} {
+		if err := validation.ValidateFileName(name); err != nil {
+			return err
+		}
+	}
+	if _, err := validation.NormalizeTags(payload.Tags); err != nil {
+		return err
+	}
+	return nil
+}
+
+// lockDraft は更新のために下書きを行ロックして読み取る。所有者の確認は呼び出し側で行う。
+func lockDraft(ctx context.Context, q querier, id string) (model.DiaryEntry, error) {
+	return scanDiaryEntry(q.QueryRow(ctx, `
+		SELECT `+diaryColumns+`
+		FROM diary_entries
+		WHERE id = $1 AND is_draft AND deleted_at IS NULL
+		FOR UPDATE
+	`, id))
+}
+
+// handleListDrafts は自分の下書きを更新日時の新しい順に返す。
+func (s *Server) handleListDrafts(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserID(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "認証トークンが無効です")
+		return
+	}
+
+	rows, err := s.db.Query(r.Context(), `
+		SELECT `+diaryColumns+`
+		FROM diary_entries
+		WHERE user_id = $1 AND is_draft AND deleted_at IS NULL
+		ORDER BY updated_at DESC, id DESC
+	`, userID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "下書きの取得に失敗しました")
+		return
+	}
+	defer rows.Close()
+
+	drafts := make([]model.DiaryEntry, 0)
+	for rows.Next() {
+		draft, err := scanDiaryEntry(rows)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "下書きの取得に失敗しました")
+			return
+		}
+		drafts = append(drafts, draft)
+	}
+	if err := rows.Err(); err != nil {
+		writeError(w, http.StatusInternalServerError, "下書きの取得に失敗しました")
+		return
+	}
+
+	writeData(w, http.StatusOK, drafts)
+}
+
+// handleCreateDraft は下書きを作成する。以降の保存は handleAutosaveDraft で行う。
+func (s *Server) handleCreateDraft(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserID(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "認証トークンが無効です")
+		return
+	}
+
+	var payload diaryCreatePayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeError(w, http.StatusBadRequest, "不正なリクエストです")
+		return
+	}
+	// 日付を省略した場合は、サーバーのローカル時刻ではなく APP_TIMEZONE での今日にする
+	if err := validateDraftPayload(&payload, time.Now().In(s.location).Format("2006-01-02")); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx := r.Context()
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "下書きの保存に失敗しました")
+		return
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	draft, err := insertDiaryEntry(ctx, tx, userID, payload, true)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "下書きの保存に失敗しました")
+		return
+	}
+	if draft.Tags, err = setDiaryTags(ctx, tx, userID, draft.ID, payload.Tags); err != nil {
+		writeError(w, http.StatusInternalServerError, "下書きの保存に失敗しました")
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, "下書きの保存に失敗しました")
+		return
+	}
+
+	writeDiary(w, http.StatusCreated, draft)
+}
+
+// handleAutosaveDraft は下書きの内容を payload で置き換える。編集中に繰り返し呼ばれる前提で、
+// 版は記録せず、内容が変わらなければ書き込まない。応答は ID と更新日時だけにする。
+func (s *Server) handleAutosaveDraft(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserID(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "認証トークンが無効です")
+		return
+	}
+
+	id := chi.URLParam(r, "id")
+	if _, err := uuid.Parse(id); err != nil {
+		writeError(w, http.StatusBadRequest, "下書きIDが不正です")
+		return
+	}
+
+	var payload diaryCreatePayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeError(w, http.StatusBadRequest, "不正なリクエストです")
+		return
+	}
+
+	ctx := r.Context()
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "下書きの保存に失敗しました")
+		return
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	current, err := lockDraft(ctx, tx, id)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		writeError(w, http.StatusInternalServerError, "下書きの保存に失敗しました")
+		return
+	}
+	if err != nil || current.UserID != userID {
+		writeError(w, http.StatusNotFound, "下書きが見つかりません")
+		return
+	}
+	if !ifMatch(r, diaryETag(current.Version)) {
+		writeDiaryPreconditionFailed(w, current)
+		return
+	}
+	if err := validateDraftPayload(&payload, current.Date); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if payload.Tags == nil {
+		payload.Tags = []string{}
+	}
+
+	saved := current
+	original := payloadFromEntry(current)
+	tagsChanged := !sameTags(original.Tags, payload.Tags)
+	if !diaryFieldsEqual(original, payload) || tagsChanged {
+		if saved, err = updateDiaryEntry(ctx, tx, id, payload); err != nil {
+			writeError(w, http.StatusInternalServerError, "下書きの保存に失敗しました")
+			return
+		}
+		if tagsChanged {
+			if _, err := setDiaryTags(ctx, tx, userID, id, payload.Tags); err != nil {
+				writeError(w, http.StatusInternalServerError, "下書きの保存に失敗しました")
+				return
+			}
+		}
+		if err := tx.Commit(ctx); err != nil {
+			writeError(w, http.StatusInternalServerError, "下書きの保存に失敗しました")
+			return
+		}
+	}
+
+	w.Header().Set("ETag", diaryETag(saved.Version))
+	writeData(w, http.StatusOK, map[string]any{
+		"id":         saved.ID,
+		"updated_at": saved.UpdatedAt,
+	})
+}
+
+// handlePublishDraft は下書きを通常の日記と同じ条件で検証し、日記として保存する。
+// 作成日時は公開した時点にする。
+func (s *Server) handlePublishDraft(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserID(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "認証トークンが無効です")
+		return
+	}
+
+	id := chi.URLParam(r, "id")
+	if _, err := uuid.Parse(id); err != nil {
+		writeError(w, http.StatusBadRequest, "下書きIDが不正です")
+		return
+	}
+
+	ctx := r.Context()
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "下書きの公開に失敗しました")
+		return
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	draft, err := lockDraft(ctx, tx, id)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		writeError(w, http.StatusInternalServerError, "下書きの公開に失敗しました")
+		return
+	}
+	if err != nil || draft.UserID != userID {
+		writeError(w, http.StatusNotFound, "下書きが見つかりません")
+		return
+	}
+	if !ifMatch(r, diaryETag(draft.Version)) {
+		writeDiaryPreconditionFailed(w, draft)
+		return
+	}
+
+	payload := payloadFromEntry(draft)
+	if err := validateDiaryPayload(payload); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if payload.IsPublic && !s.canPublish(ctx) {
+		writeError(w, http.StatusForbidden, errPublishUnverified)
+		return
+	}
+
+	entry, err := scanDiaryEntry(tx.QueryRow(ctx, `
+		UPDATE diary_entries
+		SET is_draft = FALSE, created_at = NOW(), updated_at = NOW(), version = version + 1
+		WHERE id = $1
+		RETURNING `+diaryColumns,
+		id,
+	))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "下書きの公開に失敗しました")
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, "下書きの公開に失敗しました")
+		return
+	}
+
+	writeDiary(w, http.StatusOK, entry)
+}
+
+// handleDeleteDraft は下書きを添付ファイルごと削除する。下書きはゴミ箱を経由しない。
+func (s *Server) handleDeleteDraft(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserID(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "認証トークンが無効です")
+		return
+	}
+
+	id := chi.URLParam(r, "id")
+	if _, err := uuid.Parse(id); err != nil {
+		writeError(w, http.StatusBadRequest, "下書きIDが不正です")
+		return
+	}
+
+	purged, err := s.purgeDiaries(r.Context(), `
+		DELETE FROM diary_entries
+		WHERE id = $1 AND user_id = $2 AND is_draft
+		RETURNING image_name, audio_name
+	`, id, userID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "下書きの削除に失敗しました")
+		return
+	}
+	if purged == 0 {
+		writeError(w, http.StatusNotFound, "下書きが見つかりません")
+		return
+	}
+
+	writeData(w, http.StatusOK, map[string]string{"message": "下書きを削除しました"})
+}
@@ -0,0 +1,30 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateDraftPayload(t *testing.T) {
+	// 本文が空の下書きも保存でき、日付を省略すると既定の日付になる
+	empty := diaryCreatePayload{}
+	if err := validateDraftPayload(&empty, "2026-10-17"); err != nil {
+		t.Fatalf("empty draft should pass: %v", err)
+	}
+	if empty.Date != "2026-10-17" {
+		t.Fatalf("Date = %q, want default date", empty.Date)
+	}
+	if err := validateDiaryPayload(empty); err == nil {
+		t.Fatal("empty draft should not pass publish validation")
+	}
+
+	for _, payload := range []diaryCreatePayload{
+		{Date: "2026/10/17"},
+		{Weather: strPtr("typhoon")},
+		{Tags: []string{strings.Repeat("あ", 51)}},
+	} {
+		if err := validateDraftPayload(&payload, "2026-10-17"); err == nil {
+			t.Fatalf("validateDraftPayload(%+v) should fail", payload)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ymmtyamaterous/diary-oc-api/internal/model"
+)
+
+// diaryETag は日記のバージョンから強い ETag を作る。
+func diaryETag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// writeDiary は日記を ETag ヘッダー付きで返す。
+func writeDiary(w http.ResponseWriter, status int, entry model.DiaryEntry) {
+	w.Header().Set("ETag", diaryETag(entry.Version))
+	writeData(w, status, entry)
+}
+
+// ifMatch は If-Match ヘッダーが etag に一致するかを返す。ヘッダーがなければ条件なしとして true を返す。
+// If-Match は強い比較のため、W/ 付きの ETag は一致しない。
+func ifMatch(r *http.Request, etag string) bool {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" || header == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		if strings.TrimSpace(candidate) == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// writeDiaryPreconditionFailed は If-Match が古い場合に、クライアントがマージできるようサーバー側の最新の日記を返す。
+func writeDiaryPreconditionFailed(w http.ResponseWriter, current model.DiaryEntry) {
+	w.Header().Set("ETag", diaryETag(current.Version))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusPreconditionFailed)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"error": "日記は別の場所で更新されています。最新の内容を確認してください",
+		"data":  current,
+	})
+}
+
+// lockDiary は更新のために日記を行ロックして読み取る。ゴミ箱の日記と下書きは見つからない扱いにする。
+// 所有者の確認は呼び出し側で行う。
+func lockDiary(ctx context.Context, q querier, id string) (model.DiaryEntry, error) {
+	return scanDiaryEntry(q.QueryRow(ctx, `
+		SELECT `+diaryColumns+`
+		FROM diary_entries
+		WHERE id = $1 AND deleted_at IS NULL AND NOT is_draft
+		FOR UPDATE
+	`, id))
+}
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIfMatch(t *testing.T) {
+	etag := diaryETag(3)
+	if etag != `"3"` {
+		t.Fatalf("diaryETag(3) = %s", etag)
+	}
+
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{header: "", want: true},
+		{header: "*", want: true},
+		{header: `"3"`, want: true},
+		{header: `"2", "3"`, want: true},
+		{header: `"2"`, want: false},
+		{header: `W/"3"`, want: false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("PUT", "/api/diaries/x", nil)
+		if tt.header != "" {
+			r.Header.Set("If-Match", tt.header)
+		}
+		if got := ifMatch(r, etag); got != tt.want {
+			t.Fatalf("ifMatch(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,14 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// handleJWKS は他サービスがアクセストークンを検証するための公開鍵を返す。
+// HS256 で運用している場合は公開できる鍵がないため空の一覧になる。
+func (s *Server) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	_ = json.NewEncoder(w).Encode(s.keys.JWKS())
+}
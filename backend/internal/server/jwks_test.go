@@ -0,0 +1,39 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ymmtyamaterous/diary-oc-api/internal/auth"
+	"github.com/ymmtyamaterous/diary-oc-api/internal/config"
+)
+
+func TestHandleJWKS(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	keys, err := auth.NewKeySet(key)
+	if err != nil {
+		t.Fatalf("NewKeySet() error = %v", err)
+	}
+	s := New(config.Config{}, nil, keys)
+
+	rec := httptest.NewRecorder()
+	s.Router().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	var body auth.JWKSet
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(body.Keys) != 1 || body.Keys[0].Kty != "OKP" || body.Keys[0].Alg != "EdDSA" {
+		t.Fatalf("unexpected jwks: %+v", body)
+	}
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+const maintenanceInterval = time.Hour
+
+// RunMaintenance は ctx がキャンセルされるまで定期的に後片付け処理を実行する。
+func (s *Server) RunMaintenance(ctx context.Context) {
+	ticker := time.NewTicker(maintenanceInterval)
+	defer ticker.Stop()
+
+	for {
+		s.runMaintenanceOnce(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) runMaintenanceOnce(ctx context.Context) {
+	if err := s.purgeDeletedAccounts(ctx); err != nil {
+		log.Printf("purge deleted accounts failed: %v", err)
+	}
+	if err := s.purgeTrashedDiaries(ctx); err != nil {
+		log.Printf("purge trashed diaries failed: %v", err)
+	}
+	if err := s.purgeLoginThrottles(ctx); err != nil {
+		log.Printf("purge login throttles failed: %v", err)
+	}
+	if err := s.purgeOIDCLoginStates(ctx); err != nil {
+		log.Printf("purge oidc login states failed: %v", err)
+	}
+}
@@ -0,0 +1,444 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+
+	"github.com/ymmtyamaterous/diary-oc-api/internal/auth"
+	"github.com/ymmtyamaterous/diary-oc-api/internal/model"
+	"github.com/ymmtyamaterous/diary-oc-api/internal/oidc"
+)
+
+const (
+	oidcStateTTL          = 10 * time.Minute
+	oidcBindingCookieName = "diary_oidc_binding"
+	oidcBindingCookiePath = "/api/auth/oidc"
+	maxDisplayNameRunes   = 255
+	errOIDCUnknown        = "IDプロバイダが見つかりません"
+	errOIDCAuthentication = "IDプロバイダでの認証に失敗しました"
+	errOIDCBinding        = "ログインを開始したブラウザで操作してください。もう一度お試しください"
+)
+
+var (
+	errIdentityEmailMissing  = errors.New("identity has no email")
+	errIdentityEmailConflict = errors.New("email belongs to another account")
+	errAccountDeleting       = errors.New("account is scheduled for deletion")
+)
+
+type oidcCallbackPayload struct {
+	Code  string `json:"code"`
+	State string `json:"state"`
+}
+
+func (s *Server) handleListOIDCProviders(w http.ResponseWriter, r *http.Request) {
+	names := make([]string, 0, len(s.cfg.OIDCProviders))
+	for _, provider := range s.cfg.OIDCProviders {
+		names = append(names, provider.Name)
+	}
+	writeData(w, http.StatusOK, names)
+}
+
+func (s *Server) handleStartOIDC(w http.ResponseWriter, r *http.Request) {
+	s.beginOIDC(w, r, nil)
+}
+
+// handleLinkOIDC はログイン中のアカウントに外部IDを連携するための認可URLを返す。
+func (s *Server) handleLinkOIDC(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserID(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "認証トークンが無効です")
+		return
+	}
+	s.beginOIDC(w, r, &userID)
+}
+
+// beginOIDC は state / nonce / PKCE verifier を保存し、IDプロバイダの認可URLを返す。
+// state は平文をクライアントに渡し、DBにはハッシュのみを保存する。
+// 他人が開始した認可リクエストの code と state を送り込まれないよう、ブラウザにはバインド用の httpOnly Cookie を設定する。
+func (s *Server) beginOIDC(w http.ResponseWriter, r *http.Request, userID *string) {
+	provider, ok := s.oidcProviders[chi.URLParam(r, "provider")]
+	if !ok {
+		writeError(w, http.StatusNotFound, errOIDCUnknown)
+		return
+	}
+
+	state, stateHash, err := auth.GenerateOpaqueToken()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "ログイン要求の作成に失敗しました")
+		return
+	}
+	nonce, err := oidc.GenerateVerifier()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "ログイン要求の作成に失敗しました")
+		return
+	}
+	verifier, err := oidc.GenerateVerifier()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "ログイン要求の作成に失敗しました")
+		return
+	}
+	binding, bindingHash, err := auth.GenerateOpaqueToken()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "ログイン要求の作成に失敗しました")
+		return
+	}
+
+	authURL, err := provider.AuthCodeURL(r.Context(), state, nonce, verifier)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, "IDプロバイダとの通信に失敗しました")
+		return
+	}
+
+	if _, err := s.db.Exec(r.Context(), `
+		INSERT INTO oidc_login_states (state_hash, provider, nonce, code_verifier, user_id, binding_hash, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`, stateHash, provider.Name(), nonce, verifier, userID, bindingHash, time.Now().Add(oidcStateTTL)); err != nil {
+		writeError(w, http.StatusInternalServerError, "ログイン要求の作成に失敗しました")
+		return
+	}
+
+	http.SetCookie(w, s.oidcBindingCookie(r, binding, oidcStateTTL))
+	writeData(w, http.StatusOK, map[string]string{"authorization_url": authURL})
+}
+
+// handleOIDCCallback はフロントエンドが受け取った code と state を検証し、
+// ログイン(必要に応じてアカウント作成)または既存アカウントへの連携を行う。
+// 認可リクエストを開始したブラウザの Cookie がなければ拒否し、連携の場合は開始したユーザーでのログインも要求する。
+func (s *Server) handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	provider, ok := s.oidcProviders[chi.URLParam(r, "provider")]
+	if !ok {
+		writeError(w, http.StatusNotFound, errOIDCUnknown)
+		return
+	}
+
+	var payload oidcCallbackPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeError(w, http.StatusBadRequest, "不正なリクエストです")
+		return
+	}
+	if payload.Code == "" || payload.State == "" {
+		writeError(w, http.StatusBadRequest, "不正なリクエストです")
+		return
+	}
+
+	binding, err := r.Cookie(oidcBindingCookieName)
+	if err != nil || binding.Value == "" {
+		writeError(w, http.StatusBadRequest, errOIDCBinding)
+		return
+	}
+	http.SetCookie(w, s.oidcBindingCookie(r, "", -1))
+
+	ctx := r.Context()
+	var nonce, verifier string
+	var linkUserID *string
+	var bindingHash pgtype.Text
+	err = s.db.QueryRow(ctx, `
+		DELETE FROM oidc_login_states
+		WHERE state_hash = $1 AND provider = $2 AND expires_at > NOW()
+		RETURNING nonce, code_verifier, user_id, binding_hash
+	`, auth.HashOpaqueToken(payload.State), provider.Name()).Scan(&nonce, &verifier, &linkUserID, &bindingHash)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeError(w, http.StatusBadRequest, "ログイン要求の有効期限が切れました。もう一度お試しください")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, errOIDCAuthentication)
+		return
+	}
+	if !bindingHash.Valid ||
+		subtle.ConstantTimeCompare([]byte(bindingHash.String), []byte(auth.HashOpaqueToken(binding.Value))) != 1 {
+		writeError(w, http.StatusBadRequest, errOIDCBinding)
+		return
+	}
+	if linkUserID != nil {
+		if userID, ok := getUserID(ctx); !ok || userID != *linkUserID {
+			writeError(w, http.StatusForbidden, "連携を開始したアカウントでログインした状態でお試しください")
+			return
+		}
+	}
+
+	idToken, err := provider.Exchange(ctx, payload.Code, verifier)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errOIDCAuthentication)
+		return
+	}
+	identity, err := provider.VerifyIDToken(ctx, idToken, nonce)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errOIDCAuthentication)
+		return
+	}
+
+	if linkUserID != nil {
+		s.linkIdentity(w, r, *linkUserID, provider.Name(), identity)
+		return
+	}
+
+	user, created, err := s.findOrCreateOIDCUser(ctx, provider.Name(), identity)
+	if err != nil {
+		switch {
+		case errors.Is(err, errIdentityEmailMissing):
+			writeError(w, http.StatusBadRequest, "IDプロバイダからメールアドレスを取得できませんでした")
+		case errors.Is(err, errIdentityEmailConflict):
+			writeError(w, http.StatusConflict, "このメールアドレスは既に登録されています。ログイン後にアカウント設定から連携してください")
+		case errors.Is(err, errAccountDeleting):
+			writeError(w, http.StatusForbidden, "このアカウントは削除手続き中です。復元する場合はアカウントの復元を行ってください")
+		default:
+			writeError(w, http.StatusInternalServerError, errOIDCAuthentication)
+		}
+		return
+	}
+	if created && user.EmailVerifiedAt == nil {
+		s.sendVerificationMail(ctx, user)
+	}
+
+	s.completeLogin(w, r, user)
+}
+
+// oidcBindingCookie はバインド用 Cookie を返す。フロントエンドと API は同一サイトの別オリジンで動く前提のため SameSite=Lax とし、
+// 認証 Cookie の設定(AUTH_COOKIE_*)とは切り離して、HTTPS で受けたリクエストの場合のみ Secure にする。
+func (s *Server) oidcBindingCookie(r *http.Request, value string, ttl time.Duration) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     oidcBindingCookieName,
+		Value:    value,
+		Path:     oidcBindingCookiePath,
+		HttpOnly: true,
+		Secure:   s.isHTTPS(r),
+		SameSite: http.SameSiteLaxMode,
+	}
+	if ttl < 0 {
+		cookie.MaxAge = -1
+	} else {
+		cookie.MaxAge = int(ttl / time.Second)
+	}
+	return cookie
+}
+
+// isHTTPS はリクエストが HTTPS で届いたかを返す。TRUST_PROXY が有効な場合のみ X-Forwarded-Proto を信頼する。
+func (s *Server) isHTTPS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	return s.cfg.TrustProxy && strings.EqualFold(strings.TrimSpace(r.Header.Get("X-Forwarded-Proto")), "https")
+}
+
+// findOrCreateOIDCUser は外部IDに紐づくユーザーを返す。未連携の場合、メールアドレスが
+// IDプロバイダとこのサービスの両方で確認済みであれば既存ユーザーに連携し、該当がなければ新規作成する。
+func (s *Server) findOrCreateOIDCUser(ctx context.Context, provider string, identity oidc.Identity) (model.User, bool, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return model.User{}, false, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	var deleteAfter pgtype.Timestamptz
+	user, err := scanUser(tx.QueryRow(ctx, `
+		SELECT `+userColumns+`, delete_after
+		FROM users
+		WHERE id = (SELECT user_id FROM user_identities WHERE provider = $1 AND subject = $2)
+	`, provider, identity.Subject), &deleteAfter)
+	if err == nil {
+		if deleteAfter.Valid {
+			return model.User{}, false, errAccountDeleting
+		}
+		return user, false, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return model.User{}, false, err
+	}
+
+	email := strings.TrimSpace(identity.Email)
+	if email == "" {
+		return model.User{}, false, errIdentityEmailMissing
+	}
+
+	created := false
+	user, err = scanUser(tx.QueryRow(ctx, `
+		SELECT `+userColumns+`, delete_after
+		FROM users
+		WHERE email = $1
+		FOR UPDATE
+	`, email), &deleteAfter)
+	switch {
+	case err == nil:
+		if deleteAfter.Valid {
+			return model.User{}, false, errAccountDeleting
+		}
+		// 未確認のメールアドレスで先に登録された第三者のアカウントに連携しないよう、双方の確認を条件にする
+		if !identity.EmailVerified || user.EmailVerifiedAt == nil {
+			return model.User{}, false, errIdentityEmailConflict
+		}
+	case errors.Is(err, pgx.ErrNoRows):
+		user, err = scanUser(tx.QueryRow(ctx, `
+			INSERT INTO users (email, display_name, email_verified_at)
+			VALUES ($1, $2, CASE WHEN $3::boolean THEN NOW() END)
+			RETURNING `+userColumns+`
+		`, email, identityDisplayName(identity), identity.EmailVerified))
+		if err != nil {
+			var pgErr *pgconn.PgError
+			if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+				return model.User{}, false, errIdentityEmailConflict
+			}
+			return model.User{}, false, err
+		}
+		created = true
+	default:
+		return model.User{}, false, err
+	}
+
+	if _, err := tx.Exec(ctx, `
+		INSERT INTO user_identities (user_id, provider, subject, email)
+		VALUES ($1, $2, $3, NULLIF($4, ''))
+	`, user.ID, provider, identity.Subject, email); err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return model.User{}, false, errIdentityEmailConflict
+		}
+		return model.User{}, false, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return model.User{}, false, err
+	}
+	return user, created, nil
+}
+
+func (s *Server) linkIdentity(w http.ResponseWriter, r *http.Request, userID, provider string, identity oidc.Identity) {
+	if _, err := s.db.Exec(r.Context(), `
+		INSERT INTO user_identities (user_id, provider, subject, email)
+		VALUES ($1, $2, $3, NULLIF($4, ''))
+	`, userID, provider, identity.Subject, strings.TrimSpace(identity.Email)); err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			writeError(w, http.StatusConflict, "このIDプロバイダのアカウントは既に連携されています")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "アカウントの連携に失敗しました")
+		return
+	}
+
+	writeData(w, http.StatusOK, map[string]string{"message": "アカウントを連携しました"})
+}
+
+func (s *Server) handleListIdentities(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserID(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "認証トークンが無効です")
+		return
+	}
+
+	rows, err := s.db.Query(r.Context(), `
+		SELECT provider, email, created_at
+		FROM user_identities
+		WHERE user_id = $1
+		ORDER BY created_at
+	`, userID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "連携アカウントの取得に失敗しました")
+		return
+	}
+	defer rows.Close()
+
+	identities := make([]model.UserIdentity, 0)
+	for rows.Next() {
+		var identity model.UserIdentity
+		if err := rows.Scan(&identity.Provider, &identity.Email, &identity.CreatedAt); err != nil {
+			writeError(w, http.StatusInternalServerError, "連携アカウントの取得に失敗しました")
+			return
+		}
+		identities = append(identities, identity)
+	}
+	if err := rows.Err(); err != nil {
+		writeError(w, http.StatusInternalServerError, "連携アカウントの取得に失敗しました")
+		return
+	}
+
+	writeData(w, http.StatusOK, identities)
+}
+
+// handleUnlinkIdentity は連携を解除する。パスワード未設定のアカウントでは最後のログイン手段は解除できない。
+func (s *Server) handleUnlinkIdentity(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserID(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "認証トークンが無効です")
+		return
+	}
+	provider := chi.URLParam(r, "provider")
+
+	ctx := r.Context()
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "連携の解除に失敗しました")
+		return
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	var hasPassword bool
+	var identityCount int
+	err = tx.QueryRow(ctx, `
+		SELECT password_hash IS NOT NULL,
+			(SELECT COUNT(*) FROM user_identities WHERE user_id = users.id)
+		FROM users
+		WHERE id = $1
+		FOR UPDATE
+	`, userID).Scan(&hasPassword, &identityCount)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeError(w, http.StatusUnauthorized, "認証トークンが無効です")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "連携の解除に失敗しました")
+		return
+	}
+
+	cmd, err := tx.Exec(ctx, `
+		DELETE FROM user_identities WHERE user_id = $1 AND provider = $2
+	`, userID, provider)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "連携の解除に失敗しました")
+		return
+	}
+	if cmd.RowsAffected() == 0 {
+		writeError(w, http.StatusNotFound, "連携アカウントが見つかりません")
+		return
+	}
+	if !hasPassword && identityCount <= 1 {
+		writeError(w, http.StatusBadRequest, "パスワードが未設定のため、最後のログイン方法は解除できません")
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, "連携の解除に失敗しました")
+		return
+	}
+
+	writeData(w, http.StatusOK, map[string]string{"message": "連携を解除しました"})
+}
+
+func (s *Server) purgeOIDCLoginStates(ctx context.Context) error {
+	_, err := s.db.Exec(ctx, `DELETE FROM oidc_login_states WHERE expires_at < NOW()`)
+	return err
+}
+
+// identityDisplayName は name クレームがなければメールアドレスのローカル部を表示名にする。
+func identityDisplayName(identity oidc.Identity) string {
+	name := strings.TrimSpace(identity.Name)
+	if name == "" {
+		name, _, _ = strings.Cut(strings.TrimSpace(identity.Email), "@")
+	}
+	if name == "" {
+		name = "ユーザー"
+	}
+	if utf8.RuneCountInString(name) > maxDisplayNameRunes {
+		name = string([]rune(name)[:maxDisplayNameRunes])
+	}
+	return name
+}
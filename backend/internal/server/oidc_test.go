@@ -0,0 +1,129 @@
+package server
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/ymmtyamaterous/diary-oc-api/internal/config"
+	"github.com/ymmtyamaterous/diary-oc-api/internal/oidc"
+)
+
+func TestIdentityDisplayName(t *testing.T) {
+	tests := []struct {
+		name     string
+		identity oidc.Identity
+		want     string
+	}{
+		{name: "name claim", identity: oidc.Identity{Name: " 山田 太郎 ", Email: "taro@example.com"}, want: "山田 太郎"},
+		{name: "email local part", identity: oidc.Identity{Email: "taro@example.com"}, want: "taro"},
+		{name: "fallback", identity: oidc.Identity{}, want: "ユーザー"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := identityDisplayName(tt.identity); got != tt.want {
+				t.Fatalf("identityDisplayName() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	long := identityDisplayName(oidc.Identity{Name: strings.Repeat("あ", maxDisplayNameRunes+10)})
+	if utf8.RuneCountInString(long) != maxDisplayNameRunes {
+		t.Fatalf("long name should be truncated to %d runes, got %d", maxDisplayNameRunes, utf8.RuneCountInString(long))
+	}
+}
+
+func TestOIDCCallbackRequiresBindingCookie(t *testing.T) {
+	s := New(config.Config{OIDCProviders: []config.OIDCProvider{{Name: "google", Issuer: "https://accounts.example.com", ClientID: "client"}}}, nil, nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/auth/oidc/google/callback", strings.NewReader(`{"code":"code","state":"state"}`))
+	rec := httptest.NewRecorder()
+	s.Router().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	if !strings.Contains(rec.Body.String(), errOIDCBinding) {
+		t.Fatalf("body = %s, want binding error", rec.Body.String())
+	}
+}
+
+// 既定の設定(AUTH_COOKIE_ENABLED=false, AUTH_COOKIE_SECURE=true)でも、:3000 のフロントエンドから
+// :8000 の API へ開始→コールバックの間バインド用 Cookie を受け渡せることを確認する。
+func TestOIDCBindingCookieAcrossOrigins(t *testing.T) {
+	cfg := config.Load()
+	cfg.AllowedOrigins = []string{"http://localhost:3000"}
+	cfg.AuthCookieEnabled = false
+	cfg.AuthCookieSecure = true
+	cfg.AuthCookieSameSite = "strict"
+	cfg.OIDCProviders = []config.OIDCProvider{{Name: "google", Issuer: "https://accounts.example.com", ClientID: "client"}}
+	s := New(cfg, nil, nil)
+	router := s.Router()
+
+	const origin = "http://localhost:3000"
+	for _, path := range []string{"/api/auth/oidc/google/start", "/api/auth/oidc/google/callback"} {
+		preflight := httptest.NewRequest(http.MethodOptions, "http://localhost:8000"+path, nil)
+		preflight.Header.Set("Origin", origin)
+		preflight.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		preflight.Header.Set("Access-Control-Request-Headers", "Content-Type")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, preflight)
+		if got := rec.Header().Get("Access-Control-Allow-Credentials"); got != "true" {
+			t.Fatalf("%s: Access-Control-Allow-Credentials = %q, want true", path, got)
+		}
+		if got := rec.Header().Get("Access-Control-Allow-Origin"); got != origin {
+			t.Fatalf("%s: Access-Control-Allow-Origin = %q, want %q", path, got, origin)
+		}
+	}
+
+	other := httptest.NewRequest(http.MethodOptions, "http://localhost:8000/api/auth/login", nil)
+	other.Header.Set("Origin", origin)
+	other.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, other)
+	if got := rec.Header().Get("Access-Control-Allow-Credentials"); got != "" {
+		t.Fatalf("non-OIDC route should not allow credentials, got %q", got)
+	}
+
+	// 開始時に設定される Cookie を http://localhost:8000 のブラウザが保存し、コールバックで送り返すか
+	start := httptest.NewRequest(http.MethodPost, "http://localhost:8000/api/auth/oidc/google/start", nil)
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jar.SetCookies(start.URL, []*http.Cookie{s.oidcBindingCookie(start, "binding", oidcStateTTL)})
+	callbackURL, _ := url.Parse("http://localhost:8000/api/auth/oidc/google/callback")
+	cookies := jar.Cookies(callbackURL)
+	if len(cookies) != 1 || cookies[0].Name != oidcBindingCookieName || cookies[0].Value != "binding" {
+		t.Fatalf("binding cookie should be sent back to the callback over http, got %v", cookies)
+	}
+
+	callback := httptest.NewRequest(http.MethodPost, callbackURL.String(), strings.NewReader(`{}`))
+	callback.Header.Set("Origin", origin)
+	callback.AddCookie(cookies[0])
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, callback)
+	if got := rec.Header().Get("Access-Control-Allow-Credentials"); got != "true" {
+		t.Fatalf("callback response should allow credentials, got %q", got)
+	}
+}
+
+func TestOIDCBindingCookieSecureOnHTTPS(t *testing.T) {
+	s := New(config.Config{TrustProxy: true}, nil, nil)
+
+	plain := httptest.NewRequest(http.MethodPost, "http://localhost:8000/api/auth/oidc/google/start", nil)
+	if cookie := s.oidcBindingCookie(plain, "binding", oidcStateTTL); cookie.Secure || cookie.SameSite != http.SameSiteLaxMode || !cookie.HttpOnly {
+		t.Fatalf("cookie over http = %+v, want HttpOnly, SameSite=Lax and not Secure", cookie)
+	}
+
+	proxied := httptest.NewRequest(http.MethodPost, "http://api.internal/api/auth/oidc/google/start", nil)
+	proxied.Header.Set("X-Forwarded-Proto", "https")
+	if cookie := s.oidcBindingCookie(proxied, "binding", oidcStateTTL); !cookie.Secure {
+		t.Fatal("cookie behind an HTTPS proxy should be Secure")
+	}
+}
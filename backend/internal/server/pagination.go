@@ -0,0 +1,233 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/ymmtyamaterous/diary-oc-api/internal/validation"
+)
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 100
+)
+
+// diaryCursor は一覧の最後の日記を指す。並び順に使う列だけを持ち、クライアントには不透明な文字列として渡す。
+// Date は日付順の一覧でのみ使い、作成日時順の一覧では空になる。
+type diaryCursor struct {
+	Date      string    `json:"d,omitempty"`
+	CreatedAt time.Time `json:"c"`
+	ID        string    `json:"i"`
+}
+
+func encodeCursor(cursor diaryCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(raw string) (diaryCursor, error) {
+	var cursor diaryCursor
+	data, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return cursor, err
+	}
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return cursor, err
+	}
+	if _, err := uuid.Parse(cursor.ID); err != nil {
+		return cursor, err
+	}
+	if cursor.Date != "" {
+		if _, err := time.Parse("2006-01-02", cursor.Date); err != nil {
+			return cursor, err
+		}
+	}
+	return cursor, nil
+}
+
+// writePage は一覧の1ページを返す。次のページがない場合 next_cursor は null になる。
+func writePage(w http.ResponseWriter, data any, nextCursor string) {
+	var cursor *string
+	if nextCursor != "" {
+		cursor = &nextCursor
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(map[string]any{"data": data, "next_cursor": cursor})
+}
+
+// diaryFilter は日記一覧のクエリパラメータ。
+type diaryFilter struct {
+	From     string
+	To       string
+	Weather  string
+	HasImage *bool
+	HasAudio *bool
+	IsPublic *bool
+	// Tags を指定すると、すべてのタグが付いた日記に絞り込む。
+	Tags   []string
+	Cursor *diaryCursor
+	Limit  int
+}
+
+// parseDiaryFilter は from / to / weather / has_image / has_audio / visibility / tag / cursor / limit を読み取る。
+// tag は繰り返し指定できる。
+func parseDiaryFilter(query url.Values) (diaryFilter, error) {
+	filter := diaryFilter{Limit: defaultPageLimit}
+
+	for _, field := range []struct {
+		name   string
+		target *string
+	}{{"from", &filter.From}, {"to", &filter.To}} {
+		value := strings.TrimSpace(query.Get(field.name))
+		if value == "" {
+			continue
+		}
+		if _, err := time.Parse("2006-01-02", value); err != nil {
+			return filter, errors.New("日付形式が不正です")
+		}
+		*field.target = value
+	}
+	if filter.From != "" && filter.To != "" && filter.From > filter.To {
+		return filter, errors.New("開始日は終了日以前にしてください")
+	}
+
+	if weather := strings.TrimSpace(query.Get("weather")); weather != "" {
+		if err := validation.ValidateWeather(&weather); err != nil {
+			return filter, err
+		}
+		filter.Weather = weather
+	}
+
+	for _, field := range []struct {
+		name   string
+		target **bool
+	}{{"has_image", &filter.HasImage}, {"has_audio", &filter.HasAudio}} {
+		value := strings.TrimSpace(query.Get(field.name))
+		if value == "" {
+			continue
+		}
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return filter, fmt.Errorf("%s は true または false で指定してください", field.name)
+		}
+		*field.target = &parsed
+	}
+
+	switch query.Get("visibility") {
+	case "":
+	case "public":
+		isPublic := true
+		filter.IsPublic = &isPublic
+	case "private":
+		isPublic := false
+		filter.IsPublic = &isPublic
+	default:
+		return filter, errors.New("visibility は public または private で指定してください")
+	}
+
+	tags, err := validation.NormalizeTags(query["tag"])
+	if err != nil {
+		return filter, err
+	}
+	if len(tags) > 0 {
+		filter.Tags = tags
+	}
+
+	if raw := strings.TrimSpace(query.Get("cursor")); raw != "" {
+		cursor, err := decodeCursor(raw)
+		if err != nil {
+			return filter, errors.New("カーソルが不正です")
+		}
+		filter.Cursor = &cursor
+	}
+
+	if raw := strings.TrimSpace(query.Get("limit")); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > maxPageLimit {
+			return filter, fmt.Errorf("limit は1〜%dで指定してください", maxPageLimit)
+		}
+		filter.Limit = limit
+	}
+	return filter, nil
+}
+
+// queryBuilder は WHERE 句の条件とプレースホルダの引数を組み立てる。
+type queryBuilder struct {
+	conditions []string
+	args       []any
+}
+
+// arg は引数を追加し、対応するプレースホルダ($n)を返す。
+func (q *queryBuilder) arg(value any) string {
+	q.args = append(q.args, value)
+	return fmt.Sprintf("$%d", len(q.args))
+}
+
+func (q *queryBuilder) where(condition string) {
+	q.conditions = append(q.conditions, condition)
+}
+
+func (q *queryBuilder) whereClause() string {
+	if len(q.conditions) == 0 {
+		return "TRUE"
+	}
+	return strings.Join(q.conditions, " AND ")
+}
+
+// applyDiaryFilter はカーソル以外の絞り込み条件を追加する。alias は diary_entries の別名(不要なら空)。
+func (q *queryBuilder) applyDiaryFilter(filter diaryFilter, alias string) {
+	column := func(name string) string {
+		if alias == "" {
+			return name
+		}
+		return alias + "." + name
+	}
+
+	if filter.From != "" {
+		q.where(column("date") + " >= " + q.arg(filter.From) + "::date")
+	}
+	if filter.To != "" {
+		q.where(column("date") + " <= " + q.arg(filter.To) + "::date")
+	}
+	if filter.Weather != "" {
+		q.where(column("weather") + " = " + q.arg(filter.Weather))
+	}
+	if filter.HasImage != nil {
+		q.where(nullCondition(column("image_url"), *filter.HasImage))
+	}
+	if filter.HasAudio != nil {
+		q.where(nullCondition(column("audio_url"), *filter.HasAudio))
+	}
+	if filter.IsPublic != nil {
+		q.where(column("is_public") + " = " + q.arg(*filter.IsPublic))
+	}
+	table := alias
+	if table == "" {
+		table = "diary_entries"
+	}
+	for _, tag := range filter.Tags {
+		q.where(fmt.Sprintf(`EXISTS (
+			SELECT 1
+			FROM diary_entry_tags dt
+			JOIN tags t ON t.id = dt.tag_id
+			WHERE dt.diary_entry_id = %s.id AND lower(t.name) = %s
+		)`, table, q.arg(strings.ToLower(tag))))
+	}
+}
+
+func nullCondition(column string, present bool) string {
+	if present {
+		return column + " IS NOT NULL"
+	}
+	return column + " IS NULL"
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	want := diaryCursor{
+		Date:      "2026-10-01",
+		CreatedAt: time.Date(2026, 10, 1, 21, 30, 0, 123456000, time.UTC),
+		ID:        "8b6d3f0e-4a51-4a8f-9d8e-3c0f5f0b6a11",
+	}
+	got, err := decodeCursor(encodeCursor(want))
+	if err != nil {
+		t.Fatalf("decodeCursor() error = %v", err)
+	}
+	if !got.CreatedAt.Equal(want.CreatedAt) || got.Date != want.Date || got.ID != want.ID {
+		t.Fatalf("decodeCursor() = %+v, want %+v", got, want)
+	}
+
+	for _, raw := range []string{"!!", "e30", encodeCursor(diaryCursor{ID: "not-a-uuid"})} {
+		if _, err := decodeCursor(raw); err == nil {
+			t.Fatalf("decodeCursor(%q) should fail", raw)
+		}
+	}
+}
+
+func TestParseDiaryFilter(t *testing.T) {
+	filter, err := parseDiaryFilter(url.Values{
+		"from":       {"2026-01-01"},
+		"to":         {"2026-01-31"},
+		"weather":    {"sunny"},
+		"has_image":  {"true"},
+		"has_audio":  {"false"},
+		"visibility": {"private"},
+		"limit":      {"20"},
+	})
+	if err != nil {
+		t.Fatalf("parseDiaryFilter() error = %v", err)
+	}
+
+	var q queryBuilder
+	q.applyDiaryFilter(filter, "de")
+	wantClause := "de.date >= $1::date AND de.date <= $2::date AND de.weather = $3 AND " +
+		"de.image_url IS NOT NULL AND de.audio_url IS NULL AND de.is_public = $4"
+	if got := q.whereClause(); got != wantClause {
+		t.Fatalf("whereClause() = %q, want %q", got, wantClause)
+	}
+	if want := []any{"2026-01-01", "2026-01-31", "sunny", false}; !reflect.DeepEqual(q.args, want) {
+		t.Fatalf("args = %v, want %v", q.args, want)
+	}
+	if filter.Limit != 20 {
+		t.Fatalf("Limit = %d, want 20", filter.Limit)
+	}
+
+	defaults, err := parseDiaryFilter(url.Values{})
+	if err != nil || defaults.Limit != defaultPageLimit {
+		t.Fatalf("default filter = %+v, %v", defaults, err)
+	}
+	var empty queryBuilder
+	empty.applyDiaryFilter(defaults, "")
+	if got := empty.whereClause(); got != "TRUE" {
+		t.Fatalf("whereClause() = %q, want TRUE", got)
+	}
+}
+
+func TestParseDiaryFilterRejectsInvalidValues(t *testing.T) {
+	for _, query := range []url.Values{
+		{"from": {"2026/01/01"}},
+		{"from": {"2026-02-01"}, "to": {"2026-01-01"}},
+		{"weather": {"typhoon"}},
+		{"has_image": {"maybe"}},
+		{"visibility": {"friends"}},
+		{"cursor": {"broken"}},
+		{"limit": {"0"}},
+		{"limit": {"101"}},
+		{"tag": {strings.Repeat("あ", 51)}},
+	} {
+		if _, err := parseDiaryFilter(query); err == nil {
+			t.Fatalf("parseDiaryFilter(%v) should fail", query)
+		}
+	}
+}
+
+func TestParseDiaryFilterTags(t *testing.T) {
+	filter, err := parseDiaryFilter(url.Values{"tag": {"旅行", " Work ", "work", ""}})
+	if err != nil {
+		t.Fatalf("parseDiaryFilter() error = %v", err)
+	}
+	if want := []string{"旅行", "Work"}; !reflect.DeepEqual(filter.Tags, want) {
+		t.Fatalf("Tags = %v, want %v", filter.Tags, want)
+	}
+
+	var q queryBuilder
+	q.applyDiaryFilter(filter, "")
+	clause := q.whereClause()
+	if strings.Count(clause, "EXISTS") != 2 || !strings.Contains(clause, "dt.diary_entry_id = diary_entries.id") {
+		t.Fatalf("whereClause() = %q", clause)
+	}
+	if want := []any{"旅行", "work"}; !reflect.DeepEqual(q.args, want) {
+		t.Fatalf("args = %v, want %v", q.args, want)
+	}
+}
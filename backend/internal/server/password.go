@@ -0,0 +1,319 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/ymmtyamaterous/diary-oc-api/internal/auth"
+	"github.com/ymmtyamaterous/diary-oc-api/internal/mail"
+	"github.com/ymmtyamaterous/diary-oc-api/internal/model"
+	"github.com/ymmtyamaterous/diary-oc-api/internal/validation"
+)
+
+type forgotPasswordPayload struct {
+	Email string `json:"email"`
+}
+
+type resetPasswordPayload struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+type changePasswordPayload struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// handleForgotPassword は再設定メールを送信する。アカウントの有無を推測されないよう、
+// 登録されていないメールアドレスでも同じレスポンスを返す。
+func (s *Server) handleForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var payload forgotPasswordPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeError(w, http.StatusBadRequest, "不正なリクエストです")
+		return
+	}
+	if err := validation.RequireEmail(payload.Email); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	const message = "パスワード再設定用のメールを送信しました"
+
+	// 受信箱への大量送信を防ぐため、メールアドレス単位・接続元IP単位で受付回数を制限する
+	throttle := s.newLoginThrottle(r, payload.Email)
+	retryAfter, err := s.passwordResetRetryAfter(r.Context(), throttle)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "パスワード再設定の受付に失敗しました")
+		return
+	}
+	if retryAfter > 0 {
+		writeTooManyAttempts(w, retryAfter)
+		return
+	}
+	if err := s.recordPasswordResetRequest(r.Context(), throttle); err != nil {
+		writeError(w, http.StatusInternalServerError, "パスワード再設定の受付に失敗しました")
+		return
+	}
+
+	var userID, email string
+	err = s.db.QueryRow(r.Context(), `
+		SELECT id, email
+		FROM users
+		WHERE email = $1
+	`, strings.TrimSpace(payload.Email)).Scan(&userID, &email)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeData(w, http.StatusOK, map[string]string{"message": message})
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "パスワード再設定の受付に失敗しました")
+		return
+	}
+
+	// トークンの発行とメール送信は応答後に行い、応答時間の差からアカウントの有無を推測されないようにする
+	go s.sendPasswordResetMail(context.WithoutCancel(r.Context()), userID, email)
+
+	writeData(w, http.StatusOK, map[string]string{"message": message})
+}
+
+// passwordResetMailTimeout は handleForgotPassword の応答後に行う再設定メール送信の制限時間。
+const passwordResetMailTimeout = 30 * time.Second
+
+// sendPasswordResetMail は再設定トークンを発行してメールで送る。応答後に実行されるため、失敗はログに残すだけにする。
+func (s *Server) sendPasswordResetMail(ctx context.Context, userID, email string) {
+	ctx, cancel := context.WithTimeout(ctx, passwordResetMailTimeout)
+	defer cancel()
+
+	rawToken, tokenHash, err := auth.GenerateOpaqueToken()
+	if err != nil {
+		log.Printf("password reset token failed: user=%s err=%v", userID, err)
+		return
+	}
+
+	// 未使用の古いトークンは無効化し、最新のメールのリンクだけを有効にする。
+	if _, err := s.db.Exec(ctx, `
+		WITH expired AS (
+			UPDATE password_reset_tokens SET used_at = NOW()
+			WHERE user_id = $1 AND used_at IS NULL
+		)
+		INSERT INTO password_reset_tokens (user_id, token_hash, expires_at)
+		VALUES ($1, $2, $3)
+	`, userID, tokenHash, time.Now().Add(time.Duration(s.cfg.PasswordResetMinutes)*time.Minute)); err != nil {
+		log.Printf("password reset token failed: user=%s err=%v", userID, err)
+		return
+	}
+
+	resetURL := s.cfg.AppBaseURL + "/password/reset?token=" + url.QueryEscape(rawToken)
+	if err := s.mailer.Send(ctx, mail.Message{
+		To:      email,
+		Subject: "【Diary Open Close】パスワード再設定のご案内",
+		Body: fmt.Sprintf(
+			"パスワード再設定のリクエストを受け付けました。\n\n以下のURLから%d分以内に新しいパスワードを設定してください。\n%s\n\nお心当たりがない場合はこのメールを破棄してください。\n",
+			s.cfg.PasswordResetMinutes,
+			resetURL,
+		),
+	}); err != nil {
+		log.Printf("password reset mail failed: user=%s err=%v", userID, err)
+	}
+}
+
+func (s *Server) handleResetPassword(w http.ResponseWriter, r *http.Request) {
+	var payload resetPasswordPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeError(w, http.StatusBadRequest, "不正なリクエストです")
+		return
+	}
+	if strings.TrimSpace(payload.Token) == "" {
+		writeError(w, http.StatusBadRequest, "再設定トークンは必須です")
+		return
+	}
+
+	ctx := r.Context()
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "パスワード再設定に失敗しました")
+		return
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	var tokenID, userID, email, displayName string
+	err = tx.QueryRow(ctx, `
+		SELECT t.id, t.user_id, u.email, u.display_name
+		FROM password_reset_tokens t
+		JOIN users u ON u.id = t.user_id
+		WHERE t.token_hash = $1 AND t.used_at IS NULL AND t.expires_at > NOW()
+		FOR UPDATE OF t
+	`, auth.HashOpaqueToken(strings.TrimSpace(payload.Token))).Scan(&tokenID, &userID, &email, &displayName)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeError(w, http.StatusBadRequest, "再設定トークンが無効か、有効期限が切れています")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "パスワード再設定に失敗しました")
+		return
+	}
+	if err := s.passwordRules.Check(payload.Password, email, displayName); err != nil {
+		writePasswordError(w, err)
+		return
+	}
+
+	hash, err := s.passwords.Hash(payload.Password)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "パスワード処理に失敗しました")
+		return
+	}
+	if _, err := tx.Exec(ctx, `
+		UPDATE users SET password_hash = $1, updated_at = NOW()
+		WHERE id = $2
+	`, hash, userID); err != nil {
+		writeError(w, http.StatusInternalServerError, "パスワード再設定に失敗しました")
+		return
+	}
+	if _, err := tx.Exec(ctx, `UPDATE password_reset_tokens SET used_at = NOW() WHERE id = $1`, tokenID); err != nil {
+		writeError(w, http.StatusInternalServerError, "パスワード再設定に失敗しました")
+		return
+	}
+	if _, err := s.revokeUserSessions(ctx, tx, userID, ""); err != nil {
+		writeError(w, http.StatusInternalServerError, "パスワード再設定に失敗しました")
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, "パスワード再設定に失敗しました")
+		return
+	}
+
+	writeData(w, http.StatusOK, map[string]string{"message": "パスワードを再設定しました。再度ログインしてください"})
+}
+
+// handleChangePassword はログイン中のユーザーのパスワードを変更し、現在の端末以外のセッションを無効化する。
+func (s *Server) handleChangePassword(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserID(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "認証トークンが無効です")
+		return
+	}
+	sessionID, _ := getSessionID(r.Context())
+
+	var payload changePasswordPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeError(w, http.StatusBadRequest, "不正なリクエストです")
+		return
+	}
+
+	ctx := r.Context()
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "パスワード変更に失敗しました")
+		return
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	var currentHash, email, displayName string
+	err = tx.QueryRow(ctx, `
+		SELECT COALESCE(password_hash, ''), email, display_name
+		FROM users
+		WHERE id = $1
+		FOR UPDATE
+	`, userID).Scan(&currentHash, &email, &displayName)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeError(w, http.StatusUnauthorized, "認証トークンが無効です")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "パスワード変更に失敗しました")
+		return
+	}
+	if currentHash == "" {
+		writeError(w, http.StatusBadRequest, "パスワードが設定されていません。パスワード再設定から設定してください")
+		return
+	}
+	owner := model.User{ID: userID, Email: email, DisplayName: displayName}
+	throttle, ok := s.checkReauthThrottle(w, r, owner)
+	if !ok {
+		return
+	}
+	if _, err := s.passwords.Verify(currentHash, payload.CurrentPassword); err != nil {
+		s.rejectReauth(w, r, throttle, owner, "現在のパスワードが正しくありません")
+		return
+	}
+	if err := s.passwordRules.Check(payload.NewPassword, email, displayName); err != nil {
+		writePasswordError(w, err)
+		return
+	}
+
+	hash, err := s.passwords.Hash(payload.NewPassword)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "パスワード処理に失敗しました")
+		return
+	}
+	if _, err := tx.Exec(ctx, `
+		UPDATE users SET password_hash = $1, updated_at = NOW()
+		WHERE id = $2
+	`, hash, userID); err != nil {
+		writeError(w, http.StatusInternalServerError, "パスワード変更に失敗しました")
+		return
+	}
+	if _, err := s.revokeUserSessions(ctx, tx, userID, sessionID); err != nil {
+		writeError(w, http.StatusInternalServerError, "パスワード変更に失敗しました")
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, "パスワード変更に失敗しました")
+		return
+	}
+
+	writeData(w, http.StatusOK, map[string]string{"message": "パスワードを変更しました"})
+}
+
+// rehashPassword はログイン成功時、古い設定で作られたハッシュを現在の設定で置き換える。
+// 失敗してもログインは継続し、次回のログインで再試行する。同時にパスワードが変更された場合は上書きしない。
+func (s *Server) rehashPassword(ctx context.Context, userID, oldHash, password string) {
+	hash, err := s.passwords.Hash(password)
+	if err == nil {
+		_, err = s.db.Exec(ctx, `
+			UPDATE users
+			SET password_hash = $1, updated_at = NOW()
+			WHERE id = $2 AND password_hash = $3
+		`, hash, userID, oldHash)
+	}
+	if err != nil {
+		log.Printf("password rehash failed: user=%s err=%v", userID, err)
+	}
+}
+
+// LoadBreachedPasswords は PASSWORD_BREACHED_LIST_FILE の一覧を読み込み、以降のパスワード設定で拒否する。
+func (s *Server) LoadBreachedPasswords(path string) error {
+	if path == "" {
+		return nil
+	}
+	list, err := validation.LoadPasswordList(path)
+	if err != nil {
+		return err
+	}
+	s.passwordRules.Breached = list
+	return nil
+}
+
+// writePasswordError はパスワード要件の違反を返す。error には先頭の理由、reasons にすべての理由を入れる。
+func writePasswordError(w http.ResponseWriter, err error) {
+	var policyErr *validation.PasswordError
+	if !errors.As(err, &policyErr) {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"error":   policyErr.Error(),
+		"reasons": policyErr.Violations,
+	})
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ymmtyamaterous/diary-oc-api/internal/config"
+	"github.com/ymmtyamaterous/diary-oc-api/internal/validation"
+)
+
+func TestRegisterRejectsWeakPassword(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	if err := os.WriteFile(path, []byte("iloveyou\n"), 0o600); err != nil {
+		t.Fatalf("write list: %v", err)
+	}
+	s := New(config.Config{PasswordMinLength: 8, PasswordMaxBytes: 72}, nil, nil)
+	if err := s.LoadBreachedPasswords(path); err != nil {
+		t.Fatalf("LoadBreachedPasswords() error = %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		password string
+		want     string
+	}{
+		{name: "breached", password: "ILoveYou", want: validation.PasswordBreached},
+		{name: "display name", password: "hanako-diary", want: validation.PasswordContainsPersonal},
+		{name: "too short", password: "日記", want: validation.PasswordTooShort},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := `{"email":"user@example.com","password":"` + tt.password + `","display_name":"Hanako"}`
+			rec := httptest.NewRecorder()
+			s.Router().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/auth/register", strings.NewReader(body)))
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+			}
+
+			var response struct {
+				Error   string                         `json:"error"`
+				Reasons []validation.PasswordViolation `json:"reasons"`
+			}
+			if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if response.Error == "" || len(response.Reasons) != 1 || response.Reasons[0].Code != tt.want {
+				t.Fatalf("unexpected response: %+v", response)
+			}
+		})
+	}
+}
@@ -0,0 +1,238 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+
+	"github.com/ymmtyamaterous/diary-oc-api/internal/model"
+	"github.com/ymmtyamaterous/diary-oc-api/internal/validation"
+)
+
+const (
+	avatarSize         = 256
+	avatarMaxPixels    = 40_000_000
+	avatarURLPrefix    = "/api/files/avatars/"
+	avatarUploadPrefix = "avatar"
+)
+
+type profilePayload struct {
+	DisplayName *string `json:"display_name"`
+}
+
+func (s *Server) handleUpdateProfile(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserID(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "認証トークンが無効です")
+		return
+	}
+
+	var payload profilePayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeError(w, http.StatusBadRequest, "不正なリクエストです")
+		return
+	}
+	if payload.DisplayName == nil {
+		writeError(w, http.StatusBadRequest, "更新する項目がありません")
+		return
+	}
+	if err := validation.RequireDisplayName(*payload.DisplayName); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	user, err := scanUser(s.db.QueryRow(r.Context(), `
+		UPDATE users
+		SET display_name = $1, updated_at = NOW()
+		WHERE id = $2
+		RETURNING `+userColumns+`
+	`, strings.TrimSpace(*payload.DisplayName), userID))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeError(w, http.StatusUnauthorized, "認証トークンが無効です")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "プロフィールの更新に失敗しました")
+		return
+	}
+
+	writeData(w, http.StatusOK, user)
+}
+
+func (s *Server) handleUploadAvatar(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserID(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "認証トークンが無効です")
+		return
+	}
+
+	file, header, err := r.FormFile("avatar")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "画像ファイルが必要です")
+		return
+	}
+	defer file.Close()
+
+	if header.Size > 5*1024*1024 {
+		writeError(w, http.StatusBadRequest, "画像サイズは5MB以下にしてください")
+		return
+	}
+
+	avatarDir := filepath.Join(s.cfg.UploadDir, "avatars")
+	if err := ensureDir(avatarDir); err != nil {
+		writeError(w, http.StatusInternalServerError, "アップロード先ディレクトリ作成に失敗しました")
+		return
+	}
+
+	_, rawPath, err := saveUpload(file, header, avatarDir, avatarUploadPrefix+"-raw", true)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	name, err := writeSquareAvatar(rawPath, avatarDir)
+	_ = os.Remove(rawPath)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	imageURL := avatarURLPrefix + name
+	user, previous, err := s.replaceProfileImage(r, userID, &imageURL)
+	if err != nil {
+		_ = os.Remove(filepath.Join(avatarDir, name))
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeError(w, http.StatusUnauthorized, "認証トークンが無効です")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "プロフィール画像の更新に失敗しました")
+		return
+	}
+	s.removeAvatarFile(previous)
+
+	writeData(w, http.StatusOK, user)
+}
+
+func (s *Server) handleDeleteAvatar(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserID(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "認証トークンが無効です")
+		return
+	}
+
+	user, previous, err := s.replaceProfileImage(r, userID, nil)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeError(w, http.StatusUnauthorized, "認証トークンが無効です")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "プロフィール画像の削除に失敗しました")
+		return
+	}
+	s.removeAvatarFile(previous)
+
+	writeData(w, http.StatusOK, user)
+}
+
+func (s *Server) serveAvatar(w http.ResponseWriter, r *http.Request) {
+	filename := filepath.Base(chi.URLParam(r, "filename"))
+	http.ServeFile(w, r, filepath.Join(s.cfg.UploadDir, "avatars", filename))
+}
+
+// replaceProfileImage はプロフィール画像URLを差し替え、更新後のユーザーと差し替え前のURLを返す。
+func (s *Server) replaceProfileImage(r *http.Request, userID string, imageURL *string) (user model.User, previous *string, err error) {
+	user, err = scanUser(s.db.QueryRow(r.Context(), `
+		UPDATE users u
+		SET profile_image_url = $1, updated_at = NOW()
+		FROM (SELECT id, profile_image_url FROM users WHERE id = $2 FOR UPDATE) old
+		WHERE u.id = old.id
+		RETURNING
+			u.id, u.email, u.display_name, u.profile_image_url, u.email_verified_at,
+			u.totp_enabled_at IS NOT NULL, u.created_at, old.profile_image_url
+	`, imageURL, userID), newNullableString(&previous))
+	return user, previous, err
+}
+
+// removeAvatarFile は自前で保存したアバター画像のみ削除する。
+func (s *Server) removeAvatarFile(imageURL *string) {
+	if imageURL == nil {
+		return
+	}
+	name, ok := avatarFileName(*imageURL)
+	if !ok {
+		return
+	}
+	_ = os.Remove(filepath.Join(s.cfg.UploadDir, "avatars", name))
+}
+
+// avatarFileName は自前で保存したアバター画像のURLからファイル名を返す。
+func avatarFileName(imageURL string) (string, bool) {
+	if !strings.HasPrefix(imageURL, avatarURLPrefix) {
+		return "", false
+	}
+	return filepath.Base(strings.TrimPrefix(imageURL, avatarURLPrefix)), true
+}
+
+// writeSquareAvatar はアップロード画像を中央で正方形に切り抜いて avatarSize に縮小し、PNG で保存する。
+func writeSquareAvatar(srcPath, destDir string) (string, error) {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return "", errors.New("アップロード処理に失敗しました")
+	}
+	defer src.Close()
+
+	cfg, _, err := image.DecodeConfig(src)
+	if err != nil {
+		return "", errors.New("対応していない画像形式です")
+	}
+	if cfg.Width*cfg.Height > avatarMaxPixels {
+		return "", errors.New("画像の解像度が大きすぎます")
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return "", errors.New("アップロード処理に失敗しました")
+	}
+	img, _, err := image.Decode(src)
+	if err != nil {
+		return "", errors.New("対応していない画像形式です")
+	}
+
+	name := fmt.Sprintf("%s-%d-%s.png", avatarUploadPrefix, time.Now().UnixMilli(), uuid.NewString())
+	dst, err := os.Create(filepath.Join(destDir, name))
+	if err != nil {
+		return "", errors.New("ファイル保存に失敗しました")
+	}
+	defer dst.Close()
+
+	if err := png.Encode(dst, squareThumbnail(img, avatarSize)); err != nil {
+		_ = os.Remove(dst.Name())
+		return "", errors.New("ファイル保存に失敗しました")
+	}
+	return name, nil
+}
+
+func squareThumbnail(img image.Image, size int) *image.RGBA {
+	b := img.Bounds()
+	side := min(b.Dx(), b.Dy())
+	x0 := b.Min.X + (b.Dx()-side)/2
+	y0 := b.Min.Y + (b.Dy()-side)/2
+	crop := image.Rect(x0, y0, x0+side, y0+side)
+
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, crop, draw.Over, nil)
+	return dst
+}
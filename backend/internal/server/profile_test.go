@@ -0,0 +1,67 @@
+package server
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSquareThumbnail(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 400, 200))
+	for x := 100; x < 300; x++ {
+		for y := 0; y < 200; y++ {
+			src.Set(x, y, color.RGBA{R: 255, A: 255})
+		}
+	}
+
+	thumb := squareThumbnail(src, 64)
+	if thumb.Bounds().Dx() != 64 || thumb.Bounds().Dy() != 64 {
+		t.Fatalf("unexpected size: %v", thumb.Bounds())
+	}
+	// 中央の正方形(赤)だけが残るので、端のピクセルも赤になる。
+	if got := thumb.RGBAAt(0, 32); got.R != 255 {
+		t.Fatalf("edge pixel should come from the centre crop, got %v", got)
+	}
+}
+
+func TestWriteSquareAvatar(t *testing.T) {
+	dir := t.TempDir()
+	srcPath := filepath.Join(dir, "src.png")
+	f, err := os.Create(srcPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(f, image.NewRGBA(image.Rect(0, 0, 120, 300))); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	name, err := writeSquareAvatar(srcPath, dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	out, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	cfg, err := png.DecodeConfig(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Width != avatarSize || cfg.Height != avatarSize {
+		t.Fatalf("avatar should be %dx%d, got %dx%d", avatarSize, avatarSize, cfg.Width, cfg.Height)
+	}
+
+	notImage := filepath.Join(dir, "broken.png")
+	if err := os.WriteFile(notImage, []byte("not an image"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writeSquareAvatar(notImage, dir); err == nil {
+		t.Fatal("expected decode error")
+	}
+}
@@ -0,0 +1,294 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"github.com/ymmtyamaterous/diary-oc-api/internal/model"
+)
+
+// recordDiaryRevision は更新前の日記を版として記録し、limit を超えた古い版を削除する。limit が 0 なら何もしない。
+// 版の番号は ETag と同じ version で、created_at はその版が保存された日時。
+func recordDiaryRevision(ctx context.Context, q querier, entry model.DiaryEntry, limit int) error {
+	if limit <= 0 {
+		return nil
+	}
+	snapshot, err := json.Marshal(payloadFromEntry(entry))
+	if err != nil {
+		return err
+	}
+	if _, err := q.Exec(ctx, `
+		INSERT INTO diary_entry_revisions (diary_entry_id, revision, user_id, snapshot, created_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (diary_entry_id, revision) DO NOTHING
+	`, entry.ID, entry.Version, entry.UserID, snapshot, entry.UpdatedAt); err != nil {
+		return err
+	}
+	_, err = q.Exec(ctx, `
+		DELETE FROM diary_entry_revisions
+		WHERE diary_entry_id = $1
+		  AND revision <= (
+			SELECT revision
+			FROM diary_entry_revisions
+			WHERE diary_entry_id = $1
+			ORDER BY revision DESC
+			OFFSET $2
+			LIMIT 1
+		  )
+	`, entry.ID, limit)
+	return err
+}
+
+// loadDiaryRevision は版の内容を読み取る。
+func loadDiaryRevision(ctx context.Context, q querier, entryID string, revision int64) (diaryCreatePayload, error) {
+	var payload diaryCreatePayload
+	var snapshot []byte
+	if err := q.QueryRow(ctx, `
+		SELECT snapshot
+		FROM diary_entry_revisions
+		WHERE diary_entry_id = $1 AND revision = $2
+	`, entryID, revision).Scan(&snapshot); err != nil {
+		return payload, err
+	}
+	err := json.Unmarshal(snapshot, &payload)
+	return payload, err
+}
+
+func parseRevision(raw string) (int64, error) {
+	revision, err := strconv.ParseInt(strings.TrimSpace(raw), 10, 64)
+	if err != nil || revision < 1 {
+		return 0, errors.New("版の番号が不正です")
+	}
+	return revision, nil
+}
+
+// handleListDiaryRevisions は自分の日記の過去の版を新しい順に返す。
+func (s *Server) handleListDiaryRevisions(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserID(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "認証トークンが無効です")
+		return
+	}
+
+	id := chi.URLParam(r, "id")
+	if _, err := uuid.Parse(id); err != nil {
+		writeError(w, http.StatusBadRequest, "日記IDが不正です")
+		return
+	}
+
+	var exists bool
+	if err := s.db.QueryRow(r.Context(), `
+		SELECT EXISTS (SELECT 1 FROM diary_entries WHERE id = $1 AND user_id = $2 AND deleted_at IS NULL)
+	`, id, userID).Scan(&exists); err != nil {
+		writeError(w, http.StatusInternalServerError, "版の取得に失敗しました")
+		return
+	}
+	if !exists {
+		writeError(w, http.StatusNotFound, "日記が見つかりません")
+		return
+	}
+
+	rows, err := s.db.Query(r.Context(), `
+		SELECT revision, user_id, snapshot, created_at
+		FROM diary_entry_revisions
+		WHERE diary_entry_id = $1
+		ORDER BY revision DESC
+	`, id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "版の取得に失敗しました")
+		return
+	}
+	defer rows.Close()
+
+	revisions := make([]model.DiaryRevision, 0)
+	for rows.Next() {
+		var revision model.DiaryRevision
+		if err := rows.Scan(&revision.Revision, &revision.AuthorID, &revision.Snapshot, &revision.CreatedAt); err != nil {
+			writeError(w, http.StatusInternalServerError, "版の取得に失敗しました")
+			return
+		}
+		revisions = append(revisions, revision)
+	}
+	if err := rows.Err(); err != nil {
+		writeError(w, http.StatusInternalServerError, "版の取得に失敗しました")
+		return
+	}
+
+	writeData(w, http.StatusOK, revisions)
+}
+
+// handleDiffDiaryRevisions は版 from と版 to の項目ごとの差分を返す。to を省略すると現在の日記と比較する。
+func (s *Server) handleDiffDiaryRevisions(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserID(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "認証トークンが無効です")
+		return
+	}
+
+	id := chi.URLParam(r, "id")
+	if _, err := uuid.Parse(id); err != nil {
+		writeError(w, http.StatusBadRequest, "日記IDが不正です")
+		return
+	}
+	from, err := parseRevision(r.URL.Query().Get("from"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var to *int64
+	if raw := r.URL.Query().Get("to"); raw != "" {
+		revision, err := parseRevision(raw)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		to = &revision
+	}
+
+	ctx := r.Context()
+	current, err := scanDiaryEntry(s.db.QueryRow(ctx, `
+		SELECT `+diaryColumns+`
+		FROM diary_entries
+		WHERE id = $1 AND user_id = $2 AND deleted_at IS NULL
+	`, id, userID))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "日記が見つかりません")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "版の比較に失敗しました")
+		return
+	}
+
+	older, err := loadDiaryRevision(ctx, s.db, id, from)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "版が見つかりません")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "版の比較に失敗しました")
+		return
+	}
+	newer := payloadFromEntry(current)
+	if to != nil && *to != current.Version {
+		if newer, err = loadDiaryRevision(ctx, s.db, id, *to); err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				writeError(w, http.StatusNotFound, "版が見つかりません")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "版の比較に失敗しました")
+			return
+		}
+	}
+
+	writeData(w, http.StatusOK, model.DiaryRevisionDiff{
+		From:    from,
+		To:      to,
+		Changes: diffDiaryPayloads(older, newer),
+	})
+}
+
+// handleRestoreDiaryRevision は日記を過去の版の内容に戻す。戻す前の内容も新しい版として記録する。
+func (s *Server) handleRestoreDiaryRevision(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserID(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "認証トークンが無効です")
+		return
+	}
+
+	id := chi.URLParam(r, "id")
+	if _, err := uuid.Parse(id); err != nil {
+		writeError(w, http.StatusBadRequest, "日記IDが不正です")
+		return
+	}
+	revision, err := parseRevision(chi.URLParam(r, "rev"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx := r.Context()
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "版の復元に失敗しました")
+		return
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	current, err := lockDiary(ctx, tx, id)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		writeError(w, http.StatusInternalServerError, "版の復元に失敗しました")
+		return
+	}
+	if err != nil || current.UserID != userID {
+		writeError(w, http.StatusNotFound, "日記が見つかりません")
+		return
+	}
+	if !ifMatch(r, diaryETag(current.Version)) {
+		writeDiaryPreconditionFailed(w, current)
+		return
+	}
+
+	payload, err := loadDiaryRevision(ctx, tx, id, revision)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "版が見つかりません")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "版の復元に失敗しました")
+		return
+	}
+	if err := validateDiaryPayload(payload); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if payload.IsPublic && !s.canPublish(ctx) {
+		writeError(w, http.StatusForbidden, errPublishUnverified)
+		return
+	}
+
+	if err := recordDiaryRevision(ctx, tx, current, s.cfg.DiaryRevisionLimit); err != nil {
+		writeError(w, http.StatusInternalServerError, "版の復元に失敗しました")
+		return
+	}
+	entry, err := updateDiaryEntry(ctx, tx, id, payload)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "版の復元に失敗しました")
+		return
+	}
+	if entry.Tags, err = setDiaryTags(ctx, tx, userID, entry.ID, payload.Tags); err != nil {
+		writeError(w, http.StatusInternalServerError, "版の復元に失敗しました")
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, "版の復元に失敗しました")
+		return
+	}
+
+	writeDiary(w, http.StatusOK, entry)
+}
+
+// diffDiaryPayloads は2つの版で値が異なる項目を diaryCreatePayload のフィールド順に返す。
+func diffDiaryPayloads(from, to diaryCreatePayload) []model.DiaryFieldChange {
+	fromValue, toValue := reflect.ValueOf(from), reflect.ValueOf(to)
+	fields := fromValue.Type()
+	changes := make([]model.DiaryFieldChange, 0)
+	for i := range fields.NumField() {
+		before, after := fromValue.Field(i).Interface(), toValue.Field(i).Interface()
+		if reflect.DeepEqual(before, after) {
+			continue
+		}
+		name, _, _ := strings.Cut(fields.Field(i).Tag.Get("json"), ",")
+		changes = append(changes, model.DiaryFieldChange{Field: name, From: before, To: after})
+	}
+	return changes
+}
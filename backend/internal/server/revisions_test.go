@@ -0,0 +1,44 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ymmtyamaterous/diary-oc-api/internal/model"
+)
+
+func TestDiffDiaryPayloads(t *testing.T) {
+	from := diaryCreatePayload{
+		Date:        "2026-10-01",
+		Content:     strPtr("長い振り返り"),
+		Reflections: strPtr("もっと早く寝る"),
+		Tags:        []string{"読書"},
+	}
+	to := from
+	to.Reflections = nil
+	to.IsPublic = true
+	to.Tags = []string{"読書", "旅行"}
+
+	want := []model.DiaryFieldChange{
+		{Field: "is_public", From: false, To: true},
+		{Field: "reflections", From: strPtr("もっと早く寝る"), To: (*string)(nil)},
+		{Field: "tags", From: []string{"読書"}, To: []string{"読書", "旅行"}},
+	}
+	if got := diffDiaryPayloads(from, to); !reflect.DeepEqual(got, want) {
+		t.Fatalf("diffDiaryPayloads() = %+v, want %+v", got, want)
+	}
+	if got := diffDiaryPayloads(from, from); len(got) != 0 {
+		t.Fatalf("diffDiaryPayloads() of the same payload = %+v, want none", got)
+	}
+}
+
+func TestParseRevision(t *testing.T) {
+	if got, err := parseRevision("12"); err != nil || got != 12 {
+		t.Fatalf("parseRevision(12) = %d, %v", got, err)
+	}
+	for _, raw := range []string{"", "0", "-1", "abc"} {
+		if _, err := parseRevision(raw); err == nil {
+			t.Fatalf("parseRevision(%q) should fail", raw)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/ymmtyamaterous/diary-oc-api/internal/model"
+)
+
+const (
+	maxSearchQueryRunes = 100
+	maxSearchTerms      = 5
+	maxSearchSnippets   = 3
+	// 抜粋は最初の一致の少し前から snippetRunes 文字
+	snippetRunes        = 80
+	snippetLeadingRunes = 20
+	// trigramMinRunes 未満の検索語はトライグラムの索引が使えないため、
+	// 1〜2文字の断片の索引(0020_diary_search_short_terms.sql)で絞り込む
+	trigramMinRunes = 3
+)
+
+// searchableFields は検索対象の項目。search_text 列(0013_diary_search.sql)の連結順と揃える。
+var searchableFields = []struct {
+	name  string
+	value func(model.DiaryEntry) *string
+}{
+	{"content", func(e model.DiaryEntry) *string { return e.Content }},
+	{"events", func(e model.DiaryEntry) *string { return e.Events }},
+	{"emotions", func(e model.DiaryEntry) *string { return e.Emotions }},
+	{"good_things", func(e model.DiaryEntry) *string { return e.GoodThings }},
+	{"reflections", func(e model.DiaryEntry) *string { return e.Reflections }},
+	{"gratitude", func(e model.DiaryEntry) *string { return e.Gratitude }},
+	{"tomorrow_goals", func(e model.DiaryEntry) *string { return e.TomorrowGoals }},
+	{"tomorrow_looking_forward", func(e model.DiaryEntry) *string { return e.TomorrowLookingForward }},
+	{"learnings", func(e model.DiaryEntry) *string { return e.Learnings }},
+	{"health_habits", func(e model.DiaryEntry) *string { return e.HealthHabits }},
+	{"today_in_one_word", func(e model.DiaryEntry) *string { return e.TodayInOneWord }},
+}
+
+// handleSearchDiaries は自分の日記をキーワードで部分一致検索し、出現回数の多い順に抜粋付きで返す。
+// 空白区切りの複数キーワードはすべてを含む日記に一致する。
+func (s *Server) handleSearchDiaries(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserID(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "認証トークンが無効です")
+		return
+	}
+
+	terms, err := parseSearchTerms(r.URL.Query().Get("q"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	filter, err := parseDiaryFilter(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if filter.Cursor != nil {
+		writeError(w, http.StatusBadRequest, "検索ではカーソルを指定できません")
+		return
+	}
+
+	var q queryBuilder
+	q.where("user_id = " + q.arg(userID))
+	q.where("deleted_at IS NULL AND NOT is_draft")
+	q.applyDiaryFilter(filter, "")
+	scores := make([]string, 0, len(terms))
+	for _, term := range terms {
+		q.where("search_text ILIKE " + q.arg("%"+escapeLike(term)+"%"))
+		if utf8.RuneCountInString(term) < trigramMinRunes {
+			q.where("diary_search_grams(search_text) @> ARRAY[lower(" + q.arg(term) + "::text)]")
+		}
+		placeholder := q.arg(strings.ToLower(term))
+		scores = append(scores, fmt.Sprintf(
+			"(char_length(lower(search_text)) - char_length(replace(lower(search_text), %s, ''))) / char_length(%s)",
+			placeholder, placeholder,
+		))
+	}
+
+	rows, err := s.db.Query(r.Context(), `
+		SELECT `+diaryColumns+`, `+strings.Join(scores, " + ")+` AS score
+		FROM diary_entries
+		WHERE `+q.whereClause()+`
+		ORDER BY score DESC, date DESC, created_at DESC
+		LIMIT `+q.arg(filter.Limit), q.args...)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "日記の検索に失敗しました")
+		return
+	}
+	defer rows.Close()
+
+	results := make([]model.DiarySearchResult, 0)
+	for rows.Next() {
+		var score int
+		entry, err := scanDiaryEntry(rows, &score)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "日記の検索に失敗しました")
+			return
+		}
+		results = append(results, model.DiarySearchResult{
+			DiaryEntry: entry,
+			Score:      score,
+			Snippets:   buildSnippets(entry, terms),
+		})
+	}
+	if err := rows.Err(); err != nil {
+		writeError(w, http.StatusInternalServerError, "日記の検索に失敗しました")
+		return
+	}
+
+	writeData(w, http.StatusOK, results)
+}
+
+// parseSearchTerms は検索語を空白(全角空白を含む)で区切り、重複を除いて返す。
+func parseSearchTerms(raw string) ([]string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil, errors.New("検索キーワードを入力してください")
+	}
+	if utf8.RuneCountInString(raw) > maxSearchQueryRunes {
+		return nil, fmt.Errorf("検索キーワードは%d文字以内で入力してください", maxSearchQueryRunes)
+	}
+
+	seen := map[string]bool{}
+	terms := make([]string, 0, maxSearchTerms)
+	for _, term := range strings.Fields(raw) {
+		key := strings.ToLower(term)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		terms = append(terms, term)
+	}
+	if len(terms) > maxSearchTerms {
+		return nil, fmt.Errorf("検索キーワードは%d個までにしてください", maxSearchTerms)
+	}
+	return terms, nil
+}
+
+// escapeLike は LIKE のワイルドカードを通常の文字として扱うようにエスケープする。
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(value)
+}
+
+// buildSnippets は検索語を含む項目ごとに、最初の一致付近の抜粋を作る。
+func buildSnippets(entry model.DiaryEntry, terms []string) []model.SearchSnippet {
+	lowerTerms := make([][]rune, 0, len(terms))
+	for _, term := range terms {
+		lowerTerms = append(lowerTerms, lowerRunes(term))
+	}
+
+	snippets := make([]model.SearchSnippet, 0, maxSearchSnippets)
+	for _, field := range searchableFields {
+		value := field.value(entry)
+		if value == nil {
+			continue
+		}
+		fragments := snippetFragments([]rune(*value), lowerTerms)
+		if fragments == nil {
+			continue
+		}
+		snippets = append(snippets, model.SearchSnippet{Field: field.name, Fragments: fragments})
+		if len(snippets) == maxSearchSnippets {
+			break
+		}
+	}
+	return snippets
+}
+
+// snippetFragments は text 中の検索語の位置に印を付け、最初の一致を含む範囲を一致部分とそれ以外に分けて返す。
+// 一致がなければ nil を返す。
+func snippetFragments(text []rune, lowerTerms [][]rune) []model.SnippetFragment {
+	lower := lowerRunes(string(text))
+	matched := make([]bool, len(text))
+	first := -1
+	for _, term := range lowerTerms {
+		if len(term) == 0 {
+			continue
+		}
+		for i := 0; i+len(term) <= len(lower); i++ {
+			if !slices.Equal(lower[i:i+len(term)], term) {
+				continue
+			}
+			for j := i; j < i+len(term); j++ {
+				matched[j] = true
+			}
+			if first == -1 || i < first {
+				first = i
+			}
+		}
+	}
+	if first == -1 {
+		return nil
+	}
+
+	start := max(0, first-snippetLeadingRunes)
+	end := min(len(text), start+snippetRunes)
+	// 一致の途中で切らない
+	for end < len(text) && matched[end-1] && matched[end] {
+		end++
+	}
+
+	var fragments []model.SnippetFragment
+	if start > 0 {
+		fragments = append(fragments, model.SnippetFragment{Text: "…"})
+	}
+	for i := start; i < end; {
+		j := i
+		for j < end && matched[j] == matched[i] {
+			j++
+		}
+		fragments = append(fragments, model.SnippetFragment{Text: string(text[i:j]), Match: matched[i]})
+		i = j
+	}
+	if end < len(text) {
+		fragments = append(fragments, model.SnippetFragment{Text: "…"})
+	}
+	return mergeFragments(fragments)
+}
+
+// mergeFragments は隣り合う同じ種類の断片(省略記号を含む)をまとめる。
+func mergeFragments(fragments []model.SnippetFragment) []model.SnippetFragment {
+	merged := make([]model.SnippetFragment, 0, len(fragments))
+	for _, fragment := range fragments {
+		if n := len(merged); n > 0 && merged[n-1].Match == fragment.Match {
+			merged[n-1].Text += fragment.Text
+			continue
+		}
+		merged = append(merged, fragment)
+	}
+	return merged
+}
+
+// lowerRunes は文字数を変えずに小文字化する。strings.ToLower はバイト長が変わりうるため位置合わせに使えない。
+func lowerRunes(value string) []rune {
+	runes := []rune(value)
+	for i, r := range runes {
+		runes[i] = unicode.ToLower(r)
+	}
+	return runes
+}
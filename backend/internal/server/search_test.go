@@ -0,0 +1,63 @@
+package server
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ymmtyamaterous/diary-oc-api/internal/model"
+)
+
+func TestParseSearchTerms(t *testing.T) {
+	terms, err := parseSearchTerms(" 海　散歩 Coffee coffee ")
+	if err != nil {
+		t.Fatalf("parseSearchTerms() error = %v", err)
+	}
+	if want := []string{"海", "散歩", "Coffee"}; !reflect.DeepEqual(terms, want) {
+		t.Fatalf("parseSearchTerms() = %v, want %v", terms, want)
+	}
+
+	for _, raw := range []string{"", "　", "a b c d e f", strings.Repeat("あ", maxSearchQueryRunes+1)} {
+		if _, err := parseSearchTerms(raw); err == nil {
+			t.Fatalf("parseSearchTerms(%q) should fail", raw)
+		}
+	}
+}
+
+func TestEscapeLike(t *testing.T) {
+	if got, want := escapeLike(`100%_\`), `100\%\_\\`; got != want {
+		t.Fatalf("escapeLike() = %q, want %q", got, want)
+	}
+}
+
+func TestBuildSnippets(t *testing.T) {
+	entry := model.DiaryEntry{
+		Content:    strPtr("朝から海へ行った。海の色がきれいだった"),
+		Emotions:   strPtr("楽しかった"),
+		Gratitude:  strPtr("COFFEE を淹れてくれた友人に感謝"),
+		Learnings:  nil,
+		GoodThings: strPtr(strings.Repeat("あ", 40) + "海" + strings.Repeat("い", 100)),
+	}
+
+	snippets := buildSnippets(entry, []string{"海", "coffee"})
+	want := []model.SearchSnippet{
+		{Field: "content", Fragments: []model.SnippetFragment{
+			{Text: "朝から"}, {Text: "海", Match: true}, {Text: "へ行った。"}, {Text: "海", Match: true}, {Text: "の色がきれいだった"},
+		}},
+		{Field: "good_things", Fragments: []model.SnippetFragment{
+			{Text: "…" + strings.Repeat("あ", snippetLeadingRunes)},
+			{Text: "海", Match: true},
+			{Text: strings.Repeat("い", snippetRunes-snippetLeadingRunes-1) + "…"},
+		}},
+		{Field: "gratitude", Fragments: []model.SnippetFragment{
+			{Text: "COFFEE", Match: true}, {Text: " を淹れてくれた友人に感謝"},
+		}},
+	}
+	if !reflect.DeepEqual(snippets, want) {
+		t.Fatalf("buildSnippets() = %+v, want %+v", snippets, want)
+	}
+
+	if got := buildSnippets(entry, []string{"山"}); len(got) != 0 {
+		t.Fatalf("buildSnippets() without match = %+v, want none", got)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"mime/multipart"
 	"net/http"
 	"os"
@@ -23,53 +24,178 @@ import (
 
 	"github.com/ymmtyamaterous/diary-oc-api/internal/auth"
 	"github.com/ymmtyamaterous/diary-oc-api/internal/config"
+	"github.com/ymmtyamaterous/diary-oc-api/internal/mail"
 	"github.com/ymmtyamaterous/diary-oc-api/internal/model"
+	"github.com/ymmtyamaterous/diary-oc-api/internal/oidc"
 	"github.com/ymmtyamaterous/diary-oc-api/internal/validation"
 )
 
 type Server struct {
-	cfg config.Config
-	db  *pgxpool.Pool
+	cfg           config.Config
+	db            *pgxpool.Pool
+	mailer        mail.Mailer
+	oidcProviders map[string]*oidc.Provider
+	keys          *auth.KeySet
+	passwords     auth.PasswordHasher
+	passwordRules validation.PasswordPolicy
+	location      *time.Location
 }
 
 type contextKey string
 
-const userIDKey contextKey = "userID"
+const (
+	userIDKey        contextKey = "userID"
+	sessionIDKey     contextKey = "sessionID"
+	emailVerifiedKey contextKey = "emailVerified"
+	requiredScopeKey contextKey = "requiredScope"
+)
 
-func New(cfg config.Config, db *pgxpool.Pool) *Server {
-	return &Server{cfg: cfg, db: db}
+// New はサーバーを作成する。keys が nil の場合は JWT_SECRET による HS256 で署名する。
+func New(cfg config.Config, db *pgxpool.Pool, keys *auth.KeySet) *Server {
+	if keys == nil {
+		keys = auth.NewHMACKeySet(cfg.JWTSecret)
+	}
+	providers := make(map[string]*oidc.Provider, len(cfg.OIDCProviders))
+	for _, provider := range cfg.OIDCProviders {
+		providers[provider.Name] = oidc.NewProvider(provider, nil)
+	}
+	// APP_TIMEZONE は起動時に Config.Validate で検証する
+	location, err := time.LoadLocation(cfg.AppTimezone)
+	if err != nil {
+		location = time.UTC
+	}
+	return &Server{
+		cfg:           cfg,
+		db:            db,
+		mailer:        mail.New(cfg),
+		oidcProviders: providers,
+		keys:          keys,
+		passwords:     newPasswordHasher(cfg),
+		passwordRules: validation.PasswordPolicy{MinLength: cfg.PasswordMinLength, MaxBytes: cfg.PasswordMaxBytes},
+		location:      location,
+	}
+}
+
+// newPasswordHasher は設定からパスワードハッシュのパラメータを組み立てる。範囲外の値は既定値になる。
+func newPasswordHasher(cfg config.Config) auth.PasswordHasher {
+	hasher := auth.PasswordHasher{Algorithm: cfg.PasswordHashAlgorithm, BcryptCost: cfg.BcryptCost}
+	if cfg.Argon2MemoryKiB > 0 && cfg.Argon2MemoryKiB <= math.MaxUint32 {
+		hasher.Argon2.MemoryKiB = uint32(cfg.Argon2MemoryKiB)
+	}
+	if cfg.Argon2Iterations > 0 && cfg.Argon2Iterations <= math.MaxUint32 {
+		hasher.Argon2.Iterations = uint32(cfg.Argon2Iterations)
+	}
+	if cfg.Argon2Parallelism > 0 && cfg.Argon2Parallelism <= math.MaxUint8 {
+		hasher.Argon2.Parallelism = uint8(cfg.Argon2Parallelism)
+	}
+	return hasher
+}
+
+// corsMiddleware は CORS ヘッダを付与する。OIDC のルートはバインド用 Cookie をやり取りするため、
+// AUTH_COOKIE_ENABLED に関わらず資格情報付きのリクエストを許可する。
+func (s *Server) corsMiddleware(next http.Handler) http.Handler {
+	options := cors.Options{
+		AllowedOrigins:   s.cfg.AllowedOrigins,
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "If-Match", csrfHeaderName},
+		ExposedHeaders:   []string{"Retry-After", "ETag"},
+		AllowCredentials: s.cfg.AuthCookieEnabled,
+		MaxAge:           300,
+	}
+	handler := cors.Handler(options)(next)
+	options.AllowCredentials = true
+	oidcHandler := cors.Handler(options)(next)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, oidcBindingCookiePath+"/") {
+			oidcHandler.ServeHTTP(w, r)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
 }
 
 func (s *Server) Router() http.Handler {
 	r := chi.NewRouter()
-	r.Use(cors.Handler(cors.Options{
-		AllowedOrigins: s.cfg.AllowedOrigins,
-		AllowedMethods: []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
-		AllowedHeaders: []string{"Accept", "Authorization", "Content-Type"},
-		MaxAge:         300,
-	}))
+	r.Use(s.corsMiddleware)
 
 	r.Route("/api", func(api chi.Router) {
+		api.Use(s.csrfMiddleware)
+
 		api.Get("/health", s.handleHealth)
 
 		api.Post("/auth/register", s.handleRegister)
 		api.Post("/auth/login", s.handleLogin)
+		api.Post("/auth/refresh", s.handleRefresh)
+		api.Post("/auth/password/forgot", s.handleForgotPassword)
+		api.Post("/auth/password/reset", s.handleResetPassword)
+		api.Post("/auth/verify-email", s.handleVerifyEmail)
+		api.With(s.authMiddleware).Post("/auth/verify-email/resend", s.handleResendVerification)
+		api.With(s.authMiddleware).Put("/auth/password", s.handleChangePassword)
+		api.With(s.authMiddleware).Post("/auth/email", s.handleRequestEmailChange)
+		api.Post("/auth/email/confirm", s.handleConfirmEmailChange)
+		api.With(s.authMiddleware).Post("/auth/logout", s.handleLogout)
 		api.With(s.authMiddleware).Get("/auth/me", s.handleMe)
+		api.With(s.authMiddleware).Get("/auth/sessions", s.handleListSessions)
+		api.With(s.authMiddleware).Delete("/auth/sessions", s.handleRevokeOtherSessions)
+		api.With(s.authMiddleware).Delete("/auth/sessions/{id}", s.handleRevokeSession)
+		api.With(s.authMiddleware).Get("/auth/tokens", s.handleListTokens)
+		api.With(s.authMiddleware).Post("/auth/tokens", s.handleCreateToken)
+		api.With(s.authMiddleware).Delete("/auth/tokens/{id}", s.handleRevokeToken)
+
+		api.With(s.authMiddleware).Patch("/users/me", s.handleUpdateProfile)
+		api.With(s.authMiddleware).Post("/users/me/avatar", s.handleUploadAvatar)
+		api.With(s.authMiddleware).Delete("/users/me/avatar", s.handleDeleteAvatar)
+		api.With(s.authMiddleware).Delete("/users/me", s.handleDeleteAccount)
+		api.Post("/auth/restore", s.handleRestoreAccount)
+
+		api.Post("/auth/2fa/verify", s.handleVerifyTwoFactor)
+		api.With(s.authMiddleware).Post("/auth/2fa/setup", s.handleSetupTwoFactor)
+		api.With(s.authMiddleware).Post("/auth/2fa/confirm", s.handleConfirmTwoFactor)
+		api.With(s.authMiddleware).Post("/auth/2fa/disable", s.handleDisableTwoFactor)
+
+		api.Get("/auth/oidc/providers", s.handleListOIDCProviders)
+		api.Post("/auth/oidc/{provider}/start", s.handleStartOIDC)
+		// 連携の完了ではログイン中のユーザーを確認するため、トークンがあれば認証する
+		api.With(s.optionalAuth("")).Post("/auth/oidc/{provider}/callback", s.handleOIDCCallback)
+		api.With(s.authMiddleware).Post("/auth/oidc/{provider}/link", s.handleLinkOIDC)
+		api.With(s.authMiddleware).Get("/users/me/identities", s.handleListIdentities)
+		api.With(s.authMiddleware).Delete("/users/me/identities/{provider}", s.handleUnlinkIdentity)
 
 		api.Get("/diaries/public", s.handleListPublicDiaries)
-		api.With(s.authMiddleware).Get("/diaries", s.handleListMyDiaries)
-		api.With(s.authMiddleware).Post("/diaries", s.handleCreateDiary)
-		api.With(s.authMiddleware).Put("/diaries/{id}", s.handleUpdateDiary)
-		api.With(s.authMiddleware).Delete("/diaries/{id}", s.handleDeleteDiary)
-		api.With(s.authMiddleware).Patch("/diaries/{id}/visibility", s.handleUpdateVisibility)
-
-		api.With(s.authMiddleware).Post("/upload/image", s.handleUploadImage)
-		api.With(s.authMiddleware).Post("/upload/audio", s.handleUploadAudio)
-		api.With(s.authMiddleware).Delete("/files/{filename}", s.handleDeleteFile)
+		api.Get("/users/{id}/diaries/public", s.handleListAuthorPublicDiaries)
+		api.With(s.requireScope(scopeDiariesRead), s.requireVerifiedEmail).Get("/diaries", s.handleListMyDiaries)
+		api.With(s.requireScope(scopeDiariesWrite), s.requireVerifiedEmail).Post("/diaries", s.handleCreateDiary)
+		api.With(s.requireScope(scopeDiariesRead), s.requireVerifiedEmail).Get("/diaries/search", s.handleSearchDiaries)
+		api.With(s.requireScope(scopeDiariesRead), s.requireVerifiedEmail).Get("/diaries/trash", s.handleListTrashedDiaries)
+		api.With(s.requireScope(scopeDiariesWrite), s.requireVerifiedEmail).Delete("/diaries/trash/{id}", s.handlePurgeTrashedDiary)
+		api.With(s.requireScope(scopeDiariesWrite), s.requireVerifiedEmail).Post("/diaries/{id}/restore", s.handleRestoreTrashedDiary)
+		api.With(s.requireScope(scopeDiariesRead), s.requireVerifiedEmail).Get("/drafts", s.handleListDrafts)
+		api.With(s.requireScope(scopeDiariesWrite), s.requireVerifiedEmail).Post("/drafts", s.handleCreateDraft)
+		api.With(s.requireScope(scopeDiariesWrite), s.requireVerifiedEmail).Put("/drafts/{id}", s.handleAutosaveDraft)
+		api.With(s.requireScope(scopeDiariesWrite), s.requireVerifiedEmail).Delete("/drafts/{id}", s.handleDeleteDraft)
+		api.With(s.requireScope(scopeDiariesWrite), s.requireVerifiedEmail).Post("/drafts/{id}/publish", s.handlePublishDraft)
+		api.With(s.optionalAuth(scopeDiariesRead)).Get("/diaries/{id}", s.handleGetDiary)
+		api.With(s.requireScope(scopeDiariesRead), s.requireVerifiedEmail).Get("/tags", s.handleListTags)
+		api.With(s.requireScope(scopeDiariesWrite), s.requireVerifiedEmail).Patch("/tags/{id}", s.handleRenameTag)
+		api.With(s.requireScope(scopeDiariesWrite), s.requireVerifiedEmail).Post("/tags/{id}/merge", s.handleMergeTag)
+		api.With(s.requireScope(scopeDiariesWrite), s.requireVerifiedEmail).Put("/diaries/{id}", s.handleUpdateDiary)
+		api.With(s.requireScope(scopeDiariesWrite), s.requireVerifiedEmail).Patch("/diaries/{id}", s.handlePatchDiary)
+		api.With(s.requireScope(scopeDiariesWrite), s.requireVerifiedEmail).Delete("/diaries/{id}", s.handleDeleteDiary)
+		api.With(s.requireScope(scopeDiariesWrite), s.requireVerifiedEmail).Patch("/diaries/{id}/visibility", s.handleUpdateVisibility)
+		api.With(s.requireScope(scopeDiariesRead), s.requireVerifiedEmail).Get("/diaries/{id}/revisions", s.handleListDiaryRevisions)
+		api.With(s.requireScope(scopeDiariesRead), s.requireVerifiedEmail).Get("/diaries/{id}/revisions/diff", s.handleDiffDiaryRevisions)
+		api.With(s.requireScope(scopeDiariesWrite), s.requireVerifiedEmail).Post("/diaries/{id}/revisions/{rev}/restore", s.handleRestoreDiaryRevision)
+
+		api.With(s.requireScope(scopeFilesWrite), s.requireVerifiedEmail).Post("/upload/image", s.handleUploadImage)
+		api.With(s.requireScope(scopeFilesWrite), s.requireVerifiedEmail).Post("/upload/audio", s.handleUploadAudio)
+		api.With(s.requireScope(scopeFilesWrite), s.requireVerifiedEmail).Delete("/files/{filename}", s.handleDeleteFile)
 	})
 
+	r.Get("/.well-known/jwks.json", s.handleJWKS)
 	r.Get("/api/files/images/{filename}", s.serveImage)
 	r.Get("/api/files/audio/{filename}", s.serveAudio)
+	r.Get("/api/files/avatars/{filename}", s.serveAvatar)
 
 	return r
 }
@@ -89,8 +215,10 @@ type authPayload struct {
 }
 
 type authResponse struct {
-	Token string     `json:"token"`
-	User  model.User `json:"user"`
+	Token        string     `json:"token"`
+	RefreshToken string     `json:"refresh_token"`
+	CSRFToken    string     `json:"csrf_token,omitempty"`
+	User         model.User `json:"user"`
 }
 
 func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
@@ -104,33 +232,26 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	if err := validation.RequirePassword(payload.Password); err != nil {
+	if err := validation.RequireDisplayName(payload.DisplayName); err != nil {
 		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	if err := validation.RequireDisplayName(payload.DisplayName); err != nil {
-		writeError(w, http.StatusBadRequest, err.Error())
+	if err := s.passwordRules.Check(payload.Password, payload.Email, payload.DisplayName); err != nil {
+		writePasswordError(w, err)
 		return
 	}
 
-	hash, err := auth.HashPassword(payload.Password)
+	hash, err := s.passwords.Hash(payload.Password)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "パスワード処理に失敗しました")
 		return
 	}
 
-	var user model.User
-	err = s.db.QueryRow(r.Context(), `
+	user, err := scanUser(s.db.QueryRow(r.Context(), `
 		INSERT INTO users (email, password_hash, display_name)
 		VALUES ($1, $2, $3)
-		RETURNING id, email, display_name, profile_image_url, created_at
-	`, strings.TrimSpace(payload.Email), hash, strings.TrimSpace(payload.DisplayName)).Scan(
-		&user.ID,
-		&user.Email,
-		&user.DisplayName,
-		newNullableString(&user.ProfileImageURL),
-		&user.CreatedAt,
-	)
+		RETURNING `+userColumns+`
+	`, strings.TrimSpace(payload.Email), hash, strings.TrimSpace(payload.DisplayName)))
 	if err != nil {
 		var pgErr *pgconn.PgError
 		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
@@ -141,13 +262,15 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token, err := auth.GenerateToken(user.ID, user.Email, s.cfg.JWTSecret, s.cfg.TokenHours)
+	s.sendVerificationMail(r.Context(), user)
+
+	response, err := s.startSession(r, user)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "トークン生成に失敗しました")
 		return
 	}
 
-	writeData(w, http.StatusCreated, authResponse{Token: token, User: user})
+	s.writeSession(w, http.StatusCreated, response)
 }
 
 func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
@@ -162,41 +285,51 @@ func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var user model.User
+	throttle := s.newLoginThrottle(r, payload.Email)
+	retryAfter, err := s.loginRetryAfter(r.Context(), throttle)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "ログインに失敗しました")
+		return
+	}
+	if retryAfter > 0 {
+		writeTooManyAttempts(w, retryAfter)
+		return
+	}
+
 	var hash string
-	err := s.db.QueryRow(r.Context(), `
-		SELECT id, email, display_name, profile_image_url, created_at, password_hash
+	var deleteAfter pgtype.Timestamptz
+	user, err := scanUser(s.db.QueryRow(r.Context(), `
+		SELECT `+userColumns+`, COALESCE(password_hash, ''), delete_after
 		FROM users
 		WHERE email = $1
-	`, strings.TrimSpace(payload.Email)).Scan(
-		&user.ID,
-		&user.Email,
-		&user.DisplayName,
-		newNullableString(&user.ProfileImageURL),
-		&user.CreatedAt,
-		&hash,
-	)
+	`, strings.TrimSpace(payload.Email)), &hash, &deleteAfter)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
-			writeError(w, http.StatusUnauthorized, "メールアドレスまたはパスワードが正しくありません")
+			s.rejectLogin(w, r, throttle, nil)
 			return
 		}
 		writeError(w, http.StatusInternalServerError, "ログインに失敗しました")
 		return
 	}
 
-	if err := auth.VerifyPassword(hash, payload.Password); err != nil {
-		writeError(w, http.StatusUnauthorized, "メールアドレスまたはパスワードが正しくありません")
+	needsRehash, err := s.passwords.Verify(hash, payload.Password)
+	if err != nil {
+		s.rejectLogin(w, r, throttle, &user)
 		return
 	}
-
-	token, err := auth.GenerateToken(user.ID, user.Email, s.cfg.JWTSecret, s.cfg.TokenHours)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, "トークン生成に失敗しました")
+	if needsRehash {
+		s.rehashPassword(r.Context(), user.ID, hash, payload.Password)
+	}
+	if err := s.clearLoginFailures(r.Context(), throttle); err != nil {
+		writeError(w, http.StatusInternalServerError, "ログインに失敗しました")
+		return
+	}
+	if deleteAfter.Valid {
+		writeError(w, http.StatusForbidden, "このアカウントは削除手続き中です。復元する場合はアカウントの復元を行ってください")
 		return
 	}
 
-	writeData(w, http.StatusOK, authResponse{Token: token, User: user})
+	s.completeLogin(w, r, user)
 }
 
 func (s *Server) handleMe(w http.ResponseWriter, r *http.Request) {
@@ -206,18 +339,11 @@ func (s *Server) handleMe(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var user model.User
-	err := s.db.QueryRow(r.Context(), `
-		SELECT id, email, display_name, profile_image_url, created_at
+	user, err := scanUser(s.db.QueryRow(r.Context(), `
+		SELECT `+userColumns+`
 		FROM users
 		WHERE id = $1
-	`, userID).Scan(
-		&user.ID,
-		&user.Email,
-		&user.DisplayName,
-		newNullableString(&user.ProfileImageURL),
-		&user.CreatedAt,
-	)
+	`, userID))
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			writeError(w, http.StatusUnauthorized, "認証トークンが無効です")
@@ -249,8 +375,11 @@ type diaryCreatePayload struct {
 	Learnings              *string `json:"learnings"`
 	HealthHabits           *string `json:"health_habits"`
 	TodayInOneWord         *string `json:"today_in_one_word"`
+	// Tags を省略した更新では既存のタグを変更しない。空配列を送るとすべて外す。
+	Tags []string `json:"tags"`
 }
 
+// handleListMyDiaries は自分の日記を日付の新しい順に返す。next_cursor を cursor に渡すと続きを取得できる。
 func (s *Server) handleListMyDiaries(w http.ResponseWriter, r *http.Request) {
 	userID, ok := getUserID(r.Context())
 	if !ok {
@@ -258,25 +387,41 @@ func (s *Server) handleListMyDiaries(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	filter, err := parseDiaryFilter(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var q queryBuilder
+	q.where("user_id = " + q.arg(userID))
+	q.where("deleted_at IS NULL AND NOT is_draft")
+	q.applyDiaryFilter(filter, "")
+	if filter.Cursor != nil {
+		if filter.Cursor.Date == "" {
+			writeError(w, http.StatusBadRequest, "カーソルが不正です")
+			return
+		}
+		q.where(fmt.Sprintf(
+			"(date, created_at, id) < (%s::date, %s, %s::uuid)",
+			q.arg(filter.Cursor.Date), q.arg(filter.Cursor.CreatedAt), q.arg(filter.Cursor.ID),
+		))
+	}
+
+	// 1件多く取得して次のページの有無を判定する
 	rows, err := s.db.Query(r.Context(), `
-		SELECT
-			id, user_id, content, date, weather, is_public,
-			image_url, image_name, audio_url, audio_name,
-			events, emotions, good_things, reflections, gratitude,
-			tomorrow_goals, tomorrow_looking_forward, learnings,
-			health_habits, today_in_one_word,
-			created_at, updated_at
+		SELECT `+diaryColumns+`
 		FROM diary_entries
-		WHERE user_id = $1
-		ORDER BY date DESC, created_at DESC
-	`, userID)
+		WHERE `+q.whereClause()+`
+		ORDER BY date DESC, created_at DESC, id DESC
+		LIMIT `+q.arg(filter.Limit+1), q.args...)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "日記一覧の取得に失敗しました")
 		return
 	}
 	defer rows.Close()
 
-	entries := make([]model.DiaryEntry, 0)
+	entries := make([]model.DiaryEntry, 0, filter.Limit)
 	for rows.Next() {
 		entry, err := scanDiaryEntry(rows)
 		if err != nil {
@@ -285,8 +430,66 @@ func (s *Server) handleListMyDiaries(w http.ResponseWriter, r *http.Request) {
 		}
 		entries = append(entries, entry)
 	}
+	if err := rows.Err(); err != nil {
+		writeError(w, http.StatusInternalServerError, "日記一覧の取得に失敗しました")
+		return
+	}
 
-	writeData(w, http.StatusOK, entries)
+	var nextCursor string
+	if len(entries) > filter.Limit {
+		entries = entries[:filter.Limit]
+		last := entries[len(entries)-1]
+		nextCursor = encodeCursor(diaryCursor{Date: last.Date, CreatedAt: last.CreatedAt, ID: last.ID})
+	}
+
+	writePage(w, entries, nextCursor)
+}
+
+// handleGetDiary は日記を1件返す。所有者には DiaryEntry を、それ以外には公開中の日記のみ PublicDiaryEntry を返す。
+func (s *Server) handleGetDiary(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if _, err := uuid.Parse(id); err != nil {
+		writeError(w, http.StatusBadRequest, "日記IDが不正です")
+		return
+	}
+
+	if userID, ok := getUserID(r.Context()); ok {
+		entry, err := scanDiaryEntry(s.db.QueryRow(r.Context(), `
+			SELECT `+diaryColumns+`
+			FROM diary_entries
+			WHERE id = $1 AND user_id = $2 AND deleted_at IS NULL AND NOT is_draft
+		`, id, userID))
+		if err == nil {
+			if s.cfg.EmailVerificationPolicy == config.EmailPolicyRequired && !isEmailVerified(r.Context()) {
+				writeError(w, http.StatusForbidden, "メールアドレスの確認が完了していません")
+				return
+			}
+			writeDiary(w, http.StatusOK, entry)
+			return
+		}
+		if !errors.Is(err, pgx.ErrNoRows) {
+			writeError(w, http.StatusInternalServerError, "日記の取得に失敗しました")
+			return
+		}
+	}
+
+	entry, err := scanPublicDiaryEntry(s.db.QueryRow(r.Context(), `
+		SELECT `+publicDiaryColumns+`
+		FROM diary_entries de
+		JOIN users u ON u.id = de.user_id
+		WHERE de.id = $1 AND de.is_public = TRUE AND de.deleted_at IS NULL AND NOT de.is_draft
+			AND u.delete_after IS NULL
+	`, id))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "日記が見つかりません")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "日記の取得に失敗しました")
+		return
+	}
+
+	writeData(w, http.StatusOK, entry)
 }
 
 func (s *Server) handleCreateDiary(w http.ResponseWriter, r *http.Request) {
@@ -306,84 +509,34 @@ func (s *Server) handleCreateDiary(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	if payload.IsPublic && !s.canPublish(r.Context()) {
+		writeError(w, http.StatusForbidden, errPublishUnverified)
+		return
+	}
 
-	var entry model.DiaryEntry
-	var entryDate pgtype.Date
-	err := s.db.QueryRow(r.Context(), `
-		INSERT INTO diary_entries (
-			user_id, content, date, weather, is_public,
-			image_url, image_name, audio_url, audio_name,
-			events, emotions, good_things, reflections,
-			gratitude, tomorrow_goals, tomorrow_looking_forward,
-			learnings, health_habits, today_in_one_word
-		)
-		VALUES (
-			$1, $2, $3, $4, $5,
-			$6, $7, $8, $9,
-			$10, $11, $12, $13,
-			$14, $15, $16,
-			$17, $18, $19
-		)
-		RETURNING
-			id, user_id, content, date, weather, is_public,
-			image_url, image_name, audio_url, audio_name,
-			events, emotions, good_things, reflections, gratitude,
-			tomorrow_goals, tomorrow_looking_forward, learnings,
-			health_habits, today_in_one_word,
-			created_at, updated_at
-	`,
-		userID,
-		emptyToNil(payload.Content),
-		payload.Date,
-		emptyToNil(payload.Weather),
-		payload.IsPublic,
-		emptyToNil(payload.ImageURL),
-		emptyToNil(payload.ImageName),
-		emptyToNil(payload.AudioURL),
-		emptyToNil(payload.AudioName),
-		emptyToNil(payload.Events),
-		emptyToNil(payload.Emotions),
-		emptyToNil(payload.GoodThings),
-		emptyToNil(payload.Reflections),
-		emptyToNil(payload.Gratitude),
-		emptyToNil(payload.TomorrowGoals),
-		emptyToNil(payload.TomorrowLookingForward),
-		emptyToNil(payload.Learnings),
-		emptyToNil(payload.HealthHabits),
-		emptyToNil(payload.TodayInOneWord),
-	).Scan(
-		&entry.ID,
-		&entry.UserID,
-		newNullableString(&entry.Content),
-		&entryDate,
-		newNullableString(&entry.Weather),
-		&entry.IsPublic,
-		newNullableString(&entry.ImageURL),
-		newNullableString(&entry.ImageName),
-		newNullableString(&entry.AudioURL),
-		newNullableString(&entry.AudioName),
-		newNullableString(&entry.Events),
-		newNullableString(&entry.Emotions),
-		newNullableString(&entry.GoodThings),
-		newNullableString(&entry.Reflections),
-		newNullableString(&entry.Gratitude),
-		newNullableString(&entry.TomorrowGoals),
-		newNullableString(&entry.TomorrowLookingForward),
-		newNullableString(&entry.Learnings),
-		newNullableString(&entry.HealthHabits),
-		newNullableString(&entry.TodayInOneWord),
-		&entry.CreatedAt,
-		&entry.UpdatedAt,
-	)
+	ctx := r.Context()
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "日記の保存に失敗しました")
+		return
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	entry, err := insertDiaryEntry(ctx, tx, userID, payload, false)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "日記の保存に失敗しました")
 		return
 	}
-	if entryDate.Valid {
-		entry.Date = entryDate.Time.Format("2006-01-02")
+	if entry.Tags, err = setDiaryTags(ctx, tx, userID, entry.ID, payload.Tags); err != nil {
+		writeError(w, http.StatusInternalServerError, "日記の保存に失敗しました")
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, "日記の保存に失敗しました")
+		return
 	}
 
-	writeData(w, http.StatusCreated, entry)
+	writeDiary(w, http.StatusCreated, entry)
 }
 
 func (s *Server) handleUpdateDiary(w http.ResponseWriter, r *http.Request) {
@@ -408,13 +561,20 @@ func (s *Server) handleUpdateDiary(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	if payload.IsPublic && !s.canPublish(r.Context()) {
+		writeError(w, http.StatusForbidden, errPublishUnverified)
+		return
+	}
 
-	var ownerID string
-	err := s.db.QueryRow(r.Context(), `
-		SELECT user_id
-		FROM diary_entries
-		WHERE id = $1
-	`, id).Scan(&ownerID)
+	ctx := r.Context()
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "日記更新に失敗しました")
+		return
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	current, err := lockDiary(ctx, tx, id)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			writeError(w, http.StatusNotFound, "日記が見つかりません")
@@ -423,14 +583,92 @@ func (s *Server) handleUpdateDiary(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, "日記更新に失敗しました")
 		return
 	}
-	if ownerID != userID {
+	if current.UserID != userID {
 		writeError(w, http.StatusForbidden, "この日記を変更する権限がありません")
 		return
 	}
+	if !ifMatch(r, diaryETag(current.Version)) {
+		writeDiaryPreconditionFailed(w, current)
+		return
+	}
+
+	// PATCH と同様、内容が変わらない場合は版を記録せず updated_at と ETag も変えない。tags の省略は変更なしを意味する
+	original := payloadFromEntry(current)
+	tagsChanged := payload.Tags != nil && !sameTags(original.Tags, payload.Tags)
+	if diaryFieldsEqual(original, payload) && !tagsChanged {
+		writeDiary(w, http.StatusOK, current)
+		return
+	}
+
+	if err := recordDiaryRevision(ctx, tx, current, s.cfg.DiaryRevisionLimit); err != nil {
+		writeError(w, http.StatusInternalServerError, "日記更新に失敗しました")
+		return
+	}
+	entry, err := updateDiaryEntry(ctx, tx, id, payload)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "日記更新に失敗しました")
+		return
+	}
+	if tagsChanged {
+		if entry.Tags, err = setDiaryTags(ctx, tx, userID, entry.ID, payload.Tags); err != nil {
+			writeError(w, http.StatusInternalServerError, "日記更新に失敗しました")
+			return
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, "日記更新に失敗しました")
+		return
+	}
+
+	writeDiary(w, http.StatusOK, entry)
+}
+
+// insertDiaryEntry は日記を作成する。タグは setDiaryTags で別に設定する。
+func insertDiaryEntry(ctx context.Context, q querier, userID string, payload diaryCreatePayload, isDraft bool) (model.DiaryEntry, error) {
+	return scanDiaryEntry(q.QueryRow(ctx, `
+		INSERT INTO diary_entries (
+			user_id, content, date, weather, is_public,
+			image_url, image_name, audio_url, audio_name,
+			events, emotions, good_things, reflections,
+			gratitude, tomorrow_goals, tomorrow_looking_forward,
+			learnings, health_habits, today_in_one_word,
+			is_draft
+		)
+		VALUES (
+			$1, $2, $3, $4, $5,
+			$6, $7, $8, $9,
+			$10, $11, $12, $13,
+			$14, $15, $16,
+			$17, $18, $19,
+			$20
+		)
+		RETURNING `+diaryColumns,
+		userID,
+		emptyToNil(payload.Content),
+		payload.Date,
+		emptyToNil(payload.Weather),
+		payload.IsPublic,
+		emptyToNil(payload.ImageURL),
+		emptyToNil(payload.ImageName),
+		emptyToNil(payload.AudioURL),
+		emptyToNil(payload.AudioName),
+		emptyToNil(payload.Events),
+		emptyToNil(payload.Emotions),
+		emptyToNil(payload.GoodThings),
+		emptyToNil(payload.Reflections),
+		emptyToNil(payload.Gratitude),
+		emptyToNil(payload.TomorrowGoals),
+		emptyToNil(payload.TomorrowLookingForward),
+		emptyToNil(payload.Learnings),
+		emptyToNil(payload.HealthHabits),
+		emptyToNil(payload.TodayInOneWord),
+		isDraft,
+	))
+}
 
-	var entry model.DiaryEntry
-	var entryDate pgtype.Date
-	err = s.db.QueryRow(r.Context(), `
+// updateDiaryEntry は日記の本文・日付・公開状態などを payload の内容で置き換える。タグは変更しない。
+func updateDiaryEntry(ctx context.Context, q querier, id string, payload diaryCreatePayload) (model.DiaryEntry, error) {
+	return scanDiaryEntry(q.QueryRow(ctx, `
 		UPDATE diary_entries
 		SET
 			content = $1,
@@ -451,16 +689,10 @@ func (s *Server) handleUpdateDiary(w http.ResponseWriter, r *http.Request) {
 			learnings = $16,
 			health_habits = $17,
 			today_in_one_word = $18,
-			updated_at = NOW()
+			updated_at = NOW(),
+			version = version + 1
 		WHERE id = $19
-		RETURNING
-			id, user_id, content, date, weather, is_public,
-			image_url, image_name, audio_url, audio_name,
-			events, emotions, good_things, reflections, gratitude,
-			tomorrow_goals, tomorrow_looking_forward, learnings,
-			health_habits, today_in_one_word,
-			created_at, updated_at
-	`,
+		RETURNING `+diaryColumns,
 		emptyToNil(payload.Content),
 		payload.Date,
 		emptyToNil(payload.Weather),
@@ -480,45 +712,10 @@ func (s *Server) handleUpdateDiary(w http.ResponseWriter, r *http.Request) {
 		emptyToNil(payload.HealthHabits),
 		emptyToNil(payload.TodayInOneWord),
 		id,
-	).Scan(
-		&entry.ID,
-		&entry.UserID,
-		newNullableString(&entry.Content),
-		&entryDate,
-		newNullableString(&entry.Weather),
-		&entry.IsPublic,
-		newNullableString(&entry.ImageURL),
-		newNullableString(&entry.ImageName),
-		newNullableString(&entry.AudioURL),
-		newNullableString(&entry.AudioName),
-		newNullableString(&entry.Events),
-		newNullableString(&entry.Emotions),
-		newNullableString(&entry.GoodThings),
-		newNullableString(&entry.Reflections),
-		newNullableString(&entry.Gratitude),
-		newNullableString(&entry.TomorrowGoals),
-		newNullableString(&entry.TomorrowLookingForward),
-		newNullableString(&entry.Learnings),
-		newNullableString(&entry.HealthHabits),
-		newNullableString(&entry.TodayInOneWord),
-		&entry.CreatedAt,
-		&entry.UpdatedAt,
-	)
-	if err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
-			writeError(w, http.StatusNotFound, "日記が見つかりません")
-			return
-		}
-		writeError(w, http.StatusInternalServerError, "日記更新に失敗しました")
-		return
-	}
-	if entryDate.Valid {
-		entry.Date = entryDate.Time.Format("2006-01-02")
-	}
-
-	writeData(w, http.StatusOK, entry)
+	))
 }
 
+// handleDeleteDiary は日記をゴミ箱に移動する。添付ファイルは DiaryTrashRetentionDays 日後の完全削除まで残す。
 func (s *Server) handleDeleteDiary(w http.ResponseWriter, r *http.Request) {
 	userID, ok := getUserID(r.Context())
 	if !ok {
@@ -532,15 +729,15 @@ func (s *Server) handleDeleteDiary(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var imageName *string
-	var audioName *string
-	var tempImage pgtype.Text
-	var tempAudio pgtype.Text
-	err := s.db.QueryRow(r.Context(), `
-		SELECT image_name, audio_name
-		FROM diary_entries
-		WHERE id = $1 AND user_id = $2
-	`, id, userID).Scan(&tempImage, &tempAudio)
+	ctx := r.Context()
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "日記削除に失敗しました")
+		return
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	current, err := lockDiary(ctx, tx, id)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			writeError(w, http.StatusNotFound, "日記が見つかりません")
@@ -549,34 +746,34 @@ func (s *Server) handleDeleteDiary(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, "日記削除に失敗しました")
 		return
 	}
-	if tempImage.Valid {
-		imageName = &tempImage.String
+	if current.UserID != userID {
+		writeError(w, http.StatusNotFound, "日記が見つかりません")
+		return
 	}
-	if tempAudio.Valid {
-		audioName = &tempAudio.String
+	if !ifMatch(r, diaryETag(current.Version)) {
+		writeDiaryPreconditionFailed(w, current)
+		return
 	}
 
-	cmd, err := s.db.Exec(r.Context(), `
-		DELETE FROM diary_entries
-		WHERE id = $1 AND user_id = $2
-	`, id, userID)
-	if err != nil {
+	var deletedAt time.Time
+	if err := tx.QueryRow(ctx, `
+		UPDATE diary_entries
+		SET deleted_at = NOW(), version = version + 1
+		WHERE id = $1
+		RETURNING deleted_at
+	`, id).Scan(&deletedAt); err != nil {
 		writeError(w, http.StatusInternalServerError, "日記削除に失敗しました")
 		return
 	}
-	if cmd.RowsAffected() == 0 {
-		writeError(w, http.StatusNotFound, "日記が見つかりません")
+	if err := tx.Commit(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, "日記削除に失敗しました")
 		return
 	}
 
-	if imageName != nil {
-		_ = os.Remove(filepath.Join(s.cfg.UploadDir, "images", *imageName))
-	}
-	if audioName != nil {
-		_ = os.Remove(filepath.Join(s.cfg.UploadDir, "audio", *audioName))
-	}
-
-	writeData(w, http.StatusOK, map[string]string{"message": "日記を削除しました"})
+	writeData(w, http.StatusOK, map[string]any{
+		"message":  "日記をゴミ箱に移動しました",
+		"purge_at": deletedAt.AddDate(0, 0, s.cfg.DiaryTrashRetentionDays),
+	})
 }
 
 func (s *Server) handleUpdateVisibility(w http.ResponseWriter, r *http.Request) {
@@ -599,55 +796,141 @@ func (s *Server) handleUpdateVisibility(w http.ResponseWriter, r *http.Request)
 		writeError(w, http.StatusBadRequest, "不正なリクエストです")
 		return
 	}
+	if payload.IsPublic && !s.canPublish(r.Context()) {
+		writeError(w, http.StatusForbidden, errPublishUnverified)
+		return
+	}
+
+	ctx := r.Context()
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "公開設定の更新に失敗しました")
+		return
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	current, err := lockDiary(ctx, tx, id)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		writeError(w, http.StatusInternalServerError, "公開設定の更新に失敗しました")
+		return
+	}
+	if err != nil || current.UserID != userID {
+		writeError(w, http.StatusForbidden, "この日記を変更する権限がありません")
+		return
+	}
+	if !ifMatch(r, diaryETag(current.Version)) {
+		writeDiaryPreconditionFailed(w, current)
+		return
+	}
 
 	var response struct {
 		ID        string    `json:"id"`
 		IsPublic  bool      `json:"is_public"`
 		UpdatedAt time.Time `json:"updated_at"`
 	}
-	err := s.db.QueryRow(r.Context(), `
+	if current.IsPublic == payload.IsPublic {
+		response.ID, response.IsPublic, response.UpdatedAt = current.ID, current.IsPublic, current.UpdatedAt
+		w.Header().Set("ETag", diaryETag(current.Version))
+		writeData(w, http.StatusOK, response)
+		return
+	}
+
+	if err := recordDiaryRevision(ctx, tx, current, s.cfg.DiaryRevisionLimit); err != nil {
+		writeError(w, http.StatusInternalServerError, "公開設定の更新に失敗しました")
+		return
+	}
+	var version int64
+	err = tx.QueryRow(ctx, `
 		UPDATE diary_entries
-		SET is_public = $1, updated_at = NOW()
-		WHERE id = $2 AND user_id = $3
-		RETURNING id, is_public, updated_at
-	`, payload.IsPublic, id, userID).Scan(&response.ID, &response.IsPublic, &response.UpdatedAt)
+		SET is_public = $1, updated_at = NOW(), version = version + 1
+		WHERE id = $2
+		RETURNING id, is_public, updated_at, version
+	`, payload.IsPublic, id).Scan(&response.ID, &response.IsPublic, &response.UpdatedAt, &version)
 	if err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
-			writeError(w, http.StatusForbidden, "この日記を変更する権限がありません")
-			return
-		}
+		writeError(w, http.StatusInternalServerError, "公開設定の更新に失敗しました")
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
 		writeError(w, http.StatusInternalServerError, "公開設定の更新に失敗しました")
 		return
 	}
 
+	w.Header().Set("ETag", diaryETag(version))
 	writeData(w, http.StatusOK, response)
 }
 
+// handleListPublicDiaries は公開日記を新しい順に返す。
 func (s *Server) handleListPublicDiaries(w http.ResponseWriter, r *http.Request) {
+	s.listPublicDiaries(w, r, "")
+}
+
+// handleListAuthorPublicDiaries は1人の著者の公開日記を新しい順に返す。
+func (s *Server) handleListAuthorPublicDiaries(w http.ResponseWriter, r *http.Request) {
+	authorID := chi.URLParam(r, "id")
+	if _, err := uuid.Parse(authorID); err != nil {
+		writeError(w, http.StatusBadRequest, "ユーザーIDが不正です")
+		return
+	}
+
+	var exists bool
+	if err := s.db.QueryRow(r.Context(), `
+		SELECT EXISTS (SELECT 1 FROM users WHERE id = $1 AND delete_after IS NULL)
+	`, authorID).Scan(&exists); err != nil {
+		writeError(w, http.StatusInternalServerError, "公開日記の取得に失敗しました")
+		return
+	}
+	if !exists {
+		writeError(w, http.StatusNotFound, "ユーザーが見つかりません")
+		return
+	}
+
+	s.listPublicDiaries(w, r, authorID)
+}
+
+// listPublicDiaries は公開日記を (created_at, id) の降順でページングして返す。authorID が空なら全著者が対象。
+func (s *Server) listPublicDiaries(w http.ResponseWriter, r *http.Request, authorID string) {
+	filter, err := parseDiaryFilter(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// 公開日記の一覧では公開状態での絞り込みは意味を持たず、タグは本人にしか見えない
+	filter.IsPublic = nil
+	filter.Tags = nil
+
+	var q queryBuilder
+	q.where("de.is_public = TRUE")
+	q.where("de.deleted_at IS NULL AND NOT de.is_draft")
+	q.where("u.delete_after IS NULL")
+	if authorID != "" {
+		q.where("de.user_id = " + q.arg(authorID))
+	}
+	q.applyDiaryFilter(filter, "de")
+	if filter.Cursor != nil {
+		if filter.Cursor.Date != "" {
+			writeError(w, http.StatusBadRequest, "カーソルが不正です")
+			return
+		}
+		q.where(fmt.Sprintf(
+			"(de.created_at, de.id) < (%s, %s::uuid)",
+			q.arg(filter.Cursor.CreatedAt), q.arg(filter.Cursor.ID),
+		))
+	}
+
 	rows, err := s.db.Query(r.Context(), `
-		SELECT
-			de.id, de.content, de.date, de.weather,
-			de.image_url, de.audio_url,
-			de.events, de.emotions, de.good_things,
-			de.reflections, de.gratitude, de.tomorrow_goals,
-			de.tomorrow_looking_forward, de.learnings,
-			de.health_habits, de.today_in_one_word,
-			de.created_at,
-			u.display_name AS author_name,
-			u.profile_image_url AS author_photo
+		SELECT `+publicDiaryColumns+`
 		FROM diary_entries de
 		JOIN users u ON u.id = de.user_id
-		WHERE de.is_public = TRUE
-		ORDER BY de.created_at DESC
-		LIMIT 50
-	`)
+		WHERE `+q.whereClause()+`
+		ORDER BY de.created_at DESC, de.id DESC
+		LIMIT `+q.arg(filter.Limit+1), q.args...)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "公開日記の取得に失敗しました")
 		return
 	}
 	defer rows.Close()
 
-	entries := make([]model.PublicDiaryEntry, 0)
+	entries := make([]model.PublicDiaryEntry, 0, filter.Limit)
 	for rows.Next() {
 		entry, err := scanPublicDiaryEntry(rows)
 		if err != nil {
@@ -656,8 +939,19 @@ func (s *Server) handleListPublicDiaries(w http.ResponseWriter, r *http.Request)
 		}
 		entries = append(entries, entry)
 	}
+	if err := rows.Err(); err != nil {
+		writeError(w, http.StatusInternalServerError, "公開日記の取得に失敗しました")
+		return
+	}
+
+	var nextCursor string
+	if len(entries) > filter.Limit {
+		entries = entries[:filter.Limit]
+		last := entries[len(entries)-1]
+		nextCursor = encodeCursor(diaryCursor{CreatedAt: last.CreatedAt, ID: last.ID})
+	}
 
-	writeData(w, http.StatusOK, entries)
+	writePage(w, entries, nextCursor)
 }
 
 func (s *Server) handleUploadImage(w http.ResponseWriter, r *http.Request) {
@@ -683,6 +977,11 @@ func (s *Server) handleUploadImage(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	if err := s.recordUpload(r.Context(), "images", name); err != nil {
+		_ = os.Remove(filepath.Join(s.cfg.UploadDir, "images", name))
+		writeError(w, http.StatusInternalServerError, "ファイル保存に失敗しました")
+		return
+	}
 
 	writeData(w, http.StatusCreated, map[string]string{
 		"url":  "/api/files/images/" + name,
@@ -714,6 +1013,11 @@ func (s *Server) handleUploadAudio(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	if err := s.recordUpload(r.Context(), "audio", name); err != nil {
+		_ = os.Remove(filepath.Join(s.cfg.UploadDir, "audio", name))
+		writeError(w, http.StatusInternalServerError, "ファイル保存に失敗しました")
+		return
+	}
 
 	writeData(w, http.StatusCreated, map[string]string{
 		"url":  "/api/files/audio/" + name,
@@ -722,25 +1026,73 @@ func (s *Server) handleUploadAudio(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// recordUpload はアップロードしたファイルの所有者を記録する。
+func (s *Server) recordUpload(ctx context.Context, dir, name string) error {
+	userID, ok := getUserID(ctx)
+	if !ok {
+		return errors.New("missing user")
+	}
+	_, err := s.db.Exec(ctx, `
+		INSERT INTO uploaded_files (name, dir, user_id)
+		VALUES ($1, $2, $3)
+	`, name, dir, userID)
+	return err
+}
+
+// handleDeleteFile は自分がアップロードしたファイルを削除する。ゴミ箱や下書きを含め、
+// いずれかの日記が参照しているファイルは日記の完全削除時に消すため、ここでは削除しない。
 func (s *Server) handleDeleteFile(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserID(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "認証トークンが無効です")
+		return
+	}
+
 	filename := filepath.Base(chi.URLParam(r, "filename"))
-	if filename == "" {
+	if filename == "" || filename == "." || filename == ".." || filename == string(filepath.Separator) {
 		writeError(w, http.StatusBadRequest, "ファイル名が不正です")
 		return
 	}
 
-	imagePath := filepath.Join(s.cfg.UploadDir, "images", filename)
-	audioPath := filepath.Join(s.cfg.UploadDir, "audio", filename)
-	if err := os.Remove(imagePath); err == nil {
-		writeData(w, http.StatusOK, map[string]string{"message": "ファイルを削除しました"})
+	ctx := r.Context()
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "ファイル削除に失敗しました")
+		return
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	var dir string
+	var referenced bool
+	err = tx.QueryRow(ctx, `
+		SELECT dir, EXISTS (SELECT 1 FROM diary_entries WHERE image_name = $1 OR audio_name = $1)
+		FROM uploaded_files
+		WHERE name = $1 AND user_id = $2
+		FOR UPDATE
+	`, filename, userID).Scan(&dir, &referenced)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "ファイルが見つかりません")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "ファイル削除に失敗しました")
+		return
+	}
+	if referenced {
+		writeError(w, http.StatusConflict, "日記で使用中のファイルは削除できません")
+		return
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM uploaded_files WHERE name = $1`, filename); err != nil {
+		writeError(w, http.StatusInternalServerError, "ファイル削除に失敗しました")
 		return
 	}
-	if err := os.Remove(audioPath); err == nil {
-		writeData(w, http.StatusOK, map[string]string{"message": "ファイルを削除しました"})
+	if err := tx.Commit(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, "ファイル削除に失敗しました")
 		return
 	}
 
-	writeError(w, http.StatusNotFound, "ファイルが見つかりません")
+	s.removeUploads([]uploadedFile{{dir: dir, name: filename}})
+	writeData(w, http.StatusOK, map[string]string{"message": "ファイルを削除しました"})
 }
 
 func (s *Server) serveImage(w http.ResponseWriter, r *http.Request) {
@@ -755,29 +1107,73 @@ func (s *Server) serveAudio(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) authMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		authHeader := strings.TrimSpace(r.Header.Get("Authorization"))
-		if authHeader == "" || !strings.HasPrefix(authHeader, "Bearer ") {
+		token, ok := s.requestToken(r)
+		if !ok {
 			writeError(w, http.StatusUnauthorized, "認証トークンが無効です")
 			return
 		}
+		if strings.HasPrefix(token, auth.PersonalAccessTokenPrefix) {
+			s.authenticateAccessToken(w, r, next, token)
+			return
+		}
 
-		token := strings.TrimSpace(strings.TrimPrefix(authHeader, "Bearer "))
-		claims, err := auth.ParseToken(token, s.cfg.JWTSecret)
+		claims, err := auth.ParseToken(token, s.keys)
 		if err != nil {
 			writeError(w, http.StatusUnauthorized, "認証トークンが無効です")
 			return
 		}
+		if _, err := uuid.Parse(claims.SessionID); err != nil {
+			writeError(w, http.StatusUnauthorized, "認証トークンが無効です")
+			return
+		}
+
+		state, err := s.loadSession(r.Context(), claims.SessionID, claims.UserID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "認証処理に失敗しました")
+			return
+		}
+		if !state.active {
+			writeError(w, http.StatusUnauthorized, "セッションが無効です。再度ログインしてください")
+			return
+		}
 
 		ctx := context.WithValue(r.Context(), userIDKey, claims.UserID)
+		ctx = context.WithValue(ctx, sessionIDKey, claims.SessionID)
+		ctx = context.WithValue(ctx, emailVerifiedKey, state.emailVerified)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+// optionalAuth はトークンがあれば requireScope(scope) と同じく認証し、なければ未ログインのまま next を呼ぶ。
+// 無効なトークンは未ログイン扱いにせず 401 を返す。
+func (s *Server) optionalAuth(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		authenticated := s.requireScope(scope)(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, ok := s.requestToken(r); !ok && r.Header.Get("Authorization") == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			authenticated.ServeHTTP(w, r)
+		})
+	}
+}
+
 func getUserID(ctx context.Context) (string, bool) {
 	userID, ok := ctx.Value(userIDKey).(string)
 	return userID, ok
 }
 
+func getSessionID(ctx context.Context) (string, bool) {
+	sessionID, ok := ctx.Value(sessionIDKey).(string)
+	return sessionID, ok
+}
+
+func isEmailVerified(ctx context.Context) bool {
+	verified, _ := ctx.Value(emailVerifiedKey).(bool)
+	return verified
+}
+
 func writeData(w http.ResponseWriter, status int, data any) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
@@ -837,10 +1233,57 @@ func emptyToNil(value *string) *string {
 	return &trimmed
 }
 
-func scanDiaryEntry(row pgx.Row) (model.DiaryEntry, error) {
+// diaryColumns は scanDiaryEntry が読み取る列。tags の副問い合わせのため diary_entries に別名を付けずに使う。
+const diaryColumns = `
+	id, user_id, content, date, weather, is_public,
+	image_url, image_name, audio_url, audio_name,
+	events, emotions, good_things, reflections, gratitude,
+	tomorrow_goals, tomorrow_looking_forward, learnings,
+	health_habits, today_in_one_word,
+	COALESCE((
+		SELECT array_agg(t.name ORDER BY t.name COLLATE "C")
+		FROM diary_entry_tags dt
+		JOIN tags t ON t.id = dt.tag_id
+		WHERE dt.diary_entry_id = diary_entries.id
+	), '{}') AS tags,
+	is_draft, created_at, updated_at, version`
+
+// publicDiaryColumns は scanPublicDiaryEntry が読み取る列。diary_entries de と users u の結合を前提とする。
+const publicDiaryColumns = `
+	de.id, de.content, de.date, de.weather,
+	de.image_url, de.audio_url,
+	de.events, de.emotions, de.good_things,
+	de.reflections, de.gratitude, de.tomorrow_goals,
+	de.tomorrow_looking_forward, de.learnings,
+	de.health_habits, de.today_in_one_word,
+	de.created_at,
+	u.id AS author_id,
+	u.display_name AS author_name,
+	u.profile_image_url AS author_photo`
+
+const userColumns = `id, email, display_name, profile_image_url, email_verified_at, totp_enabled_at IS NOT NULL, created_at`
+
+// scanUser は userColumns の順で User を読み取る。extra には続けて SELECT した列の格納先を渡す。
+func scanUser(row pgx.Row, extra ...any) (model.User, error) {
+	user := model.User{}
+	dest := []any{
+		&user.ID,
+		&user.Email,
+		&user.DisplayName,
+		newNullableString(&user.ProfileImageURL),
+		&user.EmailVerifiedAt,
+		&user.TwoFactorEnabled,
+		&user.CreatedAt,
+	}
+	err := row.Scan(append(dest, extra...)...)
+	return user, err
+}
+
+// scanDiaryEntry は diaryColumns の順で DiaryEntry を読み取る。extra には続けて SELECT した列の格納先を渡す。
+func scanDiaryEntry(row pgx.Row, extra ...any) (model.DiaryEntry, error) {
 	entry := model.DiaryEntry{}
 	var date pgtype.Date
-	err := row.Scan(
+	dest := []any{
 		&entry.ID,
 		&entry.UserID,
 		newNullableString(&entry.Content),
@@ -861,9 +1304,13 @@ func scanDiaryEntry(row pgx.Row) (model.DiaryEntry, error) {
 		newNullableString(&entry.Learnings),
 		newNullableString(&entry.HealthHabits),
 		newNullableString(&entry.TodayInOneWord),
+		&entry.Tags,
+		&entry.IsDraft,
 		&entry.CreatedAt,
 		&entry.UpdatedAt,
-	)
+		&entry.Version,
+	}
+	err := row.Scan(append(dest, extra...)...)
 	if err == nil && date.Valid {
 		entry.Date = date.Time.Format("2006-01-02")
 	}
@@ -891,6 +1338,7 @@ func scanPublicDiaryEntry(row pgx.Row) (model.PublicDiaryEntry, error) {
 		newNullableString(&entry.HealthHabits),
 		newNullableString(&entry.TodayInOneWord),
 		&entry.CreatedAt,
+		&entry.AuthorID,
 		&entry.AuthorName,
 		newNullableString(&entry.AuthorPhoto),
 	)
@@ -914,6 +1362,11 @@ func validateDiaryPayload(payload diaryCreatePayload) error {
 	if err := validation.ValidateWeather(payload.Weather); err != nil {
 		return err
 	}
+	for _, name := range []*string{payload.ImageName, payload.AudioName} {
+		if err := validation.ValidateFileName(name); err != nil {
+			return err
+		}
+	}
 	if err := validation.ValidateDiaryFilled(map[string]*string{
 		"content":                  payload.Content,
 		"events":                   payload.Events,
@@ -929,6 +1382,9 @@ func validateDiaryPayload(payload diaryCreatePayload) error {
 	}); err != nil {
 		return err
 	}
+	if _, err := validation.NormalizeTags(payload.Tags); err != nil {
+		return err
+	}
 	return nil
 }
 
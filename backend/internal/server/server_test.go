@@ -1,6 +1,12 @@
 package server
 
-import "testing"
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ymmtyamaterous/diary-oc-api/internal/config"
+)
 
 func strPtr(v string) *string {
 	return &v
@@ -61,3 +67,55 @@ func TestValidateDiaryPayload(t *testing.T) {
 		t.Fatal("empty diary body should fail")
 	}
 }
+
+func TestGetDiaryAuthentication(t *testing.T) {
+	s := New(config.Config{JWTSecret: "secret"}, nil, nil)
+
+	tests := []struct {
+		name          string
+		path          string
+		authorization string
+		want          int
+	}{
+		{name: "anonymous invalid id", path: "/api/diaries/not-a-uuid", want: http.StatusBadRequest},
+		{name: "invalid token is not treated as anonymous", path: "/api/diaries/8b6d3f0e-4a51-4a8f-9d8e-3c0f5f0b6a11", authorization: "Bearer broken", want: http.StatusUnauthorized},
+		{name: "non-bearer authorization", path: "/api/diaries/8b6d3f0e-4a51-4a8f-9d8e-3c0f5f0b6a11", authorization: "Basic dXNlcjpwYXNz", want: http.StatusUnauthorized},
+		// ゴミ箱の一覧は日記IDとして扱わず、認証が必要
+		{name: "trash requires authentication", path: "/api/diaries/trash", want: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rec := httptest.NewRecorder()
+			s.Router().ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestPublicDiaryListValidation(t *testing.T) {
+	s := New(config.Config{}, nil, nil)
+	dateCursor := encodeCursor(diaryCursor{Date: "2026-10-01", ID: "8b6d3f0e-4a51-4a8f-9d8e-3c0f5f0b6a11"})
+
+	for _, path := range []string{
+		"/api/users/not-a-uuid/diaries/public",
+		"/api/diaries/public?weather=typhoon",
+		"/api/diaries/public?from=2026-02-01&to=2026-01-01",
+		// 自分の日記一覧(日付順)のカーソルは公開日記一覧(作成日時順)では使えない
+		"/api/diaries/public?cursor=" + dateCursor,
+	} {
+		t.Run(path, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			s.Router().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+			}
+		})
+	}
+}
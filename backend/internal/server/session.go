@@ -0,0 +1,409 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+
+	"github.com/ymmtyamaterous/diary-oc-api/internal/auth"
+	"github.com/ymmtyamaterous/diary-oc-api/internal/model"
+)
+
+// querier は *pgxpool.Pool と pgx.Tx の共通インターフェース。
+type querier interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+type refreshPayload struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type tokenResponse struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	CSRFToken    string `json:"csrf_token,omitempty"`
+}
+
+// startSession はログイン・登録時にセッションを作成し、アクセストークンと
+// リフレッシュトークンの組を発行する。
+func (s *Server) startSession(r *http.Request, user model.User) (authResponse, error) {
+	ctx := r.Context()
+	refreshToken, refreshHash, err := auth.GenerateOpaqueToken()
+	if err != nil {
+		return authResponse{}, err
+	}
+
+	var sessionID string
+	err = s.db.QueryRow(ctx, `
+		WITH new_session AS (
+			INSERT INTO sessions (user_id, expires_at, user_agent, ip_address)
+			VALUES ($1, $2, $3, $4)
+			RETURNING id
+		)
+		INSERT INTO refresh_tokens (session_id, token_hash)
+		SELECT id, $5 FROM new_session
+		RETURNING session_id
+	`,
+		user.ID,
+		time.Now().Add(s.refreshTokenTTL()),
+		emptyToNil(truncatePtr(r.UserAgent(), 500)),
+		emptyToNil(truncatePtr(s.clientIP(r), 45)),
+		refreshHash,
+	).Scan(&sessionID)
+	if err != nil {
+		return authResponse{}, err
+	}
+
+	token, err := auth.GenerateToken(user.ID, user.Email, sessionID, s.keys, s.accessTokenTTL())
+	if err != nil {
+		return authResponse{}, err
+	}
+
+	return authResponse{Token: token, RefreshToken: refreshToken, User: user}, nil
+}
+
+func (s *Server) handleRefresh(w http.ResponseWriter, r *http.Request) {
+	// Cookie 認証ではリフレッシュトークンを Cookie で受け取るため、本文は空でもよい
+	var payload refreshPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, "不正なリクエストです")
+		return
+	}
+	presented := strings.TrimSpace(payload.RefreshToken)
+	if presented == "" {
+		presented = s.refreshTokenCookie(r)
+	}
+	if presented == "" {
+		writeError(w, http.StatusBadRequest, "リフレッシュトークンは必須です")
+		return
+	}
+
+	ctx := r.Context()
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "トークン更新に失敗しました")
+		return
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	var tokenID, sessionID, userID, email string
+	var usedAt, revokedAt pgtype.Timestamptz
+	var expiresAt time.Time
+	err = tx.QueryRow(ctx, `
+		SELECT rt.id, rt.used_at, s.id, s.revoked_at, s.expires_at, u.id, u.email
+		FROM refresh_tokens rt
+		JOIN sessions s ON s.id = rt.session_id
+		JOIN users u ON u.id = s.user_id
+		WHERE rt.token_hash = $1
+		FOR UPDATE OF rt, s
+	`, auth.HashOpaqueToken(presented)).Scan(
+		&tokenID,
+		&usedAt,
+		&sessionID,
+		&revokedAt,
+		&expiresAt,
+		&userID,
+		&email,
+	)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeError(w, http.StatusUnauthorized, "リフレッシュトークンが無効です")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "トークン更新に失敗しました")
+		return
+	}
+
+	if usedAt.Valid {
+		// 使用済みトークンの再提示は漏洩の兆候とみなし、同じファミリーをすべて失効させる。
+		if _, err := tx.Exec(ctx, `
+			UPDATE sessions SET revoked_at = NOW()
+			WHERE id = $1 AND revoked_at IS NULL
+		`, sessionID); err != nil {
+			writeError(w, http.StatusInternalServerError, "トークン更新に失敗しました")
+			return
+		}
+		if err := tx.Commit(ctx); err != nil {
+			writeError(w, http.StatusInternalServerError, "トークン更新に失敗しました")
+			return
+		}
+		writeError(w, http.StatusUnauthorized, "リフレッシュトークンの再利用を検知したため、セッションを無効化しました")
+		return
+	}
+	if revokedAt.Valid || !expiresAt.After(time.Now()) {
+		writeError(w, http.StatusUnauthorized, "リフレッシュトークンが無効です")
+		return
+	}
+
+	refreshToken, refreshHash, err := auth.GenerateOpaqueToken()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "トークン生成に失敗しました")
+		return
+	}
+	if _, err := tx.Exec(ctx, `UPDATE refresh_tokens SET used_at = NOW() WHERE id = $1`, tokenID); err != nil {
+		writeError(w, http.StatusInternalServerError, "トークン更新に失敗しました")
+		return
+	}
+	if _, err := tx.Exec(ctx, `
+		INSERT INTO refresh_tokens (session_id, token_hash)
+		VALUES ($1, $2)
+	`, sessionID, refreshHash); err != nil {
+		writeError(w, http.StatusInternalServerError, "トークン更新に失敗しました")
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, "トークン更新に失敗しました")
+		return
+	}
+
+	token, err := auth.GenerateToken(userID, email, sessionID, s.keys, s.accessTokenTTL())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "トークン生成に失敗しました")
+		return
+	}
+
+	response := tokenResponse{Token: token, RefreshToken: refreshToken}
+	if s.cfg.AuthCookieEnabled {
+		response.CSRFToken, err = s.setAuthCookies(w, token, refreshToken)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "トークン生成に失敗しました")
+			return
+		}
+	}
+
+	writeData(w, http.StatusOK, response)
+}
+
+func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	sessionID, ok := getSessionID(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "認証トークンが無効です")
+		return
+	}
+
+	if _, err := s.db.Exec(r.Context(), `
+		UPDATE sessions SET revoked_at = NOW()
+		WHERE id = $1 AND revoked_at IS NULL
+	`, sessionID); err != nil {
+		writeError(w, http.StatusInternalServerError, "ログアウトに失敗しました")
+		return
+	}
+
+	s.clearAuthCookies(w)
+	writeData(w, http.StatusOK, map[string]string{"message": "ログアウトしました"})
+}
+
+func (s *Server) handleListSessions(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserID(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "認証トークンが無効です")
+		return
+	}
+	currentID, _ := getSessionID(r.Context())
+
+	rows, err := s.db.Query(r.Context(), `
+		SELECT id, user_agent, ip_address, created_at, last_seen_at, expires_at
+		FROM sessions
+		WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > NOW()
+		ORDER BY last_seen_at DESC
+	`, userID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "セッション一覧の取得に失敗しました")
+		return
+	}
+	defer rows.Close()
+
+	sessions := make([]model.Session, 0)
+	for rows.Next() {
+		var session model.Session
+		if err := rows.Scan(
+			&session.ID,
+			newNullableString(&session.UserAgent),
+			newNullableString(&session.IPAddress),
+			&session.CreatedAt,
+			&session.LastSeenAt,
+			&session.ExpiresAt,
+		); err != nil {
+			writeError(w, http.StatusInternalServerError, "セッション一覧の取得に失敗しました")
+			return
+		}
+		session.Current = session.ID == currentID
+		sessions = append(sessions, session)
+	}
+	if err := rows.Err(); err != nil {
+		writeError(w, http.StatusInternalServerError, "セッション一覧の取得に失敗しました")
+		return
+	}
+
+	writeData(w, http.StatusOK, sessions)
+}
+
+func (s *Server) handleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserID(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "認証トークンが無効です")
+		return
+	}
+
+	id := chi.URLParam(r, "id")
+	if _, err := uuid.Parse(id); err != nil {
+		writeError(w, http.StatusBadRequest, "セッションIDが不正です")
+		return
+	}
+
+	cmd, err := s.db.Exec(r.Context(), `
+		UPDATE sessions SET revoked_at = NOW()
+		WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
+	`, id, userID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "セッションの無効化に失敗しました")
+		return
+	}
+	if cmd.RowsAffected() == 0 {
+		writeError(w, http.StatusNotFound, "セッションが見つかりません")
+		return
+	}
+
+	writeData(w, http.StatusOK, map[string]string{"message": "セッションを無効化しました"})
+}
+
+// handleRevokeOtherSessions は現在のセッション以外をすべて無効化する(他の端末からサインアウト)。
+func (s *Server) handleRevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserID(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "認証トークンが無効です")
+		return
+	}
+	sessionID, _ := getSessionID(r.Context())
+
+	count, err := s.revokeUserSessions(r.Context(), s.db, userID, sessionID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "セッションの無効化に失敗しました")
+		return
+	}
+
+	writeData(w, http.StatusOK, map[string]any{
+		"message": "他の端末からサインアウトしました",
+		"revoked": count,
+	})
+}
+
+// revokeUserSessions はユーザーの有効なセッションをすべて無効化する。
+// exceptSessionID を指定した場合はそのセッションだけ残す。
+func (s *Server) revokeUserSessions(ctx context.Context, q querier, userID, exceptSessionID string) (int64, error) {
+	cmd, err := q.Exec(ctx, `
+		UPDATE sessions SET revoked_at = NOW()
+		WHERE user_id = $1 AND revoked_at IS NULL
+			AND ($2 = '' OR id::text <> $2)
+	`, userID, exceptSessionID)
+	if err != nil {
+		return 0, err
+	}
+	return cmd.RowsAffected(), nil
+}
+
+type sessionState struct {
+	active        bool
+	emailVerified bool
+}
+
+// loadSession はアクセストークンに紐づくセッションが失効・期限切れでないかを確認し、
+// 最終アクセス日時を更新する。書き込みを抑えるため更新は1分に1回までにしている。
+func (s *Server) loadSession(ctx context.Context, sessionID, userID string) (sessionState, error) {
+	var state sessionState
+	var lastSeenAt time.Time
+	err := s.db.QueryRow(ctx, `
+		SELECT
+			s.revoked_at IS NULL AND s.expires_at > NOW(),
+			u.email_verified_at IS NOT NULL,
+			s.last_seen_at
+		FROM sessions s
+		JOIN users u ON u.id = s.user_id
+		WHERE s.id = $1 AND s.user_id = $2
+	`, sessionID, userID).Scan(&state.active, &state.emailVerified, &lastSeenAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return sessionState{}, nil
+	}
+	if err != nil || !state.active {
+		return sessionState{}, err
+	}
+
+	if time.Since(lastSeenAt) > time.Minute {
+		if _, err := s.db.Exec(ctx, `UPDATE sessions SET last_seen_at = NOW() WHERE id = $1`, sessionID); err != nil {
+			return sessionState{}, err
+		}
+	}
+	return state, nil
+}
+
+// clientIP はリクエスト元のIPアドレスを返す。TRUST_PROXY が有効な場合のみ
+// リバースプロキシが付与する X-Forwarded-For / X-Real-IP を信頼する。
+// X-Forwarded-For の左側はクライアントが自由に書けるため、信頼できるプロキシが追記した
+// 右から TRUSTED_PROXY_HOPS 番目の値を使う。
+func (s *Server) clientIP(r *http.Request) string {
+	if s.cfg.TrustProxy {
+		if ip := forwardedClientIP(r.Header.Values("X-Forwarded-For"), s.cfg.TrustedProxyHops); ip != "" {
+			return ip
+		}
+		if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(realIP) != nil {
+			return realIP
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// forwardedClientIP は X-Forwarded-For の右から hops 番目のIPアドレスを返す。
+// 段数が足りない場合や値がIPアドレスでない場合は空文字を返す。
+func forwardedClientIP(headers []string, hops int) string {
+	if hops < 1 {
+		hops = 1
+	}
+	entries := make([]string, 0)
+	for _, header := range headers {
+		for _, entry := range strings.Split(header, ",") {
+			entries = append(entries, strings.TrimSpace(entry))
+		}
+	}
+	if len(entries) < hops {
+		return ""
+	}
+	ip := entries[len(entries)-hops]
+	if net.ParseIP(ip) == nil {
+		return ""
+	}
+	return ip
+}
+
+func truncatePtr(value string, limit int) *string {
+	runes := []rune(value)
+	if len(runes) > limit {
+		value = string(runes[:limit])
+	}
+	return &value
+}
+
+func (s *Server) accessTokenTTL() time.Duration {
+	return time.Duration(s.cfg.AccessTokenMinutes) * time.Minute
+}
+
+func (s *Server) refreshTokenTTL() time.Duration {
+	return time.Duration(s.cfg.RefreshTokenDays) * 24 * time.Hour
+}
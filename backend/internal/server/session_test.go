@@ -0,0 +1,60 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ymmtyamaterous/diary-oc-api/internal/config"
+)
+
+func TestClientIP(t *testing.T) {
+	req := httptest.NewRequest("GET", "/api/auth/sessions", nil)
+	req.RemoteAddr = "192.0.2.10:54321"
+	req.Header.Set("X-Forwarded-For", "198.51.100.7, 203.0.113.5, 10.0.0.1")
+
+	direct := New(config.Config{}, nil, nil)
+	if got := direct.clientIP(req); got != "192.0.2.10" {
+		t.Fatalf("clientIP without proxy = %q, want %q", got, "192.0.2.10")
+	}
+
+	tests := []struct {
+		name      string
+		hops      int
+		forwarded []string
+		realIP    string
+		want      string
+	}{
+		{name: "rightmost entry", hops: 1, forwarded: []string{"198.51.100.7, 203.0.113.5"}, want: "203.0.113.5"},
+		{name: "hops from the right", hops: 2, forwarded: []string{"198.51.100.7, 203.0.113.5, 10.0.0.1"}, want: "203.0.113.5"},
+		{name: "multiple headers", hops: 2, forwarded: []string{"198.51.100.7", "203.0.113.5, 10.0.0.1"}, want: "203.0.113.5"},
+		{name: "fewer entries than hops", hops: 3, forwarded: []string{"203.0.113.5, 10.0.0.1"}, realIP: "203.0.113.9", want: "203.0.113.9"},
+		{name: "not an ip address", hops: 1, forwarded: []string{"198.51.100.7, unknown"}, want: "192.0.2.10"},
+		{name: "no headers", hops: 1, want: "192.0.2.10"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/api/auth/sessions", nil)
+			req.RemoteAddr = "192.0.2.10:54321"
+			for _, value := range tt.forwarded {
+				req.Header.Add("X-Forwarded-For", value)
+			}
+			if tt.realIP != "" {
+				req.Header.Set("X-Real-IP", tt.realIP)
+			}
+
+			proxied := New(config.Config{TrustProxy: true, TrustedProxyHops: tt.hops}, nil, nil)
+			if got := proxied.clientIP(req); got != tt.want {
+				t.Fatalf("clientIP behind proxy = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTruncatePtr(t *testing.T) {
+	if got := *truncatePtr("日記アプリ", 2); got != "日記" {
+		t.Fatalf("truncatePtr should cut by runes, got %q", got)
+	}
+	if got := *truncatePtr("abc", 10); got != "abc" {
+		t.Fatalf("truncatePtr should keep short values, got %q", got)
+	}
+}
@@ -0,0 +1,313 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"github.com/ymmtyamaterous/diary-oc-api/internal/model"
+	"github.com/ymmtyamaterous/diary-oc-api/internal/validation"
+)
+
+// tagColumns は scanTag が読み取る列。tags に別名を付けずに使う。
+const tagColumns = `id, name, (
+	SELECT COUNT(*)
+	FROM diary_entry_tags dt
+	JOIN diary_entries de ON de.id = dt.diary_entry_id
+	WHERE dt.tag_id = tags.id AND de.deleted_at IS NULL AND NOT de.is_draft
+), created_at`
+
+func scanTag(row pgx.Row) (model.Tag, error) {
+	var tag model.Tag
+	err := row.Scan(&tag.ID, &tag.Name, &tag.UsageCount, &tag.CreatedAt)
+	return tag, err
+}
+
+// setDiaryTags は日記のタグを names で置き換え、付いたタグ名を返す。
+// 未登録のタグは作成し、大文字小文字だけが異なる既存のタグがあればそちらを使う。
+func setDiaryTags(ctx context.Context, q querier, userID, entryID string, names []string) ([]string, error) {
+	names, err := validation.NormalizeTags(names)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := q.Exec(ctx, `DELETE FROM diary_entry_tags WHERE diary_entry_id = $1`, entryID); err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return []string{}, nil
+	}
+
+	if _, err := q.Exec(ctx, `
+		INSERT INTO tags (user_id, name)
+		SELECT $1, unnest($2::text[])
+		ON CONFLICT (user_id, lower(name)) DO NOTHING
+	`, userID, names); err != nil {
+		return nil, err
+	}
+
+	lowered := make([]string, 0, len(names))
+	for _, name := range names {
+		lowered = append(lowered, strings.ToLower(name))
+	}
+	rows, err := q.Query(ctx, `
+		INSERT INTO diary_entry_tags (diary_entry_id, tag_id)
+		SELECT $1, id
+		FROM tags
+		WHERE user_id = $2 AND lower(name) = ANY($3::text[])
+		RETURNING (SELECT name FROM tags WHERE id = tag_id)
+	`, entryID, userID, lowered)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, err
+	}
+	// diaryColumns の ORDER BY name COLLATE "C" と同じ順にする
+	slices.Sort(tags)
+	return tags, nil
+}
+
+func (s *Server) handleListTags(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserID(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "認証トークンが無効です")
+		return
+	}
+
+	rows, err := s.db.Query(r.Context(), `
+		SELECT `+tagColumns+`
+		FROM tags
+		WHERE user_id = $1
+		ORDER BY 3 DESC, name
+	`, userID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "タグ一覧の取得に失敗しました")
+		return
+	}
+	defer rows.Close()
+
+	tags := make([]model.Tag, 0)
+	for rows.Next() {
+		tag, err := scanTag(rows)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "タグ一覧の取得に失敗しました")
+			return
+		}
+		tags = append(tags, tag)
+	}
+	if err := rows.Err(); err != nil {
+		writeError(w, http.StatusInternalServerError, "タグ一覧の取得に失敗しました")
+		return
+	}
+
+	writeData(w, http.StatusOK, tags)
+}
+
+// handleRenameTag はタグ名を変更する。変更はタグが付いたすべての日記に反映される。
+func (s *Server) handleRenameTag(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserID(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "認証トークンが無効です")
+		return
+	}
+
+	id := chi.URLParam(r, "id")
+	if _, err := uuid.Parse(id); err != nil {
+		writeError(w, http.StatusBadRequest, "タグIDが不正です")
+		return
+	}
+
+	var payload struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeError(w, http.StatusBadRequest, "不正なリクエストです")
+		return
+	}
+	name := strings.TrimSpace(payload.Name)
+	if err := validation.ValidateTagName(name); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx := r.Context()
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "タグの変更に失敗しました")
+		return
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	if err := s.touchTaggedDiaries(ctx, tx, userID, id); err != nil {
+		writeError(w, http.StatusInternalServerError, "タグの変更に失敗しました")
+		return
+	}
+	tag, err := scanTag(tx.QueryRow(ctx, `
+		UPDATE tags
+		SET name = $1
+		WHERE id = $2 AND user_id = $3
+		RETURNING `+tagColumns,
+		name, id, userID,
+	))
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			writeError(w, http.StatusConflict, "同じ名前のタグがあります。まとめる場合はタグを統合してください")
+			return
+		}
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "タグが見つかりません")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "タグの変更に失敗しました")
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, "タグの変更に失敗しました")
+		return
+	}
+
+	writeData(w, http.StatusOK, tag)
+}
+
+// handleMergeTag はタグ {id} が付いた日記に into のタグを付け、タグ {id} を削除する。
+func (s *Server) handleMergeTag(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserID(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "認証トークンが無効です")
+		return
+	}
+
+	sourceID := chi.URLParam(r, "id")
+	if _, err := uuid.Parse(sourceID); err != nil {
+		writeError(w, http.StatusBadRequest, "タグIDが不正です")
+		return
+	}
+
+	var payload struct {
+		Into string `json:"into"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeError(w, http.StatusBadRequest, "不正なリクエストです")
+		return
+	}
+	if _, err := uuid.Parse(payload.Into); err != nil {
+		writeError(w, http.StatusBadRequest, "統合先のタグIDが不正です")
+		return
+	}
+	if payload.Into == sourceID {
+		writeError(w, http.StatusBadRequest, "同じタグには統合できません")
+		return
+	}
+
+	ctx := r.Context()
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "タグの統合に失敗しました")
+		return
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	var owned int
+	if err := tx.QueryRow(ctx, `
+		SELECT COUNT(*)
+		FROM tags
+		WHERE user_id = $1 AND id = ANY($2::uuid[])
+	`, userID, []string{sourceID, payload.Into}).Scan(&owned); err != nil {
+		writeError(w, http.StatusInternalServerError, "タグの統合に失敗しました")
+		return
+	}
+	if owned != 2 {
+		writeError(w, http.StatusNotFound, "タグが見つかりません")
+		return
+	}
+
+	if err := s.touchTaggedDiaries(ctx, tx, userID, sourceID); err != nil {
+		writeError(w, http.StatusInternalServerError, "タグの統合に失敗しました")
+		return
+	}
+	if _, err := tx.Exec(ctx, `
+		INSERT INTO diary_entry_tags (diary_entry_id, tag_id)
+		SELECT diary_entry_id, $2
+		FROM diary_entry_tags
+		WHERE tag_id = $1
+		ON CONFLICT DO NOTHING
+	`, sourceID, payload.Into); err != nil {
+		writeError(w, http.StatusInternalServerError, "タグの統合に失敗しました")
+		return
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM tags WHERE id = $1`, sourceID); err != nil {
+		writeError(w, http.StatusInternalServerError, "タグの統合に失敗しました")
+		return
+	}
+	tag, err := scanTag(tx.QueryRow(ctx, `SELECT `+tagColumns+` FROM tags WHERE id = $1`, payload.Into))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "タグの統合に失敗しました")
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, "タグの統合に失敗しました")
+		return
+	}
+
+	writeData(w, http.StatusOK, tag)
+}
+
+// touchTaggedDiaries はタグの変更で tags が変わる日記を行ロックし、変更前の内容を版として記録したうえで
+// version と updated_at を進める。古い ETag での更新がタグの変更を元に戻さないようにするため。
+func (s *Server) touchTaggedDiaries(ctx context.Context, q querier, userID, tagID string) error {
+	rows, err := q.Query(ctx, `
+		SELECT `+diaryColumns+`, deleted_at IS NOT NULL
+		FROM diary_entries
+		WHERE user_id = $1
+			AND id IN (SELECT diary_entry_id FROM diary_entry_tags WHERE tag_id = $2)
+		ORDER BY id
+		FOR UPDATE
+	`, userID, tagID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	// 下書きとゴミ箱の日記は版を記録しない
+	ids := make([]string, 0)
+	revisions := make([]model.DiaryEntry, 0)
+	for rows.Next() {
+		var trashed bool
+		entry, err := scanDiaryEntry(rows, &trashed)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, entry.ID)
+		if !entry.IsDraft && !trashed {
+			revisions = append(revisions, entry)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	for _, entry := range revisions {
+		if err := recordDiaryRevision(ctx, q, entry, s.cfg.DiaryRevisionLimit); err != nil {
+			return err
+		}
+	}
+	_, err = q.Exec(ctx, `
+		UPDATE diary_entries
+		SET updated_at = NOW(), version = version + 1
+		WHERE id = ANY($1::uuid[])
+	`, ids)
+	return err
+}
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+
+	"github.com/ymmtyamaterous/diary-oc-api/internal/mail"
+	"github.com/ymmtyamaterous/diary-oc-api/internal/model"
+)
+
+const (
+	throttleScopeAccount = "account"
+	throttleScopeIP      = "ip"
+	// パスワード再設定メールの送信回数は別の scope で数える
+	throttleScopeResetAccount = "reset"
+	throttleScopeResetIP      = "reset_ip"
+)
+
+type loginThrottle struct {
+	accountKey string
+	ipKey      string
+}
+
+func (s *Server) newLoginThrottle(r *http.Request, email string) loginThrottle {
+	return loginThrottle{
+		accountKey: strings.ToLower(strings.TrimSpace(email)),
+		ipKey:      s.clientIP(r),
+	}
+}
+
+// loginRetryAfter はアカウントまたは接続元IPがロック中であれば、解除までの残り時間を返す。
+func (s *Server) loginRetryAfter(ctx context.Context, t loginThrottle) (time.Duration, error) {
+	return s.throttleRetryAfter(ctx, throttleScopeAccount, throttleScopeIP, t)
+}
+
+// passwordResetRetryAfter はメールアドレスまたは接続元IPの再設定メール送信が制限中であれば、解除までの残り時間を返す。
+func (s *Server) passwordResetRetryAfter(ctx context.Context, t loginThrottle) (time.Duration, error) {
+	return s.throttleRetryAfter(ctx, throttleScopeResetAccount, throttleScopeResetIP, t)
+}
+
+func (s *Server) throttleRetryAfter(ctx context.Context, accountScope, ipScope string, t loginThrottle) (time.Duration, error) {
+	var lockedUntil pgtype.Timestamptz
+	err := s.db.QueryRow(ctx, `
+		SELECT MAX(locked_until)
+		FROM login_throttles
+		WHERE ((scope = $1 AND key = $2) OR (scope = $3 AND key = $4))
+			AND locked_until > NOW()
+	`, accountScope, t.accountKey, ipScope, t.ipKey).Scan(&lockedUntil)
+	if err != nil || !lockedUntil.Valid {
+		return 0, err
+	}
+	return time.Until(lockedUntil.Time), nil
+}
+
+// recordLoginFailure は失敗回数を加算し、しきい値を超えた場合はロックする。
+// アカウントが新たにロックされた場合、owner が分かっていれば本人にメールで通知する。
+func (s *Server) recordLoginFailure(ctx context.Context, t loginThrottle, owner *model.User) error {
+	accountLock, err := s.bumpLoginFailures(ctx, throttleScopeAccount, t.accountKey, s.cfg.LoginMaxAccountFailures)
+	if err != nil {
+		return err
+	}
+	if _, err := s.bumpLoginFailures(ctx, throttleScopeIP, t.ipKey, s.cfg.LoginMaxIPFailures); err != nil {
+		return err
+	}
+
+	if accountLock > 0 && owner != nil {
+		// メール送信は応答後に行い、応答時間の差からアカウントの有無を推測されないようにする
+		go s.sendLockoutNotice(context.WithoutCancel(ctx), *owner, accountLock)
+	}
+	return nil
+}
+
+// lockoutNoticeTimeout は recordLoginFailure から非同期に行うロック通知メール送信の制限時間。
+const lockoutNoticeTimeout = 30 * time.Second
+
+// sendLockoutNotice はアカウントのロックを本人にメールで通知する。応答後に実行されるため、失敗はログに残すだけにする。
+func (s *Server) sendLockoutNotice(ctx context.Context, owner model.User, lock time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, lockoutNoticeTimeout)
+	defer cancel()
+
+	if err := s.mailer.Send(ctx, mail.Message{
+		To:      owner.Email,
+		Subject: "【Diary Open Close】ログインが一時的に制限されました",
+		Body: fmt.Sprintf(
+			"%s さん\n\nパスワードの誤入力が続いたため、アカウントへのログインを %s 制限しました。\nお心当たりがない場合は、パスワードの変更をおすすめします。\n",
+			owner.DisplayName,
+			formatRetryAfter(lock),
+		),
+	}); err != nil {
+		log.Printf("lockout notice failed: user=%s err=%v", owner.ID, err)
+	}
+}
+
+// recordPasswordResetRequest は再設定メールの送信回数を加算し、しきい値に達した場合は以降の受付を制限する。
+// アカウントの有無を推測されないよう、登録されていないメールアドレスでも数える。
+func (s *Server) recordPasswordResetRequest(ctx context.Context, t loginThrottle) error {
+	if _, err := s.bumpLoginFailures(ctx, throttleScopeResetAccount, t.accountKey, s.cfg.PasswordResetMaxEmailRequests); err != nil {
+		return err
+	}
+	_, err := s.bumpLoginFailures(ctx, throttleScopeResetIP, t.ipKey, s.cfg.PasswordResetMaxIPRequests)
+	return err
+}
+
+// bumpLoginFailures は失敗回数を1加算し、今回の失敗でロックした場合はその期間を返す。
+// 最後の失敗から LOGIN_FAILURE_WINDOW_MINUTES 以上経過していれば回数をリセットする。
+func (s *Server) bumpLoginFailures(ctx context.Context, scope, key string, threshold int) (time.Duration, error) {
+	if key == "" {
+		return 0, nil
+	}
+
+	var failures int
+	err := s.db.QueryRow(ctx, `
+		INSERT INTO login_throttles (scope, key, failures, last_failed_at)
+		VALUES ($1, $2, 1, NOW())
+		ON CONFLICT (scope, key) DO UPDATE SET
+			failures = CASE
+				WHEN login_throttles.last_failed_at < NOW() - make_interval(mins => $3)
+					AND (login_throttles.locked_until IS NULL OR login_throttles.locked_until <= NOW())
+				THEN 1
+				ELSE login_throttles.failures + 1
+			END,
+			last_failed_at = NOW()
+		RETURNING failures
+	`, scope, key, s.cfg.LoginFailureWindowMinutes).Scan(&failures)
+	if err != nil {
+		return 0, err
+	}
+
+	lock := lockoutDuration(failures, threshold, s.lockoutBase(), s.lockoutMax())
+	if lock <= 0 {
+		return 0, nil
+	}
+	if _, err := s.db.Exec(ctx, `
+		UPDATE login_throttles
+		SET locked_until = NOW() + make_interval(secs => $3)
+		WHERE scope = $1 AND key = $2
+	`, scope, key, lock.Seconds()); err != nil {
+		return 0, err
+	}
+	return lock, nil
+}
+
+// clearLoginFailures はログイン成功時にアカウント単位の失敗回数をリセットする。
+// IP単位の記録は他アカウントへの総当たりを防ぐため時間経過でのみ解除する。
+func (s *Server) clearLoginFailures(ctx context.Context, t loginThrottle) error {
+	_, err := s.db.Exec(ctx, `
+		DELETE FROM login_throttles
+		WHERE scope = $1 AND key = $2
+	`, throttleScopeAccount, t.accountKey)
+	return err
+}
+
+// rejectLogin は認証失敗を記録したうえで 401 を返す。
+func (s *Server) rejectLogin(w http.ResponseWriter, r *http.Request, t loginThrottle, owner *model.User) {
+	if err := s.recordLoginFailure(r.Context(), t, owner); err != nil {
+		writeError(w, http.StatusInternalServerError, "ログインに失敗しました")
+		return
+	}
+	writeError(w, http.StatusUnauthorized, "メールアドレスまたはパスワードが正しくありません")
+}
+
+// checkReauthThrottle はログイン中の操作でパスワード等を再確認する前に、アカウントまたは接続元IPがロック中でないかを確認する。
+// ロック中なら 429 を返して false を返す。盗まれたセッションから現在のパスワードを総当たりされないよう、ログインと同じ記録を使う。
+func (s *Server) checkReauthThrottle(w http.ResponseWriter, r *http.Request, user model.User) (loginThrottle, bool) {
+	throttle := s.newLoginThrottle(r, user.Email)
+	retryAfter, err := s.loginRetryAfter(r.Context(), throttle)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "本人確認に失敗しました")
+		return throttle, false
+	}
+	if retryAfter > 0 {
+		writeTooManyAttempts(w, retryAfter)
+		return throttle, false
+	}
+	return throttle, true
+}
+
+// rejectReauth は再確認の失敗を記録したうえで 400 を返す。
+func (s *Server) rejectReauth(w http.ResponseWriter, r *http.Request, t loginThrottle, user model.User, message string) {
+	if err := s.recordLoginFailure(r.Context(), t, &user); err != nil {
+		writeError(w, http.StatusInternalServerError, "本人確認に失敗しました")
+		return
+	}
+	writeError(w, http.StatusBadRequest, message)
+}
+
+func (s *Server) purgeLoginThrottles(ctx context.Context) error {
+	_, err := s.db.Exec(ctx, `
+		DELETE FROM login_throttles
+		WHERE last_failed_at < NOW() - INTERVAL '1 day'
+			AND (locked_until IS NULL OR locked_until < NOW())
+	`)
+	return err
+}
+
+func (s *Server) lockoutBase() time.Duration {
+	return time.Duration(s.cfg.LoginLockoutSeconds) * time.Second
+}
+
+func (s *Server) lockoutMax() time.Duration {
+	return time.Duration(s.cfg.LoginLockoutMaxMinutes) * time.Minute
+}
+
+// lockoutDuration はしきい値到達時に base、以降の失敗ごとに倍の期間を limit を上限として返す。
+func lockoutDuration(failures, threshold int, base, limit time.Duration) time.Duration {
+	if threshold <= 0 || failures < threshold {
+		return 0
+	}
+	exponent := failures - threshold
+	if exponent > 30 {
+		return limit
+	}
+	d := time.Duration(float64(base) * math.Pow(2, float64(exponent)))
+	return min(d, limit)
+}
+
+func writeTooManyAttempts(w http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	writeError(w, http.StatusTooManyRequests, fmt.Sprintf("ログイン試行回数が上限を超えました。%s後に再度お試しください", formatRetryAfter(retryAfter)))
+}
+
+func formatRetryAfter(d time.Duration) string {
+	if d < time.Minute {
+		return fmt.Sprintf("%d秒", max(1, int(math.Ceil(d.Seconds()))))
+	}
+	return fmt.Sprintf("%d分", int(math.Ceil(d.Minutes())))
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLockoutDuration(t *testing.T) {
+	base := time.Minute
+	limit := 30 * time.Minute
+
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{failures: 4, want: 0},
+		{failures: 5, want: time.Minute},
+		{failures: 6, want: 2 * time.Minute},
+		{failures: 8, want: 8 * time.Minute},
+		{failures: 10, want: limit},
+		{failures: 100, want: limit},
+	}
+	for _, tt := range tests {
+		if got := lockoutDuration(tt.failures, 5, base, limit); got != tt.want {
+			t.Fatalf("lockoutDuration(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+
+	if got := lockoutDuration(100, 0, base, limit); got != 0 {
+		t.Fatalf("threshold 0 should disable lockout, got %v", got)
+	}
+}
+
+func TestWriteTooManyAttempts(t *testing.T) {
+	rec := httptest.NewRecorder()
+	writeTooManyAttempts(rec, 90*time.Second+100*time.Millisecond)
+
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want 429", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "91" {
+		t.Fatalf("Retry-After = %q, want %q", got, "91")
+	}
+}
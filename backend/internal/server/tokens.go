@@ -0,0 +1,251 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"github.com/ymmtyamaterous/diary-oc-api/internal/auth"
+	"github.com/ymmtyamaterous/diary-oc-api/internal/model"
+)
+
+// パーソナルアクセストークンに付与できる権限。
+const (
+	scopeDiariesRead  = "diaries:read"
+	scopeDiariesWrite = "diaries:write"
+	scopeFilesWrite   = "files:write"
+)
+
+var tokenScopes = []string{scopeDiariesRead, scopeDiariesWrite, scopeFilesWrite}
+
+const (
+	maxTokenNameRunes   = 100
+	maxTokenExpiresDays = 365
+	tokenPrefixLength   = 12
+)
+
+type createTokenPayload struct {
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	ExpiresInDays int      `json:"expires_in_days"`
+}
+
+type createTokenResponse struct {
+	Token       string                    `json:"token"`
+	AccessToken model.PersonalAccessToken `json:"access_token"`
+}
+
+// requireScope は authMiddleware で認証したうえで、パーソナルアクセストークンに scope を要求する。
+// requireScope を通らないルートではパーソナルアクセストークンは受け付けない。
+func (s *Server) requireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		authenticated := s.authMiddleware(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), requiredScopeKey, scope)
+			authenticated.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// authenticateAccessToken は authMiddleware から呼ばれ、パーソナルアクセストークンを検証する。
+func (s *Server) authenticateAccessToken(w http.ResponseWriter, r *http.Request, next http.Handler, token string) {
+	scope, _ := r.Context().Value(requiredScopeKey).(string)
+	if scope == "" {
+		writeError(w, http.StatusForbidden, "このAPIはアクセストークンでは利用できません")
+		return
+	}
+
+	var tokenID, userID string
+	var scopes []string
+	var emailVerified bool
+	var lastUsedAt *time.Time
+	err := s.db.QueryRow(r.Context(), `
+		SELECT t.id, t.user_id, t.scopes, u.email_verified_at IS NOT NULL, t.last_used_at
+		FROM personal_access_tokens t
+		JOIN users u ON u.id = t.user_id
+		WHERE t.token_hash = $1
+			AND (t.expires_at IS NULL OR t.expires_at > NOW())
+			AND u.delete_after IS NULL
+	`, auth.HashOpaqueToken(token)).Scan(&tokenID, &userID, &scopes, &emailVerified, &lastUsedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeError(w, http.StatusUnauthorized, "アクセストークンが無効です")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "認証処理に失敗しました")
+		return
+	}
+	if !slices.Contains(scopes, scope) {
+		writeError(w, http.StatusForbidden, fmt.Sprintf("アクセストークンに %s の権限がありません", scope))
+		return
+	}
+
+	// セッションと同様、書き込みを抑えるため最終利用日時の更新は1分に1回までにしている
+	if lastUsedAt == nil || time.Since(*lastUsedAt) > time.Minute {
+		if _, err := s.db.Exec(r.Context(), `
+			UPDATE personal_access_tokens SET last_used_at = NOW() WHERE id = $1
+		`, tokenID); err != nil {
+			writeError(w, http.StatusInternalServerError, "認証処理に失敗しました")
+			return
+		}
+	}
+
+	ctx := context.WithValue(r.Context(), userIDKey, userID)
+	ctx = context.WithValue(ctx, emailVerifiedKey, emailVerified)
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+func (s *Server) handleListTokens(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserID(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "認証トークンが無効です")
+		return
+	}
+
+	rows, err := s.db.Query(r.Context(), `
+		SELECT id, name, token_prefix, scopes, expires_at, last_used_at, created_at
+		FROM personal_access_tokens
+		WHERE user_id = $1
+		ORDER BY created_at DESC
+	`, userID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "アクセストークン一覧の取得に失敗しました")
+		return
+	}
+	defer rows.Close()
+
+	tokens := make([]model.PersonalAccessToken, 0)
+	for rows.Next() {
+		var token model.PersonalAccessToken
+		if err := rows.Scan(
+			&token.ID,
+			&token.Name,
+			&token.TokenPrefix,
+			&token.Scopes,
+			&token.ExpiresAt,
+			&token.LastUsedAt,
+			&token.CreatedAt,
+		); err != nil {
+			writeError(w, http.StatusInternalServerError, "アクセストークン一覧の取得に失敗しました")
+			return
+		}
+		tokens = append(tokens, token)
+	}
+	if err := rows.Err(); err != nil {
+		writeError(w, http.StatusInternalServerError, "アクセストークン一覧の取得に失敗しました")
+		return
+	}
+
+	writeData(w, http.StatusOK, tokens)
+}
+
+func (s *Server) handleCreateToken(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserID(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "認証トークンが無効です")
+		return
+	}
+
+	var payload createTokenPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeError(w, http.StatusBadRequest, "不正なリクエストです")
+		return
+	}
+	name, scopes, err := validateTokenPayload(payload)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	raw, hash, err := auth.GeneratePersonalAccessToken()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "アクセストークンの発行に失敗しました")
+		return
+	}
+	var expiresAt *time.Time
+	if payload.ExpiresInDays > 0 {
+		expiry := time.Now().AddDate(0, 0, payload.ExpiresInDays)
+		expiresAt = &expiry
+	}
+
+	token := model.PersonalAccessToken{Name: name, TokenPrefix: raw[:tokenPrefixLength], Scopes: scopes}
+	err = s.db.QueryRow(r.Context(), `
+		INSERT INTO personal_access_tokens (user_id, name, token_hash, token_prefix, scopes, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, expires_at, created_at
+	`, userID, token.Name, hash, token.TokenPrefix, token.Scopes, expiresAt).Scan(&token.ID, &token.ExpiresAt, &token.CreatedAt)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "アクセストークンの発行に失敗しました")
+		return
+	}
+
+	writeData(w, http.StatusCreated, createTokenResponse{Token: raw, AccessToken: token})
+}
+
+func (s *Server) handleRevokeToken(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserID(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "認証トークンが無効です")
+		return
+	}
+
+	tokenID := chi.URLParam(r, "id")
+	if _, err := uuid.Parse(tokenID); err != nil {
+		writeError(w, http.StatusBadRequest, "アクセストークンIDが不正です")
+		return
+	}
+
+	cmd, err := s.db.Exec(r.Context(), `
+		DELETE FROM personal_access_tokens WHERE id = $1 AND user_id = $2
+	`, tokenID, userID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "アクセストークンの削除に失敗しました")
+		return
+	}
+	if cmd.RowsAffected() == 0 {
+		writeError(w, http.StatusNotFound, "アクセストークンが見つかりません")
+		return
+	}
+
+	writeData(w, http.StatusOK, map[string]string{"message": "アクセストークンを削除しました"})
+}
+
+// validateTokenPayload は名前を整え、権限を重複なしの定義順にそろえて返す。
+func validateTokenPayload(payload createTokenPayload) (string, []string, error) {
+	name := strings.TrimSpace(payload.Name)
+	if name == "" {
+		return "", nil, errors.New("トークン名は必須です")
+	}
+	if utf8.RuneCountInString(name) > maxTokenNameRunes {
+		return "", nil, fmt.Errorf("トークン名は%d文字以内で入力してください", maxTokenNameRunes)
+	}
+	if payload.ExpiresInDays < 0 || payload.ExpiresInDays > maxTokenExpiresDays {
+		return "", nil, fmt.Errorf("有効期限は0〜%d日で指定してください", maxTokenExpiresDays)
+	}
+	if len(payload.Scopes) == 0 {
+		return "", nil, errors.New("権限を1つ以上指定してください")
+	}
+
+	scopes := make([]string, 0, len(tokenScopes))
+	for _, scope := range payload.Scopes {
+		if !slices.Contains(tokenScopes, scope) {
+			return "", nil, fmt.Errorf("不明な権限です: %s", scope)
+		}
+	}
+	for _, scope := range tokenScopes {
+		if slices.Contains(payload.Scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	return name, scopes, nil
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ymmtyamaterous/diary-oc-api/internal/auth"
+	"github.com/ymmtyamaterous/diary-oc-api/internal/config"
+)
+
+func TestValidateTokenPayload(t *testing.T) {
+	name, scopes, err := validateTokenPayload(createTokenPayload{
+		Name:   "  backup script ",
+		Scopes: []string{scopeFilesWrite, scopeDiariesRead, scopeFilesWrite},
+	})
+	if err != nil {
+		t.Fatalf("valid payload should pass: %v", err)
+	}
+	if name != "backup script" {
+		t.Fatalf("name = %q, want trimmed", name)
+	}
+	if want := []string{scopeDiariesRead, scopeFilesWrite}; !reflect.DeepEqual(scopes, want) {
+		t.Fatalf("scopes = %v, want %v", scopes, want)
+	}
+
+	invalid := []createTokenPayload{
+		{Name: "", Scopes: []string{scopeDiariesRead}},
+		{Name: strings.Repeat("a", maxTokenNameRunes+1), Scopes: []string{scopeDiariesRead}},
+		{Name: "script", Scopes: nil},
+		{Name: "script", Scopes: []string{"admin"}},
+		{Name: "script", Scopes: []string{scopeDiariesRead}, ExpiresInDays: -1},
+		{Name: "script", Scopes: []string{scopeDiariesRead}, ExpiresInDays: maxTokenExpiresDays + 1},
+	}
+	for _, payload := range invalid {
+		if _, _, err := validateTokenPayload(payload); err == nil {
+			t.Fatalf("payload %+v should fail", payload)
+		}
+	}
+}
+
+func TestAuthMiddlewareRejectsAccessTokenWithoutScope(t *testing.T) {
+	s := New(config.Config{JWTSecret: "secret"}, nil, nil)
+	handler := s.authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("handler should not be reached")
+	}))
+
+	raw, _, err := auth.GeneratePersonalAccessToken()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodPut, "/api/auth/password", nil)
+	req.Header.Set("Authorization", "Bearer "+raw)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+
+	"github.com/ymmtyamaterous/diary-oc-api/internal/model"
+)
+
+// handleListTrashedDiaries はゴミ箱の日記を削除日時の新しい順に返す。
+func (s *Server) handleListTrashedDiaries(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserID(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "認証トークンが無効です")
+		return
+	}
+
+	rows, err := s.db.Query(r.Context(), `
+		SELECT `+diaryColumns+`, deleted_at
+		FROM diary_entries
+		WHERE user_id = $1 AND deleted_at IS NOT NULL
+		ORDER BY deleted_at DESC, id DESC
+	`, userID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "ゴミ箱の取得に失敗しました")
+		return
+	}
+	defer rows.Close()
+
+	entries := make([]model.TrashedDiaryEntry, 0)
+	for rows.Next() {
+		var deletedAt time.Time
+		entry, err := scanDiaryEntry(rows, &deletedAt)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "ゴミ箱の取得に失敗しました")
+			return
+		}
+		entries = append(entries, model.TrashedDiaryEntry{
+			DiaryEntry: entry,
+			DeletedAt:  deletedAt,
+			PurgeAt:    deletedAt.AddDate(0, 0, s.cfg.DiaryTrashRetentionDays),
+		})
+	}
+	if err := rows.Err(); err != nil {
+		writeError(w, http.StatusInternalServerError, "ゴミ箱の取得に失敗しました")
+		return
+	}
+
+	writeData(w, http.StatusOK, entries)
+}
+
+// handleRestoreTrashedDiary はゴミ箱の日記を元に戻す。ゴミ箱に移す前の ETag で更新されないよう版を進める。
+func (s *Server) handleRestoreTrashedDiary(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserID(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "認証トークンが無効です")
+		return
+	}
+
+	id := chi.URLParam(r, "id")
+	if _, err := uuid.Parse(id); err != nil {
+		writeError(w, http.StatusBadRequest, "日記IDが不正です")
+		return
+	}
+
+	entry, err := scanDiaryEntry(s.db.QueryRow(r.Context(), `
+		UPDATE diary_entries
+		SET deleted_at = NULL, updated_at = NOW(), version = version + 1
+		WHERE id = $1 AND user_id = $2 AND deleted_at IS NOT NULL
+		RETURNING `+diaryColumns,
+		id, userID,
+	))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "ゴミ箱に日記が見つかりません")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "日記の復元に失敗しました")
+		return
+	}
+
+	writeDiary(w, http.StatusOK, entry)
+}
+
+// handlePurgeTrashedDiary はゴミ箱の日記を添付ファイルごと完全に削除する。ゴミ箱にない日記は削除できない。
+func (s *Server) handlePurgeTrashedDiary(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserID(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "認証トークンが無効です")
+		return
+	}
+
+	id := chi.URLParam(r, "id")
+	if _, err := uuid.Parse(id); err != nil {
+		writeError(w, http.StatusBadRequest, "日記IDが不正です")
+		return
+	}
+
+	purged, err := s.purgeDiaries(r.Context(), `
+		DELETE FROM diary_entries
+		WHERE id = $1 AND user_id = $2 AND deleted_at IS NOT NULL
+		RETURNING image_name, audio_name
+	`, id, userID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "日記削除に失敗しました")
+		return
+	}
+	if purged == 0 {
+		writeError(w, http.StatusNotFound, "ゴミ箱に日記が見つかりません")
+		return
+	}
+
+	writeData(w, http.StatusOK, map[string]string{"message": "日記を完全に削除しました"})
+}
+
+// purgeTrashedDiaries は保持期間を過ぎたゴミ箱の日記を添付ファイルごと削除する。
+func (s *Server) purgeTrashedDiaries(ctx context.Context) error {
+	_, err := s.purgeDiaries(ctx, `
+		DELETE FROM diary_entries
+		WHERE deleted_at <= NOW() - make_interval(days => $1)
+		RETURNING image_name, audio_name
+	`, s.cfg.DiaryTrashRetentionDays)
+	return err
+}
+
+// purgeDiaries は image_name, audio_name を RETURNING する DELETE 文を実行し、削除した日記の添付ファイルを消して件数を返す。
+func (s *Server) purgeDiaries(ctx context.Context, sql string, args ...any) (int, error) {
+	rows, err := s.db.Query(ctx, sql, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	files := make([]uploadedFile, 0)
+	purged := 0
+	for rows.Next() {
+		var imageName, audioName pgtype.Text
+		if err := rows.Scan(&imageName, &audioName); err != nil {
+			return 0, err
+		}
+		purged++
+		if imageName.Valid {
+			files = append(files, uploadedFile{dir: "images", name: imageName.String})
+		}
+		if audioName.Valid {
+			files = append(files, uploadedFile{dir: "audio", name: audioName.String})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	rows.Close()
+
+	files, err = s.unreferencedUploads(ctx, files)
+	if err != nil {
+		return 0, err
+	}
+	s.removeUploads(files)
+	return purged, nil
+}
+
+// uploadedFile は UPLOAD_DIR 配下のサブディレクトリ dir にあるアップロードファイル。
+type uploadedFile struct {
+	dir  string
+	name string
+}
+
+// unreferencedUploads は files のうち、残っている日記から参照されていない画像・音声を返す。
+// 日記には任意のファイル名を保存できるため、他の日記(他のユーザーのものを含む)が参照するファイルは削除対象から外す。
+// アバターはサーバーが名前を生成し本人だけが参照するため、そのまま返す。
+func (s *Server) unreferencedUploads(ctx context.Context, files []uploadedFile) ([]uploadedFile, error) {
+	unreferenced := make([]uploadedFile, 0, len(files))
+	for _, file := range files {
+		if file.dir == "images" || file.dir == "audio" {
+			var referenced bool
+			if err := s.db.QueryRow(ctx, `
+				SELECT EXISTS (SELECT 1 FROM diary_entries WHERE image_name = $1 OR audio_name = $1)
+			`, file.name).Scan(&referenced); err != nil {
+				return nil, err
+			}
+			if referenced {
+				continue
+			}
+		}
+		unreferenced = append(unreferenced, file)
+	}
+	return unreferenced, nil
+}
+
+// removeUploads はアップロードファイルを削除する。DB に保存された名前にディレクトリが含まれていても、
+// serveImage と同様に最後の要素だけを使い、UPLOAD_DIR/dir の外のファイルは削除しない。
+func (s *Server) removeUploads(files []uploadedFile) {
+	for _, file := range files {
+		name := filepath.Base(file.name)
+		if name == "." || name == ".." || name == string(filepath.Separator) {
+			continue
+		}
+		_ = os.Remove(filepath.Join(s.cfg.UploadDir, file.dir, name))
+	}
+}
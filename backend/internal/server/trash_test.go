@@ -0,0 +1,43 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ymmtyamaterous/diary-oc-api/internal/config"
+)
+
+func TestRemoveUploadsStaysInsideUploadDir(t *testing.T) {
+	root := t.TempDir()
+	uploadDir := filepath.Join(root, "uploads")
+	for _, dir := range []string{"images", "audio"} {
+		if err := os.MkdirAll(filepath.Join(uploadDir, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	image := filepath.Join(uploadDir, "images", "diary-image.png")
+	outside := filepath.Join(root, "secret.txt")
+	for _, path := range []string{image, outside} {
+		if err := os.WriteFile(path, []byte("x"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := New(config.Config{UploadDir: uploadDir}, nil, nil)
+	s.removeUploads([]uploadedFile{
+		{dir: "images", name: "diary-image.png"},
+		{dir: "audio", name: "../../secret.txt"},
+		{dir: "images", name: ".."},
+	})
+
+	if _, err := os.Stat(image); !os.IsNotExist(err) {
+		t.Fatalf("uploaded image should be removed, stat err = %v", err)
+	}
+	if _, err := os.Stat(outside); err != nil {
+		t.Fatalf("file outside the upload directory should be kept, stat err = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(uploadDir, "images")); err != nil {
+		t.Fatalf("upload subdirectory should be kept, stat err = %v", err)
+	}
+}
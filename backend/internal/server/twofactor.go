@@ -0,0 +1,389 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+
+	"github.com/ymmtyamaterous/diary-oc-api/internal/auth"
+	"github.com/ymmtyamaterous/diary-oc-api/internal/model"
+)
+
+const (
+	mfaTokenTTL       = 5 * time.Minute
+	recoveryCodeCount = 10
+)
+
+type mfaChallengeResponse struct {
+	MFARequired bool   `json:"mfa_required"`
+	MFAToken    string `json:"mfa_token"`
+}
+
+type twoFactorCodePayload struct {
+	Code string `json:"code"`
+}
+
+type twoFactorVerifyPayload struct {
+	MFAToken string `json:"mfa_token"`
+	Code     string `json:"code"`
+}
+
+type twoFactorDisablePayload struct {
+	Password string `json:"password"`
+	Code     string `json:"code"`
+}
+
+// completeLogin はパスワード認証に成功したユーザーに対し、2段階認証が有効であれば
+// 短命の mfa_token を、そうでなければ通常のセッションを返す。
+func (s *Server) completeLogin(w http.ResponseWriter, r *http.Request, user model.User) {
+	if user.TwoFactorEnabled {
+		mfaToken, err := auth.GenerateMFAToken(user.ID, s.keys, mfaTokenTTL)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "トークン生成に失敗しました")
+			return
+		}
+		writeData(w, http.StatusOK, mfaChallengeResponse{MFARequired: true, MFAToken: mfaToken})
+		return
+	}
+
+	response, err := s.startSession(r, user)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "トークン生成に失敗しました")
+		return
+	}
+
+	s.writeSession(w, http.StatusOK, response)
+}
+
+func (s *Server) handleVerifyTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var payload twoFactorVerifyPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeError(w, http.StatusBadRequest, "不正なリクエストです")
+		return
+	}
+
+	claims, err := auth.ParseMFAToken(payload.MFAToken, s.keys)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, "2段階認証の有効期限が切れました。再度ログインしてください")
+		return
+	}
+
+	ctx := r.Context()
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "2段階認証に失敗しました")
+		return
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	var secret pgtype.Text
+	var lastCounter int64
+	user, err := scanUser(tx.QueryRow(ctx, `
+		SELECT `+userColumns+`, totp_secret, totp_last_counter
+		FROM users
+		WHERE id = $1 AND totp_enabled_at IS NOT NULL
+		FOR UPDATE
+	`, claims.UserID), &secret, &lastCounter)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeError(w, http.StatusUnauthorized, "2段階認証の有効期限が切れました。再度ログインしてください")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "2段階認証に失敗しました")
+		return
+	}
+
+	throttle := s.newLoginThrottle(r, user.Email)
+	retryAfter, err := s.loginRetryAfter(ctx, throttle)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "2段階認証に失敗しました")
+		return
+	}
+	if retryAfter > 0 {
+		writeTooManyAttempts(w, retryAfter)
+		return
+	}
+
+	ok, err := verifySecondFactor(ctx, tx, user.ID, secret.String, lastCounter, payload.Code)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "2段階認証に失敗しました")
+		return
+	}
+	if !ok {
+		if err := s.recordLoginFailure(ctx, throttle, &user); err != nil {
+			writeError(w, http.StatusInternalServerError, "2段階認証に失敗しました")
+			return
+		}
+		writeError(w, http.StatusUnauthorized, "認証コードが正しくありません")
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, "2段階認証に失敗しました")
+		return
+	}
+	if err := s.clearLoginFailures(ctx, throttle); err != nil {
+		writeError(w, http.StatusInternalServerError, "2段階認証に失敗しました")
+		return
+	}
+
+	response, err := s.startSession(r, user)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "トークン生成に失敗しました")
+		return
+	}
+
+	s.writeSession(w, http.StatusOK, response)
+}
+
+// handleSetupTwoFactor は新しいシークレットを発行する。confirm で確認コードが検証されるまでは有効にならない。
+func (s *Server) handleSetupTwoFactor(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserID(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "認証トークンが無効です")
+		return
+	}
+
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "2段階認証の設定に失敗しました")
+		return
+	}
+
+	var email string
+	err = s.db.QueryRow(r.Context(), `
+		UPDATE users
+		SET totp_secret = $1, updated_at = NOW()
+		WHERE id = $2 AND totp_enabled_at IS NULL
+		RETURNING email
+	`, secret, userID).Scan(&email)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeError(w, http.StatusConflict, "2段階認証はすでに有効です")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "2段階認証の設定に失敗しました")
+		return
+	}
+
+	writeData(w, http.StatusOK, map[string]string{
+		"secret":      secret,
+		"otpauth_uri": auth.TOTPURI(s.cfg.TOTPIssuer, email, secret),
+	})
+}
+
+func (s *Server) handleConfirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserID(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "認証トークンが無効です")
+		return
+	}
+
+	var payload twoFactorCodePayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeError(w, http.StatusBadRequest, "不正なリクエストです")
+		return
+	}
+
+	ctx := r.Context()
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "2段階認証の設定に失敗しました")
+		return
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	var secret pgtype.Text
+	var enabledAt pgtype.Timestamptz
+	err = tx.QueryRow(ctx, `
+		SELECT totp_secret, totp_enabled_at
+		FROM users
+		WHERE id = $1
+		FOR UPDATE
+	`, userID).Scan(&secret, &enabledAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeError(w, http.StatusUnauthorized, "認証トークンが無効です")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "2段階認証の設定に失敗しました")
+		return
+	}
+	if enabledAt.Valid {
+		writeError(w, http.StatusConflict, "2段階認証はすでに有効です")
+		return
+	}
+	if !secret.Valid {
+		writeError(w, http.StatusBadRequest, "先に2段階認証のセットアップを行ってください")
+		return
+	}
+
+	counter, ok := auth.ValidateTOTP(secret.String, payload.Code, time.Now(), 0)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "認証コードが正しくありません")
+		return
+	}
+
+	if _, err := tx.Exec(ctx, `
+		UPDATE users
+		SET totp_enabled_at = NOW(), totp_last_counter = $1, updated_at = NOW()
+		WHERE id = $2
+	`, counter, userID); err != nil {
+		writeError(w, http.StatusInternalServerError, "2段階認証の設定に失敗しました")
+		return
+	}
+	codes, err := replaceRecoveryCodes(ctx, tx, userID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "2段階認証の設定に失敗しました")
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, "2段階認証の設定に失敗しました")
+		return
+	}
+
+	writeData(w, http.StatusOK, map[string]any{
+		"message":        "2段階認証を有効にしました。リカバリーコードを安全な場所に保管してください",
+		"recovery_codes": codes,
+	})
+}
+
+func (s *Server) handleDisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserID(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "認証トークンが無効です")
+		return
+	}
+
+	var payload twoFactorDisablePayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeError(w, http.StatusBadRequest, "不正なリクエストです")
+		return
+	}
+
+	ctx := r.Context()
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "2段階認証の解除に失敗しました")
+		return
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	var hash string
+	var secret pgtype.Text
+	var enabledAt pgtype.Timestamptz
+	var lastCounter int64
+	user, err := scanUser(tx.QueryRow(ctx, `
+		SELECT `+userColumns+`, COALESCE(password_hash, ''), totp_secret, totp_enabled_at, totp_last_counter
+		FROM users
+		WHERE id = $1
+		FOR UPDATE
+	`, userID), &hash, &secret, &enabledAt, &lastCounter)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeError(w, http.StatusUnauthorized, "認証トークンが無効です")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "2段階認証の解除に失敗しました")
+		return
+	}
+	if !enabledAt.Valid {
+		writeError(w, http.StatusBadRequest, "2段階認証は有効になっていません")
+		return
+	}
+	// パスワードや認証コードの総当たりを防ぐため、失敗はログインと同じくロックの対象にする
+	throttle, ok := s.checkReauthThrottle(w, r, user)
+	if !ok {
+		return
+	}
+	// パスワード未設定のアカウントでは、続く認証コードの確認を本人確認とする
+	if hash != "" {
+		if _, err := s.passwords.Verify(hash, payload.Password); err != nil {
+			s.rejectReauth(w, r, throttle, user, "パスワードが正しくありません")
+			return
+		}
+	}
+
+	ok, err = verifySecondFactor(ctx, tx, userID, secret.String, lastCounter, payload.Code)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "2段階認証の解除に失敗しました")
+		return
+	}
+	if !ok {
+		s.rejectReauth(w, r, throttle, user, "認証コードが正しくありません")
+		return
+	}
+
+	if _, err := tx.Exec(ctx, `
+		UPDATE users
+		SET totp_secret = NULL, totp_enabled_at = NULL, totp_last_counter = 0, updated_at = NOW()
+		WHERE id = $1
+	`, userID); err != nil {
+		writeError(w, http.StatusInternalServerError, "2段階認証の解除に失敗しました")
+		return
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID); err != nil {
+		writeError(w, http.StatusInternalServerError, "2段階認証の解除に失敗しました")
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, "2段階認証の解除に失敗しました")
+		return
+	}
+
+	writeData(w, http.StatusOK, map[string]string{"message": "2段階認証を解除しました"})
+}
+
+// verifySecondFactor は TOTP コードまたは未使用のリカバリーコードを検証し、使用済みとして記録する。
+func verifySecondFactor(ctx context.Context, q querier, userID, secret string, lastCounter int64, code string) (bool, error) {
+	if counter, ok := auth.ValidateTOTP(secret, code, time.Now(), lastCounter); ok {
+		cmd, err := q.Exec(ctx, `
+			UPDATE users SET totp_last_counter = $1
+			WHERE id = $2 AND totp_last_counter < $1
+		`, counter, userID)
+		if err != nil {
+			return false, err
+		}
+		return cmd.RowsAffected() == 1, nil
+	}
+
+	normalized := auth.NormalizeRecoveryCode(code)
+	if normalized == "" {
+		return false, nil
+	}
+	cmd, err := q.Exec(ctx, `
+		UPDATE recovery_codes SET used_at = NOW()
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL
+	`, userID, auth.HashOpaqueToken(normalized))
+	if err != nil {
+		return false, err
+	}
+	return cmd.RowsAffected() == 1, nil
+}
+
+// replaceRecoveryCodes は既存のリカバリーコードを破棄して新しいコードを発行し、平文を一度だけ返す。
+func replaceRecoveryCodes(ctx context.Context, q querier, userID string) ([]string, error) {
+	codes, err := auth.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := q.Exec(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return nil, err
+	}
+
+	hashes := make([]string, 0, len(codes))
+	for _, code := range codes {
+		hashes = append(hashes, auth.HashOpaqueToken(auth.NormalizeRecoveryCode(code)))
+	}
+	if _, err := q.Exec(ctx, `
+		INSERT INTO recovery_codes (user_id, code_hash)
+		SELECT $1, unnest($2::text[])
+	`, userID, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
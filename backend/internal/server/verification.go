@@ -0,0 +1,360 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"github.com/ymmtyamaterous/diary-oc-api/internal/auth"
+	"github.com/ymmtyamaterous/diary-oc-api/internal/config"
+	"github.com/ymmtyamaterous/diary-oc-api/internal/mail"
+	"github.com/ymmtyamaterous/diary-oc-api/internal/model"
+	"github.com/ymmtyamaterous/diary-oc-api/internal/validation"
+)
+
+const errPublishUnverified = "メールアドレスの確認が完了するまで日記を公開できません"
+
+const (
+	tokenPurposeVerify = "verify"
+	tokenPurposeChange = "change"
+)
+
+type verifyEmailPayload struct {
+	Token string `json:"token"`
+}
+
+type changeEmailPayload struct {
+	NewEmail string `json:"new_email"`
+	Password string `json:"password"`
+	// Code はパスワード未設定のアカウントで本人確認に使う2段階認証のコード
+	Code string `json:"code"`
+}
+
+// sendVerificationMail は確認用トークンを発行し、登録メールアドレス宛てに送信する。
+// 送信失敗は登録自体を失敗させないよう、ログに残して呼び出し元には返さない。
+func (s *Server) sendVerificationMail(ctx context.Context, user model.User) {
+	if err := s.issueVerificationMail(ctx, user); err != nil {
+		log.Printf("verification mail failed: user=%s err=%v", user.ID, err)
+	}
+}
+
+func (s *Server) issueVerificationMail(ctx context.Context, user model.User) error {
+	rawToken, tokenHash, err := auth.GenerateOpaqueToken()
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.db.Exec(ctx, `
+		WITH expired AS (
+			UPDATE email_verification_tokens SET used_at = NOW()
+			WHERE user_id = $1 AND purpose = $5 AND used_at IS NULL
+		)
+		INSERT INTO email_verification_tokens (user_id, email, token_hash, expires_at, purpose)
+		VALUES ($1, $2, $3, $4, $5)
+	`, user.ID, user.Email, tokenHash, s.verificationExpiry(), tokenPurposeVerify); err != nil {
+		return err
+	}
+
+	verifyURL := s.cfg.AppBaseURL + "/verify-email?token=" + url.QueryEscape(rawToken)
+	return s.mailer.Send(ctx, mail.Message{
+		To:      user.Email,
+		Subject: "【Diary Open Close】メールアドレスの確認",
+		Body: fmt.Sprintf(
+			"%s さん\n\nご登録ありがとうございます。\n以下のURLから%d時間以内にメールアドレスを確認してください。\n%s\n\nお心当たりがない場合はこのメールを破棄してください。\n",
+			user.DisplayName,
+			s.cfg.EmailVerificationHours,
+			verifyURL,
+		),
+	})
+}
+
+func (s *Server) handleVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var payload verifyEmailPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeError(w, http.StatusBadRequest, "不正なリクエストです")
+		return
+	}
+	if strings.TrimSpace(payload.Token) == "" {
+		writeError(w, http.StatusBadRequest, "確認トークンは必須です")
+		return
+	}
+
+	ctx := r.Context()
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "メールアドレスの確認に失敗しました")
+		return
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	// トークン発行後にメールアドレスが変わっていた場合は無効として扱う。
+	var tokenID, userID string
+	err = tx.QueryRow(ctx, `
+		SELECT t.id, t.user_id
+		FROM email_verification_tokens t
+		JOIN users u ON u.id = t.user_id AND u.email = t.email
+		WHERE t.token_hash = $1 AND t.purpose = $2 AND t.used_at IS NULL AND t.expires_at > NOW()
+		FOR UPDATE OF t
+	`, auth.HashOpaqueToken(strings.TrimSpace(payload.Token)), tokenPurposeVerify).Scan(&tokenID, &userID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeError(w, http.StatusBadRequest, "確認トークンが無効か、有効期限が切れています")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "メールアドレスの確認に失敗しました")
+		return
+	}
+
+	if _, err := tx.Exec(ctx, `
+		UPDATE users
+		SET email_verified_at = COALESCE(email_verified_at, NOW()), updated_at = NOW()
+		WHERE id = $1
+	`, userID); err != nil {
+		writeError(w, http.StatusInternalServerError, "メールアドレスの確認に失敗しました")
+		return
+	}
+	if _, err := tx.Exec(ctx, `UPDATE email_verification_tokens SET used_at = NOW() WHERE id = $1`, tokenID); err != nil {
+		writeError(w, http.StatusInternalServerError, "メールアドレスの確認に失敗しました")
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, "メールアドレスの確認に失敗しました")
+		return
+	}
+
+	writeData(w, http.StatusOK, map[string]string{"message": "メールアドレスを確認しました"})
+}
+
+func (s *Server) handleResendVerification(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserID(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "認証トークンが無効です")
+		return
+	}
+
+	user, err := scanUser(s.db.QueryRow(r.Context(), `
+		SELECT `+userColumns+`
+		FROM users
+		WHERE id = $1
+	`, userID))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeError(w, http.StatusUnauthorized, "認証トークンが無効です")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "ユーザー情報取得に失敗しました")
+		return
+	}
+	if user.EmailVerifiedAt != nil {
+		writeError(w, http.StatusBadRequest, "メールアドレスはすでに確認済みです")
+		return
+	}
+
+	if err := s.issueVerificationMail(r.Context(), user); err != nil {
+		writeError(w, http.StatusInternalServerError, "確認メールの送信に失敗しました")
+		return
+	}
+
+	writeData(w, http.StatusOK, map[string]string{"message": "確認メールを再送信しました"})
+}
+
+// handleRequestEmailChange は新しいメールアドレス宛てに確認メールを送る。
+// 確認が完了するまでメールアドレスは切り替えない。
+func (s *Server) handleRequestEmailChange(w http.ResponseWriter, r *http.Request) {
+	userID, ok := getUserID(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "認証トークンが無効です")
+		return
+	}
+
+	var payload changeEmailPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeError(w, http.StatusBadRequest, "不正なリクエストです")
+		return
+	}
+	if err := validation.RequireEmail(payload.NewEmail); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	newEmail := strings.TrimSpace(payload.NewEmail)
+
+	var hash string
+	user, err := scanUser(s.db.QueryRow(r.Context(), `
+		SELECT `+userColumns+`, COALESCE(password_hash, '')
+		FROM users
+		WHERE id = $1
+	`, userID), &hash)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeError(w, http.StatusUnauthorized, "認証トークンが無効です")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "ユーザー情報取得に失敗しました")
+		return
+	}
+	throttle, ok := s.checkReauthThrottle(w, r, user)
+	if !ok {
+		return
+	}
+	if hash == "" {
+		confirmed, err := s.confirmWithoutPassword(r.Context(), s.db, userID, payload.Code)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "メールアドレス変更の受付に失敗しました")
+			return
+		}
+		if !confirmed {
+			s.rejectWithoutPassword(w, r, throttle, user, payload.Code)
+			return
+		}
+	} else if _, err := s.passwords.Verify(hash, payload.Password); err != nil {
+		s.rejectReauth(w, r, throttle, user, "パスワードが正しくありません")
+		return
+	}
+	if newEmail == user.Email {
+		writeError(w, http.StatusBadRequest, "現在と同じメールアドレスです")
+		return
+	}
+
+	var taken bool
+	if err := s.db.QueryRow(r.Context(), `SELECT EXISTS(SELECT 1 FROM users WHERE email = $1)`, newEmail).Scan(&taken); err != nil {
+		writeError(w, http.StatusInternalServerError, "メールアドレス変更の受付に失敗しました")
+		return
+	}
+	if taken {
+		writeError(w, http.StatusConflict, "このメールアドレスはすでに登録されています")
+		return
+	}
+
+	rawToken, tokenHash, err := auth.GenerateOpaqueToken()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "トークン生成に失敗しました")
+		return
+	}
+	if _, err := s.db.Exec(r.Context(), `
+		WITH expired AS (
+			UPDATE email_verification_tokens SET used_at = NOW()
+			WHERE user_id = $1 AND purpose = $5 AND used_at IS NULL
+		)
+		INSERT INTO email_verification_tokens (user_id, email, token_hash, expires_at, purpose)
+		VALUES ($1, $2, $3, $4, $5)
+	`, userID, newEmail, tokenHash, s.verificationExpiry(), tokenPurposeChange); err != nil {
+		writeError(w, http.StatusInternalServerError, "メールアドレス変更の受付に失敗しました")
+		return
+	}
+
+	confirmURL := s.cfg.AppBaseURL + "/email/confirm?token=" + url.QueryEscape(rawToken)
+	if err := s.mailer.Send(r.Context(), mail.Message{
+		To:      newEmail,
+		Subject: "【Diary Open Close】メールアドレス変更の確認",
+		Body: fmt.Sprintf(
+			"%s さん\n\nメールアドレスの変更リクエストを受け付けました。\n以下のURLから%d時間以内に変更を確定してください。\n%s\n\nお心当たりがない場合はこのメールを破棄してください。\n",
+			user.DisplayName,
+			s.cfg.EmailVerificationHours,
+			confirmURL,
+		),
+	}); err != nil {
+		writeError(w, http.StatusInternalServerError, "確認メールの送信に失敗しました")
+		return
+	}
+
+	writeData(w, http.StatusOK, map[string]string{"message": "新しいメールアドレスに確認メールを送信しました"})
+}
+
+func (s *Server) handleConfirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	var payload verifyEmailPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeError(w, http.StatusBadRequest, "不正なリクエストです")
+		return
+	}
+	if strings.TrimSpace(payload.Token) == "" {
+		writeError(w, http.StatusBadRequest, "確認トークンは必須です")
+		return
+	}
+
+	ctx := r.Context()
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "メールアドレスの変更に失敗しました")
+		return
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	var tokenID, userID, newEmail, oldEmail string
+	err = tx.QueryRow(ctx, `
+		SELECT t.id, t.user_id, t.email, u.email
+		FROM email_verification_tokens t
+		JOIN users u ON u.id = t.user_id
+		WHERE t.token_hash = $1 AND t.purpose = $2 AND t.used_at IS NULL AND t.expires_at > NOW()
+		FOR UPDATE OF t, u
+	`, auth.HashOpaqueToken(strings.TrimSpace(payload.Token)), tokenPurposeChange).Scan(&tokenID, &userID, &newEmail, &oldEmail)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeError(w, http.StatusBadRequest, "確認トークンが無効か、有効期限が切れています")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "メールアドレスの変更に失敗しました")
+		return
+	}
+
+	if _, err := tx.Exec(ctx, `
+		UPDATE users
+		SET email = $1, email_verified_at = NOW(), updated_at = NOW()
+		WHERE id = $2
+	`, newEmail, userID); err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			writeError(w, http.StatusConflict, "このメールアドレスはすでに登録されています")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "メールアドレスの変更に失敗しました")
+		return
+	}
+	if _, err := tx.Exec(ctx, `UPDATE email_verification_tokens SET used_at = NOW() WHERE id = $1`, tokenID); err != nil {
+		writeError(w, http.StatusInternalServerError, "メールアドレスの変更に失敗しました")
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, "メールアドレスの変更に失敗しました")
+		return
+	}
+
+	// 乗っ取り時に気付けるよう、旧アドレスにも変更を通知する。
+	if err := s.mailer.Send(ctx, mail.Message{
+		To:      oldEmail,
+		Subject: "【Diary Open Close】メールアドレスが変更されました",
+		Body:    fmt.Sprintf("アカウントのメールアドレスが %s に変更されました。\n\nお心当たりがない場合はサポートまでご連絡ください。\n", newEmail),
+	}); err != nil {
+		log.Printf("email change notice failed: user=%s err=%v", userID, err)
+	}
+
+	writeData(w, http.StatusOK, map[string]string{"message": "メールアドレスを変更しました"})
+}
+
+func (s *Server) verificationExpiry() time.Time {
+	return time.Now().Add(time.Duration(s.cfg.EmailVerificationHours) * time.Hour)
+}
+
+// requireVerifiedEmail は EMAIL_VERIFICATION_POLICY=required の場合に未確認アカウントを拒否する。
+// authMiddleware の後に適用すること。
+func (s *Server) requireVerifiedEmail(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.cfg.EmailVerificationPolicy == config.EmailPolicyRequired && !isEmailVerified(r.Context()) {
+			writeError(w, http.StatusForbidden, "メールアドレスの確認が完了していません")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) canPublish(ctx context.Context) bool {
+	return s.cfg.EmailVerificationPolicy == config.EmailPolicyNone || isEmailVerified(ctx)
+}
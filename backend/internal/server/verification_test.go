@@ -0,0 +1,60 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ymmtyamaterous/diary-oc-api/internal/config"
+)
+
+func TestRequireVerifiedEmail(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   string
+		verified bool
+		want     int
+	}{
+		{name: "required unverified", policy: config.EmailPolicyRequired, verified: false, want: http.StatusForbidden},
+		{name: "required verified", policy: config.EmailPolicyRequired, verified: true, want: http.StatusOK},
+		{name: "restrict public unverified", policy: config.EmailPolicyRestrictPublic, verified: false, want: http.StatusOK},
+		{name: "none unverified", policy: config.EmailPolicyNone, verified: false, want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(config.Config{EmailVerificationPolicy: tt.policy}, nil, nil)
+			handler := s.requireVerifiedEmail(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/api/diaries", nil)
+			req = req.WithContext(context.WithValue(req.Context(), emailVerifiedKey, tt.verified))
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestCanPublish(t *testing.T) {
+	unverified := context.WithValue(context.Background(), emailVerifiedKey, false)
+	verified := context.WithValue(context.Background(), emailVerifiedKey, true)
+
+	restrict := New(config.Config{EmailVerificationPolicy: config.EmailPolicyRestrictPublic}, nil, nil)
+	if restrict.canPublish(unverified) {
+		t.Fatal("unverified user should not publish under restrict_public")
+	}
+	if !restrict.canPublish(verified) {
+		t.Fatal("verified user should publish")
+	}
+
+	none := New(config.Config{EmailVerificationPolicy: config.EmailPolicyNone}, nil, nil)
+	if !none.canPublish(unverified) {
+		t.Fatal("policy none should allow publishing")
+	}
+}
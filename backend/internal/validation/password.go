@@ -0,0 +1,136 @@
+package validation
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	PasswordTooShort         = "too_short"
+	PasswordTooLong          = "too_long"
+	PasswordContainsPersonal = "contains_personal_info"
+	PasswordBreached         = "breached"
+
+	// bcrypt は先頭72バイトしか使わないため、それ以上は受け付けない。
+	defaultPasswordMaxBytes  = 72
+	defaultPasswordMinLength = 8
+	// 短すぎる表示名やメールアドレスのローカル部は偶然の一致が多いため照合しない。
+	minPersonalInfoLength = 3
+)
+
+// PasswordPolicy はパスワードの要件。登録・再設定・変更で共通に使う。
+type PasswordPolicy struct {
+	// MinLength は文字数(rune 数)の下限。
+	MinLength int
+	// MaxBytes は UTF-8 でのバイト数の上限。
+	MaxBytes int
+	// Breached は漏洩済み・よく使われるパスワード(小文字)の集合。
+	Breached map[string]struct{}
+}
+
+// PasswordViolation はパスワードが要件を満たさない理由。
+type PasswordViolation struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// PasswordError は満たしていない要件の一覧。Error は先頭の理由を返す。
+type PasswordError struct {
+	Violations []PasswordViolation
+}
+
+func (e *PasswordError) Error() string {
+	return e.Violations[0].Message
+}
+
+// DefaultPasswordPolicy は8文字以上・72バイト以内の要件を返す。
+func DefaultPasswordPolicy() PasswordPolicy {
+	return PasswordPolicy{MinLength: defaultPasswordMinLength, MaxBytes: defaultPasswordMaxBytes}
+}
+
+// Check はパスワードを検証し、要件を満たさない場合は *PasswordError を返す。
+// personal にはメールアドレスや表示名など、パスワードに含めてはいけない値を渡す。
+func (p PasswordPolicy) Check(password string, personal ...string) error {
+	minLength := p.MinLength
+	if minLength <= 0 {
+		minLength = defaultPasswordMinLength
+	}
+	maxBytes := p.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultPasswordMaxBytes
+	}
+
+	var violations []PasswordViolation
+	if utf8.RuneCountInString(password) < minLength {
+		violations = append(violations, PasswordViolation{
+			Code:    PasswordTooShort,
+			Message: fmt.Sprintf("パスワードは%d文字以上で入力してください", minLength),
+		})
+	}
+	if len(password) > maxBytes {
+		violations = append(violations, PasswordViolation{
+			Code:    PasswordTooLong,
+			Message: fmt.Sprintf("パスワードが長すぎます（%dバイト以内、全角文字は1文字3バイト）", maxBytes),
+		})
+	}
+	if containsPersonalInfo(password, personal) {
+		violations = append(violations, PasswordViolation{
+			Code:    PasswordContainsPersonal,
+			Message: "パスワードにメールアドレスや表示名を含めないでください",
+		})
+	}
+	if _, ok := p.Breached[strings.ToLower(password)]; ok {
+		violations = append(violations, PasswordViolation{
+			Code:    PasswordBreached,
+			Message: "このパスワードは漏洩済みか推測されやすいため使用できません",
+		})
+	}
+
+	if len(violations) > 0 {
+		return &PasswordError{Violations: violations}
+	}
+	return nil
+}
+
+func containsPersonalInfo(password string, personal []string) bool {
+	lower := strings.ToLower(password)
+	for _, value := range personal {
+		value = strings.ToLower(strings.TrimSpace(value))
+		candidates := []string{value}
+		if local, _, ok := strings.Cut(value, "@"); ok {
+			candidates = append(candidates, local)
+		}
+		for _, candidate := range candidates {
+			if utf8.RuneCountInString(candidate) >= minPersonalInfoLength && strings.Contains(lower, candidate) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// LoadPasswordList は1行1パスワードのファイルを読み込む。空行と # で始まる行は無視する。
+func LoadPasswordList(path string) (map[string]struct{}, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	list := map[string]struct{}{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		list[strings.ToLower(line)] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
@@ -0,0 +1,95 @@
+package validation
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func violationCodes(t *testing.T, err error) []string {
+	t.Helper()
+	if err == nil {
+		return nil
+	}
+	var policyErr *PasswordError
+	if !errors.As(err, &policyErr) {
+		t.Fatalf("error should be *PasswordError, got %T", err)
+	}
+	codes := make([]string, 0, len(policyErr.Violations))
+	for _, violation := range policyErr.Violations {
+		codes = append(codes, violation.Code)
+	}
+	return codes
+}
+
+func TestPasswordPolicyCheck(t *testing.T) {
+	policy := PasswordPolicy{
+		MinLength: 8,
+		MaxBytes:  72,
+		Breached:  map[string]struct{}{"password123": {}},
+	}
+
+	tests := []struct {
+		name     string
+		password string
+		want     string
+	}{
+		{name: "valid", password: "correct horse", want: ""},
+		{name: "japanese counts runes", password: "にっきをかくのがすき", want: ""},
+		{name: "too short", password: "日記を書く", want: PasswordTooShort},
+		{name: "too long in bytes", password: strings.Repeat("日", 25), want: PasswordTooLong},
+		{name: "contains email local part", password: "taro.yamada-2026", want: PasswordContainsPersonal},
+		{name: "contains display name", password: "山田たろう最高です", want: PasswordContainsPersonal},
+		{name: "breached ignores case", password: "Password123", want: PasswordBreached},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			codes := violationCodes(t, policy.Check(tt.password, "Taro.Yamada@example.com", "山田たろう"))
+			if tt.want == "" {
+				if len(codes) != 0 {
+					t.Fatalf("Check() violations = %v, want none", codes)
+				}
+				return
+			}
+			if len(codes) != 1 || codes[0] != tt.want {
+				t.Fatalf("Check() violations = %v, want [%s]", codes, tt.want)
+			}
+		})
+	}
+}
+
+func TestPasswordPolicyReportsAllViolations(t *testing.T) {
+	policy := PasswordPolicy{Breached: map[string]struct{}{"taro": {}}}
+	codes := violationCodes(t, policy.Check("taro", "taro@example.com"))
+	want := []string{PasswordTooShort, PasswordContainsPersonal, PasswordBreached}
+	if strings.Join(codes, ",") != strings.Join(want, ",") {
+		t.Fatalf("Check() violations = %v, want %v", codes, want)
+	}
+}
+
+func TestLoadPasswordList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	if err := os.WriteFile(path, []byte("# common passwords\nPassword\n\n  qwerty123  \n"), 0o600); err != nil {
+		t.Fatalf("write list: %v", err)
+	}
+
+	list, err := LoadPasswordList(path)
+	if err != nil {
+		t.Fatalf("LoadPasswordList() error = %v", err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("LoadPasswordList() = %v, want 2 entries", list)
+	}
+	for _, password := range []string{"password", "qwerty123"} {
+		if _, ok := list[password]; !ok {
+			t.Fatalf("LoadPasswordList() missing %q", password)
+		}
+	}
+
+	if _, err := LoadPasswordList(filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Fatal("missing file should fail")
+	}
+}
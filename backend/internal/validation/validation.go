@@ -2,7 +2,9 @@ package validation
 
 import (
 	"errors"
+	"fmt"
 	"strings"
+	"unicode/utf8"
 )
 
 var validWeather = map[string]struct{}{
@@ -27,11 +29,9 @@ func RequireEmail(email string) error {
 	return nil
 }
 
+// RequirePassword は既定のパスワード要件で検証する。設定済みの要件を使う場合は PasswordPolicy.Check を使う。
 func RequirePassword(password string) error {
-	if len(password) < 8 {
-		return errors.New("パスワードは8文字以上で入力してください")
-	}
-	return nil
+	return DefaultPasswordPolicy().Check(password)
 }
 
 func RequireDisplayName(displayName string) error {
@@ -51,6 +51,17 @@ func ValidateWeather(weather *string) error {
 	return nil
 }
 
+// ValidateFileName はアップロード済みファイルの名前を検証する。ディレクトリを含む名前は受け付けない。
+func ValidateFileName(name *string) error {
+	if name == nil || *name == "" {
+		return nil
+	}
+	if strings.ContainsAny(*name, `/\`) || *name == "." || *name == ".." {
+		return errors.New("ファイル名が不正です")
+	}
+	return nil
+}
+
 func ValidateDiaryFilled(fields map[string]*string) error {
 	for _, value := range fields {
 		if value != nil && strings.TrimSpace(*value) != "" {
@@ -59,3 +70,44 @@ func ValidateDiaryFilled(fields map[string]*string) error {
 	}
 	return errors.New("少なくとも1つの項目を入力してください")
 }
+
+const (
+	MaxTagRunes     = 50
+	MaxTagsPerDiary = 20
+)
+
+// NormalizeTags は前後の空白を除き、空のタグと大文字小文字だけが異なる重複を取り除く。
+func NormalizeTags(tags []string) ([]string, error) {
+	normalized := make([]string, 0, len(tags))
+	seen := map[string]bool{}
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		if err := ValidateTagName(tag); err != nil {
+			return nil, err
+		}
+		key := strings.ToLower(tag)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		normalized = append(normalized, tag)
+	}
+	if len(normalized) > MaxTagsPerDiary {
+		return nil, fmt.Errorf("タグは1つの日記に%d個までです", MaxTagsPerDiary)
+	}
+	return normalized, nil
+}
+
+// ValidateTagName は前後の空白を除いたタグ名を検証する。
+func ValidateTagName(name string) error {
+	if name == "" {
+		return errors.New("タグ名は必須です")
+	}
+	if utf8.RuneCountInString(name) > MaxTagRunes {
+		return fmt.Errorf("タグ名は%d文字以内で入力してください", MaxTagRunes)
+	}
+	return nil
+}
@@ -1,6 +1,10 @@
 package validation
 
-import "testing"
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
 
 func strPtr(s string) *string {
 	return &s
@@ -18,6 +22,23 @@ func TestValidateWeather(t *testing.T) {
 	}
 }
 
+func TestValidateFileName(t *testing.T) {
+	for _, name := range []string{"", "diary-image-1.png"} {
+		if err := ValidateFileName(strPtr(name)); err != nil {
+			t.Fatalf("expected %q to be valid, got error: %v", name, err)
+		}
+	}
+	if err := ValidateFileName(nil); err != nil {
+		t.Fatalf("expected nil name to be valid, got error: %v", err)
+	}
+
+	for _, name := range []string{"../../etc/passwd", "images/a.png", `..\a.png`, ".."} {
+		if err := ValidateFileName(strPtr(name)); err == nil {
+			t.Fatalf("expected %q to be rejected", name)
+		}
+	}
+}
+
 func TestValidateDiaryFilled(t *testing.T) {
 	empty := map[string]*string{
 		"content": nil,
@@ -57,3 +78,24 @@ func TestAuthValidation(t *testing.T) {
 		t.Fatal("expected display name required error")
 	}
 }
+
+func TestNormalizeTags(t *testing.T) {
+	got, err := NormalizeTags([]string{" 旅行 ", "Work", "", "work", "読書"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := []string{"旅行", "Work", "読書"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("NormalizeTags() = %v, want %v", got, want)
+	}
+
+	if _, err := NormalizeTags([]string{strings.Repeat("あ", MaxTagRunes+1)}); err == nil {
+		t.Fatal("expected error for too long tag")
+	}
+	tooMany := make([]string, 0, MaxTagsPerDiary+1)
+	for i := range MaxTagsPerDiary + 1 {
+		tooMany = append(tooMany, strings.Repeat("a", i+1))
+	}
+	if _, err := NormalizeTags(tooMany); err == nil {
+		t.Fatal("expected error for too many tags")
+	}
+}
@@ -0,0 +1,30 @@
+CREATE TABLE IF NOT EXISTS sessions (
+    id         UUID        NOT NULL DEFAULT gen_random_uuid(),
+    user_id    UUID        NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    revoked_at TIMESTAMPTZ,
+    CONSTRAINT sessions_pkey PRIMARY KEY (id),
+    CONSTRAINT sessions_user_id_fkey FOREIGN KEY (user_id)
+        REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_sessions_user_id
+    ON sessions (user_id);
+
+-- 1セッション(トークンファミリー)に対してローテーションされたリフレッシュトークンを保持する。
+-- 使用済み(used_at != NULL)のトークンが再提示された場合はファミリーごと失効させる。
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    id         UUID        NOT NULL DEFAULT gen_random_uuid(),
+    session_id UUID        NOT NULL,
+    token_hash VARCHAR(64) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    used_at    TIMESTAMPTZ,
+    CONSTRAINT refresh_tokens_pkey PRIMARY KEY (id),
+    CONSTRAINT refresh_tokens_token_hash_key UNIQUE (token_hash),
+    CONSTRAINT refresh_tokens_session_id_fkey FOREIGN KEY (session_id)
+        REFERENCES sessions(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_session_id
+    ON refresh_tokens (session_id);
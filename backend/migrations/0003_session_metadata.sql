@@ -0,0 +1,8 @@
+ALTER TABLE sessions
+    ADD COLUMN IF NOT EXISTS user_agent   VARCHAR(500),
+    ADD COLUMN IF NOT EXISTS ip_address   VARCHAR(45),
+    ADD COLUMN IF NOT EXISTS last_seen_at TIMESTAMPTZ NOT NULL DEFAULT NOW();
+
+CREATE INDEX IF NOT EXISTS idx_sessions_user_active
+    ON sessions (user_id, last_seen_at DESC)
+    WHERE revoked_at IS NULL;
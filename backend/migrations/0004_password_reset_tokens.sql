@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS password_reset_tokens (
+    id         UUID        NOT NULL DEFAULT gen_random_uuid(),
+    user_id    UUID        NOT NULL,
+    token_hash VARCHAR(64) NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at    TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    CONSTRAINT password_reset_tokens_pkey PRIMARY KEY (id),
+    CONSTRAINT password_reset_tokens_token_hash_key UNIQUE (token_hash),
+    CONSTRAINT password_reset_tokens_user_id_fkey FOREIGN KEY (user_id)
+        REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_password_reset_tokens_user_id
+    ON password_reset_tokens (user_id);
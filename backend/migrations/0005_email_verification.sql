@@ -0,0 +1,22 @@
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS email_verified_at TIMESTAMPTZ;
+
+-- 確認機能の導入前に登録済みのユーザーは確認済みとして扱う
+UPDATE users SET email_verified_at = created_at WHERE email_verified_at IS NULL;
+
+CREATE TABLE IF NOT EXISTS email_verification_tokens (
+    id         UUID         NOT NULL DEFAULT gen_random_uuid(),
+    user_id    UUID         NOT NULL,
+    email      VARCHAR(255) NOT NULL,
+    token_hash VARCHAR(64)  NOT NULL,
+    expires_at TIMESTAMPTZ  NOT NULL,
+    used_at    TIMESTAMPTZ,
+    created_at TIMESTAMPTZ  NOT NULL DEFAULT NOW(),
+    CONSTRAINT email_verification_tokens_pkey PRIMARY KEY (id),
+    CONSTRAINT email_verification_tokens_token_hash_key UNIQUE (token_hash),
+    CONSTRAINT email_verification_tokens_user_id_fkey FOREIGN KEY (user_id)
+        REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_email_verification_tokens_user_id
+    ON email_verification_tokens (user_id);
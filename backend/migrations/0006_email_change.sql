@@ -0,0 +1,3 @@
+-- verify: 登録メールアドレスの確認 / change: メールアドレス変更時の新アドレス確認
+ALTER TABLE email_verification_tokens
+    ADD COLUMN IF NOT EXISTS purpose VARCHAR(20) NOT NULL DEFAULT 'verify';
@@ -0,0 +1,7 @@
+-- 削除猶予期間中のアカウントは delete_after に完全削除予定日時を持つ
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS delete_after TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS idx_users_delete_after
+    ON users (delete_after)
+    WHERE delete_after IS NOT NULL;
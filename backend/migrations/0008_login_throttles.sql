@@ -0,0 +1,9 @@
+-- ログイン失敗回数をアカウント(メールアドレス)単位・接続元IP単位で記録する
+CREATE TABLE IF NOT EXISTS login_throttles (
+    scope          VARCHAR(10)  NOT NULL,
+    key            VARCHAR(255) NOT NULL,
+    failures       INTEGER      NOT NULL DEFAULT 0,
+    locked_until   TIMESTAMPTZ,
+    last_failed_at TIMESTAMPTZ  NOT NULL DEFAULT NOW(),
+    CONSTRAINT login_throttles_pkey PRIMARY KEY (scope, key)
+);
@@ -0,0 +1,17 @@
+-- totp_secret はセットアップ開始時に保存し、確認コードの検証後に totp_enabled_at を設定して有効化する
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS totp_secret       VARCHAR(64),
+    ADD COLUMN IF NOT EXISTS totp_enabled_at   TIMESTAMPTZ,
+    ADD COLUMN IF NOT EXISTS totp_last_counter BIGINT NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    id         UUID        NOT NULL DEFAULT gen_random_uuid(),
+    user_id    UUID        NOT NULL,
+    code_hash  VARCHAR(64) NOT NULL,
+    used_at    TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    CONSTRAINT recovery_codes_pkey PRIMARY KEY (id),
+    CONSTRAINT recovery_codes_user_id_code_hash_key UNIQUE (user_id, code_hash),
+    CONSTRAINT recovery_codes_user_id_fkey FOREIGN KEY (user_id)
+        REFERENCES users(id) ON DELETE CASCADE
+);
@@ -0,0 +1,32 @@
+-- 外部IDプロバイダのみで登録したアカウントはパスワードを持たない
+ALTER TABLE users ALTER COLUMN password_hash DROP NOT NULL;
+
+CREATE TABLE IF NOT EXISTS user_identities (
+    id         UUID         NOT NULL DEFAULT gen_random_uuid(),
+    user_id    UUID         NOT NULL,
+    provider   VARCHAR(50)  NOT NULL,
+    subject    VARCHAR(255) NOT NULL,
+    email      VARCHAR(255),
+    created_at TIMESTAMPTZ  NOT NULL DEFAULT NOW(),
+    CONSTRAINT user_identities_pkey PRIMARY KEY (id),
+    CONSTRAINT user_identities_provider_subject_key UNIQUE (provider, subject),
+    CONSTRAINT user_identities_user_id_provider_key UNIQUE (user_id, provider),
+    CONSTRAINT user_identities_user_id_fkey FOREIGN KEY (user_id)
+        REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- 認可リクエストごとの state / nonce / PKCE verifier。user_id がある場合は既存アカウントへの連携
+CREATE TABLE IF NOT EXISTS oidc_login_states (
+    state_hash    VARCHAR(64)  NOT NULL,
+    provider      VARCHAR(50)  NOT NULL,
+    nonce         VARCHAR(64)  NOT NULL,
+    code_verifier VARCHAR(128) NOT NULL,
+    user_id       UUID,
+    expires_at    TIMESTAMPTZ  NOT NULL,
+    created_at    TIMESTAMPTZ  NOT NULL DEFAULT NOW(),
+    CONSTRAINT oidc_login_states_pkey PRIMARY KEY (state_hash),
+    CONSTRAINT oidc_login_states_user_id_fkey FOREIGN KEY (user_id)
+        REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_oidc_login_states_expires_at ON oidc_login_states(expires_at);
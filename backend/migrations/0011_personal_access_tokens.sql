@@ -0,0 +1,18 @@
+-- スクリプトや外部連携用のパーソナルアクセストークン。平文は発行時に一度だけ返し、SHA-256 ハッシュのみ保存する
+CREATE TABLE IF NOT EXISTS personal_access_tokens (
+    id           UUID         NOT NULL DEFAULT gen_random_uuid(),
+    user_id      UUID         NOT NULL,
+    name         VARCHAR(100) NOT NULL,
+    token_hash   VARCHAR(64)  NOT NULL,
+    token_prefix VARCHAR(16)  NOT NULL,
+    scopes       TEXT[]       NOT NULL,
+    expires_at   TIMESTAMPTZ,
+    last_used_at TIMESTAMPTZ,
+    created_at   TIMESTAMPTZ  NOT NULL DEFAULT NOW(),
+    CONSTRAINT personal_access_tokens_pkey PRIMARY KEY (id),
+    CONSTRAINT personal_access_tokens_token_hash_key UNIQUE (token_hash),
+    CONSTRAINT personal_access_tokens_user_id_fkey FOREIGN KEY (user_id)
+        REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_personal_access_tokens_user_id ON personal_access_tokens(user_id);
@@ -0,0 +1,4 @@
+-- 著者ごとの公開日記タイムライン(GET /api/users/{id}/diaries/public)用。カーソルの並び順と揃える
+CREATE INDEX IF NOT EXISTS idx_diary_entries_public_author
+    ON diary_entries (user_id, created_at DESC, id DESC)
+    WHERE is_public = TRUE;
@@ -0,0 +1,23 @@
+-- 日記の全文検索(GET /api/diaries/search)用。
+-- 日本語は単語を空白で区切らないため、形態素解析の不要なトライグラム(pg_trgm)で部分一致検索する。
+-- トライグラムの抽出は LC_CTYPE に依存するため、データベースは C 以外の UTF-8 ロケールで作成すること。
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+-- 検索対象の項目を1列にまとめる。項目をまたいで一致しないよう改行で区切る
+ALTER TABLE diary_entries
+    ADD COLUMN IF NOT EXISTS search_text TEXT GENERATED ALWAYS AS (
+        COALESCE(content, '') || E'\n' ||
+        COALESCE(events, '') || E'\n' ||
+        COALESCE(emotions, '') || E'\n' ||
+        COALESCE(good_things, '') || E'\n' ||
+        COALESCE(reflections, '') || E'\n' ||
+        COALESCE(gratitude, '') || E'\n' ||
+        COALESCE(tomorrow_goals, '') || E'\n' ||
+        COALESCE(tomorrow_looking_forward, '') || E'\n' ||
+        COALESCE(learnings, '') || E'\n' ||
+        COALESCE(health_habits, '') || E'\n' ||
+        COALESCE(today_in_one_word, '')
+    ) STORED;
+
+CREATE INDEX IF NOT EXISTS idx_diary_entries_search_text
+    ON diary_entries USING GIN (search_text gin_trgm_ops);
@@ -0,0 +1,24 @@
+-- 日記のタグ。タグはユーザーごとに管理し、大文字小文字の違いは同じタグとして扱う
+CREATE TABLE IF NOT EXISTS tags (
+    id         UUID        NOT NULL DEFAULT gen_random_uuid(),
+    user_id    UUID        NOT NULL,
+    name       VARCHAR(50) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    CONSTRAINT tags_pkey PRIMARY KEY (id),
+    CONSTRAINT tags_user_id_fkey FOREIGN KEY (user_id)
+        REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_tags_user_id_lower_name ON tags (user_id, lower(name));
+
+CREATE TABLE IF NOT EXISTS diary_entry_tags (
+    diary_entry_id UUID NOT NULL,
+    tag_id         UUID NOT NULL,
+    CONSTRAINT diary_entry_tags_pkey PRIMARY KEY (diary_entry_id, tag_id),
+    CONSTRAINT diary_entry_tags_diary_entry_id_fkey FOREIGN KEY (diary_entry_id)
+        REFERENCES diary_entries(id) ON DELETE CASCADE,
+    CONSTRAINT diary_entry_tags_tag_id_fkey FOREIGN KEY (tag_id)
+        REFERENCES tags(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_diary_entry_tags_tag_id ON diary_entry_tags(tag_id);
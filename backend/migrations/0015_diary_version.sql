@@ -0,0 +1,2 @@
+-- 楽観的排他制御用。日記を更新するたびに1増やし、ETag として返す
+ALTER TABLE diary_entries ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 1;
@@ -0,0 +1,13 @@
+-- 日記の過去の版。更新のたびに更新前の内容を記録し、DIARY_REVISION_LIMIT を超えた古い版は削除する
+CREATE TABLE IF NOT EXISTS diary_entry_revisions (
+    diary_entry_id UUID        NOT NULL,
+    revision       BIGINT      NOT NULL,
+    user_id        UUID,
+    snapshot       JSONB       NOT NULL,
+    created_at     TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    CONSTRAINT diary_entry_revisions_pkey PRIMARY KEY (diary_entry_id, revision),
+    CONSTRAINT diary_entry_revisions_diary_entry_id_fkey FOREIGN KEY (diary_entry_id)
+        REFERENCES diary_entries(id) ON DELETE CASCADE,
+    CONSTRAINT diary_entry_revisions_user_id_fkey FOREIGN KEY (user_id)
+        REFERENCES users(id) ON DELETE SET NULL
+);
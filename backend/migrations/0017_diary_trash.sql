@@ -0,0 +1,7 @@
+-- ゴミ箱。deleted_at が設定された日記は一覧・検索・公開ページから除外し、
+-- DIARY_TRASH_RETENTION_DAYS の経過後に RunMaintenance が添付ファイルごと削除する
+ALTER TABLE diary_entries ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS idx_diary_entries_trash
+    ON diary_entries (user_id, deleted_at DESC)
+    WHERE deleted_at IS NOT NULL;
@@ -0,0 +1,6 @@
+-- 下書き。is_draft の日記は一覧・検索・公開ページに出さず、公開(publish)で通常の日記になる
+ALTER TABLE diary_entries ADD COLUMN IF NOT EXISTS is_draft BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE INDEX IF NOT EXISTS idx_diary_entries_drafts
+    ON diary_entries (user_id, updated_at DESC)
+    WHERE is_draft = TRUE;
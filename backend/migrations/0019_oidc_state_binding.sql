@@ -0,0 +1,2 @@
+-- 認可リクエストを開始したブラウザに結び付けるための値。平文は httpOnly Cookie にのみ置き、DBにはハッシュを保存する
+ALTER TABLE oidc_login_states ADD COLUMN IF NOT EXISTS binding_hash VARCHAR(64);
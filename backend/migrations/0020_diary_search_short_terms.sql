@@ -0,0 +1,40 @@
+-- 1〜2文字の検索語用のインデックス。pg_trgm のトライグラムは3文字未満の ILIKE パターンに使えず、
+-- 日本語の検索語の多くが逐次走査になるため、検索語を小文字化した1文字・2文字の断片の配列を GIN で索引付けする。
+-- 標準の PostgreSQL イメージで動くよう pg_bigm などの拡張は使わない。
+
+-- トライグラム・断片の抽出は文字コードと LC_CTYPE に依存する。C / POSIX ロケールや UTF-8 以外の
+-- データベースでは日本語が正しく扱われないため、マイグレーションを失敗させる。
+DO $$
+DECLARE
+    db_encoding TEXT;
+    db_ctype    TEXT;
+BEGIN
+    SELECT pg_encoding_to_char(encoding), datctype INTO db_encoding, db_ctype
+    FROM pg_database
+    WHERE datname = current_database();
+
+    IF db_encoding <> 'UTF8' THEN
+        RAISE EXCEPTION 'diary search requires a UTF8 database (found %)', db_encoding;
+    END IF;
+    IF db_ctype IN ('C', 'POSIX') THEN
+        RAISE EXCEPTION 'diary search requires a UTF-8 LC_CTYPE such as en_US.UTF-8 or ja_JP.UTF-8 (found %)', db_ctype;
+    END IF;
+END
+$$;
+
+-- 空白を含まない1文字・2文字の断片。検索語は空白で区切るため、空白をまたぐ断片は不要
+CREATE OR REPLACE FUNCTION diary_search_grams(body TEXT) RETURNS TEXT[]
+LANGUAGE sql IMMUTABLE STRICT PARALLEL SAFE AS $$
+    SELECT COALESCE(array_agg(DISTINCT gram), '{}')
+    FROM (
+        SELECT substr(t, i, n) AS gram
+        FROM (SELECT lower(body) AS t) lowered,
+            generate_series(1, char_length(t)) AS i,
+            (VALUES (1), (2)) AS lengths(n)
+        WHERE i + n - 1 <= char_length(t)
+    ) grams
+    WHERE gram !~ '\s'
+$$;
+
+CREATE INDEX IF NOT EXISTS idx_diary_entries_search_grams
+    ON diary_entries USING GIN (diary_search_grams(search_text));
@@ -0,0 +1,13 @@
+-- アップロードした画像・音声の所有者。DELETE /api/files/{filename} で他人のファイルを削除できないようにする。
+-- このテーブルより前にアップロードされたファイルは記録がないため、日記の完全削除時にのみ削除される
+CREATE TABLE IF NOT EXISTS uploaded_files (
+    name       VARCHAR(255) NOT NULL,
+    dir        VARCHAR(16)  NOT NULL,
+    user_id    UUID         NOT NULL,
+    created_at TIMESTAMPTZ  NOT NULL DEFAULT NOW(),
+    CONSTRAINT uploaded_files_pkey PRIMARY KEY (name),
+    CONSTRAINT uploaded_files_user_id_fkey FOREIGN KEY (user_id)
+        REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_uploaded_files_user_id ON uploaded_files (user_id);
@@ -4,7 +4,7 @@ import Link from "next/link";
 import { ChangeEvent, FormEvent, useEffect, useMemo, useState } from "react";
 import { useRouter } from "next/navigation";
 
-import { apiFileUrl, apiRequest } from "@/lib/api";
+import { apiFileUrl, apiRequest, apiRequestAll } from "@/lib/api";
 import { clearAuthToken, getAuthToken } from "@/lib/auth";
 import { defaultDiaryForm, entryToDiaryForm, type DiaryForm, weatherOptions } from "@/lib/diaryForm";
 import {
@@ -52,7 +52,7 @@ export default function DiaryListPage() {
   }, [router]);
 
   const fetchDiaries = async (currentToken: string) => {
-    const data = await apiRequest<DiaryEntry[]>("/api/diaries", { token: currentToken });
+    const data = await apiRequestAll<DiaryEntry>("/api/diaries?limit=100", { token: currentToken });
     setEntries(data);
   };
 
@@ -375,7 +375,7 @@ export default function DiaryListPage() {
       {confirmDeleteId ? (
         <div className="fixed inset-0 z-50 flex items-center justify-center bg-black/50 p-4">
           <div className="w-full max-w-sm rounded-xl bg-white p-5 text-zinc-900 dark:bg-zinc-900 dark:text-zinc-100">
-            <p className="mb-4 text-zinc-900 dark:text-zinc-100">この日記を削除しますか？</p>
+            <p className="mb-4 text-zinc-900 dark:text-zinc-100">この日記をゴミ箱に移動しますか？</p>
             <div className="flex justify-end gap-2">
               <button
                 type="button"
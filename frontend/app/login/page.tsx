@@ -25,7 +25,7 @@ export default function LoginPage() {
         method: "POST",
         body: { email, password },
       });
-      setAuthToken(data.token);
+      setAuthToken(data.token, data.refresh_token);
       setUserCache(JSON.stringify(data.user));
       router.push("/diary");
     } catch (err) {
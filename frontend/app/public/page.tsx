@@ -2,22 +2,45 @@
 
 import { useEffect, useState } from "react";
 
-import { apiRequest } from "@/lib/api";
+import { apiRequestPage } from "@/lib/api";
 import type { PublicDiaryEntry } from "@/lib/types";
 import { DiaryCard } from "@/components/DiaryCard";
 
 export default function PublicPage() {
   const [entries, setEntries] = useState<PublicDiaryEntry[]>([]);
+  const [nextCursor, setNextCursor] = useState<string | null>(null);
+  const [loadingMore, setLoadingMore] = useState(false);
   const [error, setError] = useState<string | null>(null);
 
   useEffect(() => {
-    apiRequest<PublicDiaryEntry[]>("/api/diaries/public")
-      .then((data) => setEntries(data))
+    apiRequestPage<PublicDiaryEntry>("/api/diaries/public")
+      .then((page) => {
+        setEntries(page.data);
+        setNextCursor(page.nextCursor);
+      })
       .catch((err) => {
         setError(err instanceof Error ? err.message : "公開日記の取得に失敗しました");
       });
   }, []);
 
+  const loadMore = async () => {
+    if (!nextCursor) {
+      return;
+    }
+    setLoadingMore(true);
+    try {
+      const page = await apiRequestPage<PublicDiaryEntry>(
+        `/api/diaries/public?cursor=${encodeURIComponent(nextCursor)}`,
+      );
+      setEntries((current) => [...current, ...page.data]);
+      setNextCursor(page.nextCursor);
+    } catch (err) {
+      setError(err instanceof Error ? err.message : "公開日記の取得に失敗しました");
+    } finally {
+      setLoadingMore(false);
+    }
+  };
+
   return (
     <main className="mx-auto max-w-5xl space-y-4 px-4 py-6">
       <h1 className="text-2xl font-bold">みんなの日記</h1>
@@ -25,6 +48,16 @@ export default function PublicPage() {
       {entries.map((entry) => (
         <DiaryCard key={entry.id} entry={entry} />
       ))}
+      {nextCursor ? (
+        <button
+          type="button"
+          onClick={loadMore}
+          disabled={loadingMore}
+          className="w-full rounded border border-zinc-300 px-4 py-2 text-sm text-zinc-700 hover:bg-zinc-100 disabled:opacity-50 dark:border-zinc-700 dark:text-zinc-200 dark:hover:bg-zinc-900"
+        >
+          {loadingMore ? "読み込み中..." : "もっと見る"}
+        </button>
+      ) : null}
     </main>
   );
 }
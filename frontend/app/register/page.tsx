@@ -36,7 +36,7 @@ export default function RegisterPage() {
           password,
         },
       });
-      setAuthToken(data.token);
+      setAuthToken(data.token, data.refresh_token);
       setUserCache(JSON.stringify(data.user));
       router.push("/diary");
     } catch (err) {
@@ -56,6 +56,10 @@ export function AppHeader() {
   };
 
   const logout = () => {
+    const token = getAuthToken();
+    if (token) {
+      void apiRequest<{ message: string }>("/api/auth/logout", { method: "POST", token }).catch(() => null);
+    }
     clearAuthToken();
     setUser(null);
     router.push("/login");
@@ -1,6 +1,11 @@
-import type { ApiError, ApiResponse } from "@/lib/types";
+import { getCsrfToken, getRefreshToken, setAuthToken } from "@/lib/auth";
+import type { ApiError, ApiResponse, TokenResponseData } from "@/lib/types";
 
 const API_BASE = process.env.NEXT_PUBLIC_API_BASE_URL ?? "http://localhost:8000";
+// API 側で AUTH_COOKIE_ENABLED を有効にした場合のみ Cookie を送受信する
+const USE_AUTH_COOKIE = process.env.NEXT_PUBLIC_AUTH_COOKIE === "true";
+// OIDC の開始とコールバックはバインド用 Cookie をやり取りするため、設定に関わらず Cookie を送受信する
+const OIDC_PATH_PREFIX = "/api/auth/oidc/";
 
 type RequestOptions = {
   method?: "GET" | "POST" | "PUT" | "PATCH" | "DELETE";
@@ -9,36 +14,113 @@ type RequestOptions = {
   isForm?: boolean;
 };
 
-export async function apiRequest<T>(
+let refreshing: Promise<string | null> | null = null;
+
+// アクセストークン期限切れ時にリフレッシュトークンで再発行する。同時実行は1回にまとめる。
+async function refreshAccessToken(): Promise<string | null> {
+  const refreshToken = getRefreshToken();
+  const csrfToken = USE_AUTH_COOKIE ? getCsrfToken() : null;
+  if (!refreshToken && !csrfToken) {
+    return null;
+  }
+  if (!refreshing) {
+    const headers: Record<string, string> = { "Content-Type": "application/json" };
+    if (csrfToken) {
+      headers["X-CSRF-Token"] = csrfToken;
+    }
+    refreshing = fetch(`${API_BASE}/api/auth/refresh`, {
+      method: "POST",
+      headers,
+      body: refreshToken ? JSON.stringify({ refresh_token: refreshToken }) : undefined,
+      credentials: USE_AUTH_COOKIE ? "include" : "same-origin",
+      cache: "no-store",
+    })
+      .then(async (response) => {
+        if (!response.ok) {
+          return null;
+        }
+        const json = (await response.json()) as ApiResponse<TokenResponseData>;
+        setAuthToken(json.data.token, json.data.refresh_token);
+        return json.data.token;
+      })
+      .catch(() => null)
+      .finally(() => {
+        refreshing = null;
+      });
+  }
+  return refreshing;
+}
+
+async function apiFetch<T>(
   path: string,
-  options: RequestOptions = {},
-): Promise<T> {
+  options: RequestOptions,
+  retried = false,
+): Promise<ApiResponse<T>> {
   const { method = "GET", token, body, isForm = false } = options;
 
-  const headers: HeadersInit = {};
+  const headers: Record<string, string> = {};
   if (!isForm) {
     headers["Content-Type"] = "application/json";
   }
   if (token) {
     headers.Authorization = `Bearer ${token}`;
   }
+  const csrfToken = USE_AUTH_COOKIE ? getCsrfToken() : null;
+  if (csrfToken && method !== "GET") {
+    headers["X-CSRF-Token"] = csrfToken;
+  }
 
   const response = await fetch(`${API_BASE}${path}`, {
     method,
     headers,
     body: isForm ? (body as FormData) : body ? JSON.stringify(body) : undefined,
+    credentials: USE_AUTH_COOKIE || path.startsWith(OIDC_PATH_PREFIX) ? "include" : "same-origin",
     cache: "no-store",
   });
 
+  if (response.status === 401 && (token || csrfToken) && !retried) {
+    const nextToken = await refreshAccessToken();
+    if (nextToken) {
+      return apiFetch<T>(path, { ...options, token: nextToken }, true);
+    }
+  }
+
   if (!response.ok) {
     const errorJson = (await response.json().catch(() => null)) as ApiError | null;
     throw new Error(errorJson?.error ?? "API通信に失敗しました");
   }
 
-  const json = (await response.json()) as ApiResponse<T>;
+  return (await response.json()) as ApiResponse<T>;
+}
+
+export async function apiRequest<T>(path: string, options: RequestOptions = {}): Promise<T> {
+  const json = await apiFetch<T>(path, options);
   return json.data;
 }
 
+// カーソルページングの一覧を1ページ取得する
+export async function apiRequestPage<T>(
+  path: string,
+  options: RequestOptions = {},
+): Promise<{ data: T[]; nextCursor: string | null }> {
+  const json = await apiFetch<T[]>(path, options);
+  return { data: json.data, nextCursor: json.next_cursor ?? null };
+}
+
+// カーソルページングの一覧を next_cursor がなくなるまで取得する
+export async function apiRequestAll<T>(path: string, options: RequestOptions = {}): Promise<T[]> {
+  const items: T[] = [];
+  let cursor: string | null | undefined = null;
+  do {
+    const separator = path.includes("?") ? "&" : "?";
+    const pagePath: string = cursor ? `${path}${separator}cursor=${encodeURIComponent(cursor)}` : path;
+    const json: ApiResponse<T[]> = await apiFetch<T[]>(pagePath, options);
+    items.push(...json.data);
+    cursor = json.next_cursor;
+  } while (cursor);
+  return items;
+}
+
 export function apiFileUrl(path: string | null): string | null {
   if (!path) {
     return null;
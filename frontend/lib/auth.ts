@@ -1,9 +1,13 @@
 const TOKEN_KEY = "diary_token";
+const REFRESH_TOKEN_KEY = "diary_refresh_token";
 const USER_KEY = "diary_user";
 
-export function setAuthToken(token: string): void {
+export function setAuthToken(token: string, refreshToken?: string): void {
   localStorage.setItem(TOKEN_KEY, token);
-  document.cookie = `auth_token=${token}; path=/; max-age=${60 * 60 * 24}; samesite=lax`;
+  if (refreshToken) {
+    localStorage.setItem(REFRESH_TOKEN_KEY, refreshToken);
+  }
+  document.cookie = `auth_token=${token}; path=/; max-age=${60 * 60 * 24 * 30}; samesite=lax`;
 }
 
 export function getAuthToken(): string | null {
@@ -13,8 +17,25 @@ export function getAuthToken(): string | null {
   return localStorage.getItem(TOKEN_KEY);
 }
 
+export function getRefreshToken(): string | null {
+  if (typeof window === "undefined") {
+    return null;
+  }
+  return localStorage.getItem(REFRESH_TOKEN_KEY);
+}
+
+// Cookie 認証時に API が発行する CSRF トークン（httpOnly ではない Cookie）を返す。
+export function getCsrfToken(): string | null {
+  if (typeof document === "undefined") {
+    return null;
+  }
+  const match = document.cookie.match(/(?:^|;\s*)diary_csrf=([^;]+)/);
+  return match ? decodeURIComponent(match[1]) : null;
+}
+
 export function clearAuthToken(): void {
   localStorage.removeItem(TOKEN_KEY);
+  localStorage.removeItem(REFRESH_TOKEN_KEY);
   localStorage.removeItem(USER_KEY);
   document.cookie = "auth_token=; path=/; max-age=0; samesite=lax";
 }
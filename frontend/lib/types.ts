@@ -5,14 +5,22 @@ export type User = {
   email: string;
   display_name: string;
   profile_image_url: NullableString;
+  email_verified_at: NullableString;
+  two_factor_enabled: boolean;
   created_at: string;
 };
 
 export type AuthResponseData = {
   token: string;
+  refresh_token: string;
   user: User;
 };
 
+export type TokenResponseData = {
+  token: string;
+  refresh_token: string;
+};
+
 export type DiaryEntry = {
   id: string;
   user_id: string;
@@ -34,6 +42,8 @@ export type DiaryEntry = {
   learnings: NullableString;
   health_habits: NullableString;
   today_in_one_word: NullableString;
+  tags: string[];
+  is_draft: boolean;
   created_at: string;
   updated_at: string;
 };
@@ -56,12 +66,15 @@ export type PublicDiaryEntry = {
   health_habits: NullableString;
   today_in_one_word: NullableString;
   created_at: string;
+  author_id: string;
   author_name: string;
   author_photo: NullableString;
 };
 
 export type ApiResponse<T> = {
   data: T;
+  // 一覧 API で次のページがある場合のカーソル
+  next_cursor?: string | null;
 };
 
 export type ApiError = {